@@ -223,6 +223,43 @@ type Backups struct {
 	// Defaults to 0 (unlimited)
 	WriteLimit int `default:"0" yaml:"write_limit"`
 
+	// RestoreRateLimit imposes a Disk I/O write limit when restoring a backup or
+	// decompressing an archive, this is configured independently of WriteLimit.
+	//
+	// If the value is less than 1, the write speed is unlimited,
+	// if the value is greater than 0, the write speed is the value in MiB/s.
+	//
+	// Defaults to 0 (unlimited)
+	RestoreRateLimit int `default:"0" yaml:"restore_rate_limit"`
+
+	// RestoreUmask is an octal umask, such as "022", that is applied to the mode of
+	// every file written when restoring a backup or decompressing an archive. This
+	// allows a consistent permission policy for restored files regardless of the
+	// modes stored in the archive.
+	//
+	// If the value is empty, the modes stored in the archive are used exactly.
+	//
+	// Defaults to "" (stored modes)
+	RestoreUmask string `default:"" yaml:"restore_umask"`
+
+	// RestoreMaxPathDepth is the maximum number of components the path of a file
+	// being written when restoring a backup or decompressing an archive may have.
+	// Crafted archives containing very deeply nested paths are rejected rather than
+	// exhausting resources creating every parent directory.
+	//
+	// If the value is less than 1, the depth is unlimited.
+	//
+	// Defaults to 256
+	RestoreMaxPathDepth int `default:"256" yaml:"restore_max_path_depth"`
+
+	// RestoreMaxPathLength is the maximum length in bytes of the path of a file
+	// being written when restoring a backup or decompressing an archive.
+	//
+	// If the value is less than 1, the length is unlimited.
+	//
+	// Defaults to 4096
+	RestoreMaxPathLength int `default:"4096" yaml:"restore_max_path_length"`
+
 	// CompressionLevel determines how much backups created by wings should be compressed.
 	//
 	// "none" -> no compression will be applied
@@ -231,6 +268,100 @@ type Backups struct {
 	//
 	// Defaults to "best_speed" (level 1)
 	CompressionLevel string `default:"best_speed" yaml:"compression_level"`
+
+	// AdaptiveCompression lowers the gzip compression level used for backups while
+	// the system is under heavy CPU load, and raises it again once the load drops,
+	// so that creating a backup does not compete with running servers. The level
+	// is kept between MinCompressionLevel and MaxCompressionLevel. This has no
+	// effect if CompressionLevel is "none".
+	AdaptiveCompression bool `default:"false" yaml:"adaptive_compression"`
+	MinCompressionLevel int  `default:"1" yaml:"min_compression_level"`
+	MaxCompressionLevel int  `default:"9" yaml:"max_compression_level"`
+
+	// MemoryBudget is the approximate maximum amount of memory in MiB that the
+	// compressor may use while creating a backup. The compressor splits the backup
+	// into blocks that are compressed in parallel, using roughly
+	//
+	//   (blocks + 2) * 3 * block size
+	//
+	// bytes of memory. When a budget is set the number of blocks, and if needed the
+	// size of each block, is chosen to stay within it, allowing more parallelism
+	// for larger budgets and trading throughput for bounded memory on smaller ones.
+	// The buffers used to copy each file into the backup are a fixed 4 KiB and are
+	// not counted against the budget.
+	//
+	// If the value is less than 1, a single 1 MiB block is compressed at a time
+	// (approximately 9 MiB).
+	//
+	// Defaults to 0
+	MemoryBudget int `default:"0" yaml:"memory_budget"`
+
+	// OpenRetries is the number of times a file will be re-opened when creating a
+	// backup if it fails to open due to a transient error. This is most useful for
+	// servers whose data is stored on network mounted storage such as NFS.
+	//
+	// Defaults to 3
+	OpenRetries int `default:"3" yaml:"open_retries"`
+
+	// FileTimeout is the maximum number of seconds that copying a single file into
+	// a backup can take before the copy is abandoned. This protects backups from
+	// stalling on files stored on a hung network mount.
+	//
+	// If the value is less than 1, there is no timeout.
+	//
+	// Defaults to 0 (no timeout)
+	FileTimeout int `default:"0" yaml:"file_timeout"`
+
+	// MaxDuration is the maximum number of seconds that creating a backup can take.
+	// A backup that takes longer is abandoned and fails, rather than overlapping
+	// with the next scheduled backup of the server.
+	//
+	// If the value is less than 1, there is no limit.
+	//
+	// Defaults to 0 (no limit)
+	MaxDuration int `default:"0" yaml:"max_duration"`
+
+	// LowPriorityIO places the process creating a backup into the idle I/O scheduling
+	// class, ensuring that disk I/O from running servers is always favored over the
+	// backup. This is only supported on Linux and is ignored on other platforms.
+	//
+	// Defaults to false
+	LowPriorityIO bool `default:"false" yaml:"low_priority_io"`
+
+	// ShardedLayout stores local backups in nested directories named after the first
+	// characters of their uuid, such as "ab/cd/abcd1234-....tar.gz", rather than all
+	// in the backup directory itself. This keeps directories small enough to list
+	// and stat quickly on nodes storing a large number of backups. Backups stored
+	// using the other layout are still found, so this can be changed at any time.
+	//
+	// Defaults to false
+	ShardedLayout bool `default:"false" yaml:"sharded_layout"`
+
+	// PreserveACLs records the POSIX access ACL of every file in a backup, and applies
+	// it again when the backup is restored or an archive is decompressed. Restoring
+	// an ACL requires the privileges to set it on the file, and ACLs are only
+	// supported on Linux filesystems mounted with ACL support.
+	//
+	// Defaults to false
+	PreserveACLs bool `default:"false" yaml:"preserve_acls"`
+
+	// IgnoreDefaults leaves files created by operating systems and editors, such as
+	// ".DS_Store", "Thumbs.db" and Vim swap files, out of backups. See
+	// filesystem.DefaultIgnore for the full list of patterns, any of them can be
+	// included again with a negated pattern in the ignore rules of a backup.
+	//
+	// Defaults to true
+	IgnoreDefaults bool `default:"true" yaml:"ignore_defaults"`
+
+	// TempDirectory is the directory backups are written to while they are being
+	// created, they are moved to the backup directory once complete. This allows
+	// the scratch I/O of creating a backup to be placed on a larger volume than
+	// the backup directory. The directory must exist and be writable.
+	//
+	// If the value is empty, backups are written directly to the backup directory.
+	//
+	// Defaults to ""
+	TempDirectory string `default:"" yaml:"temp_directory"`
 }
 
 type Transfers struct {
@@ -585,6 +716,12 @@ func (sc *SystemConfiguration) GetStatesPath() string {
 	return path.Join(sc.RootDirectory, "/states.json")
 }
 
+// GetBackupRecordsPath returns the location of the JSON file that tracks the
+// last successful backup of each server.
+func (sc *SystemConfiguration) GetBackupRecordsPath() string {
+	return path.Join(sc.RootDirectory, "/backups.json")
+}
+
 // ConfigureTimezone sets the timezone data for the configuration if it is
 // currently missing. If a value has been set, this functionality will only run
 // to validate that the timezone being used is valid.
@@ -131,9 +131,15 @@ func (re *RequestError) asFilesystemError() (int, string) {
 	if filesystem.IsErrorCode(err, filesystem.ErrCodeIsDirectory) || strings.Contains(err.Error(), "filesystem: is a directory") {
 		return http.StatusBadRequest, "Cannot perform that action: file is a directory."
 	}
-	if filesystem.IsErrorCode(err, filesystem.ErrCodeDiskSpace) || strings.Contains(err.Error(), "filesystem: not enough disk space") {
+	if filesystem.IsErrorCode(err, filesystem.ErrCodeDiskSpace) || errors.Is(err, filesystem.ErrNoSpace) || strings.Contains(err.Error(), "filesystem: not enough disk space") {
 		return http.StatusBadRequest, "There is not enough disk space available to perform that action."
 	}
+	if errors.Is(err, filesystem.ErrPermission) {
+		return http.StatusBadRequest, "Cannot perform that action: one or more files could not be accessed due to their permissions."
+	}
+	if errors.Is(err, filesystem.ErrArchiveTooLarge) {
+		return http.StatusBadRequest, "Cannot perform that action: the files are too large to archive."
+	}
 	if strings.HasSuffix(err.Error(), "file name too long") {
 		return http.StatusBadRequest, "Cannot perform that action: file name is too long."
 	}
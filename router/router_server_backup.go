@@ -12,6 +12,7 @@ import (
 	"github.com/pterodactyl/wings/router/middleware"
 	"github.com/pterodactyl/wings/server"
 	"github.com/pterodactyl/wings/server/backup"
+	"github.com/pterodactyl/wings/server/filesystem"
 )
 
 // postServerBackup performs a backup against a given server instance using the
@@ -73,6 +74,9 @@ func postServerRestoreBackup(c *gin.Context) {
 	var data struct {
 		Adapter           backup.AdapterType `binding:"required,oneof=wings s3" json:"adapter"`
 		TruncateDirectory bool               `json:"truncate_directory"`
+		// ConflictPolicy determines what happens to files that already exist, by
+		// default they are overwritten by the files in the backup.
+		ConflictPolicy filesystem.ConflictPolicy `binding:"omitempty,oneof=overwrite newer_wins skip" json:"conflict_policy"`
 		// A UUID is always required for this endpoint, however the download URL
 		// is only present when the given adapter type is s3.
 		DownloadUrl string `json:"download_url"`
@@ -114,7 +118,7 @@ func postServerRestoreBackup(c *gin.Context) {
 		}
 		go func(s *server.Server, b backup.BackupInterface, logger *log.Entry) {
 			logger.Info("starting restoration process for server backup using local driver")
-			if err := s.RestoreBackup(b, nil); err != nil {
+			if err := s.RestoreBackup(b, nil, data.ConflictPolicy); err != nil {
 				logger.WithField("error", err).Error("failed to restore local backup to server")
 			}
 			s.Events().Publish(server.DaemonMessageEvent, "Completed server restoration from local backup.")
@@ -158,7 +162,7 @@ func postServerRestoreBackup(c *gin.Context) {
 
 	go func(s *server.Server, uuid string, logger *log.Entry) {
 		logger.Info("starting restoration process for server backup using S3 driver")
-		if err := s.RestoreBackup(backup.NewS3(client, uuid, ""), res.Body); err != nil {
+		if err := s.RestoreBackup(backup.NewS3(client, uuid, ""), res.Body, data.ConflictPolicy); err != nil {
 			logger.WithField("error", errors.WithStack(err)).Error("failed to restore remote S3 backup to server")
 		}
 		s.Events().Publish(server.DaemonMessageEvent, "Completed server restoration from S3 backup.")
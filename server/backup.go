@@ -1,6 +1,7 @@
 package server
 
 import (
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
@@ -13,6 +14,7 @@ import (
 	"github.com/pterodactyl/wings/environment"
 	"github.com/pterodactyl/wings/remote"
 	"github.com/pterodactyl/wings/server/backup"
+	"github.com/pterodactyl/wings/server/filesystem"
 )
 
 // Notifies the panel of a backup's state and returns an error if one is encountered
@@ -68,6 +70,15 @@ func (s *Server) Backup(b backup.BackupInterface) error {
 		}
 	}
 
+	b.SetServer(s.ID())
+	// Publish the progress of the backup over the socket while it is generated.
+	b.SetProgressEvents(&filesystem.ProgressEvents{
+		Emitter: s.Events(),
+		Topic:   BackupProgressEvent + ":" + b.Identifier(),
+		ID:      b.Identifier(),
+		Total:   s.Filesystem().CachedUsage(),
+	})
+
 	ad, err := b.Generate(s.Context(), s.Filesystem().Path(), ignored)
 	if err != nil {
 		if err := s.notifyPanelOfBackup(b.Identifier(), &backup.ArchiveDetails{}, false); err != nil {
@@ -120,7 +131,10 @@ func (s *Server) Backup(b backup.BackupInterface) error {
 //
 // In addition to the websocket event an API call is triggered to notify the
 // Panel of the new state.
-func (s *Server) RestoreBackup(b backup.BackupInterface, reader io.ReadCloser) (err error) {
+//
+// The policy determines whether files that already exist on the disk are replaced
+// by the files in the backup, see filesystem.ConflictPolicy.
+func (s *Server) RestoreBackup(b backup.BackupInterface, reader io.ReadCloser, policy filesystem.ConflictPolicy) (err error) {
 	s.Config().SetSuspended(true)
 	// Local backups will not pass a reader through to this function, so check first
 	// to make sure it is a valid reader before trying to close it.
@@ -149,19 +163,58 @@ func (s *Server) RestoreBackup(b backup.BackupInterface, reader io.ReadCloser) (
 		}
 	}
 
+	// Refuse to restore a local backup that could never fit on the disk of the
+	// server, rather than failing part way through writing it.
+	if lb, ok := b.(*backup.LocalBackup); ok {
+		if err = s.Filesystem().HasSpaceForRestore(lb.Path()); err != nil {
+			return err
+		}
+	}
+
 	// Attempt to restore the backup to the server by running through each entry
 	// in the file one at a time and writing them to the disk.
 	s.Log().Debug("starting file writing process for backup restoration")
-	err = b.Restore(s.Context(), reader, func(file string, r io.Reader, mode fs.FileMode, atime, mtime time.Time) error {
+	var counts filesystem.RestoreCounts
+	err = b.Restore(s.Context(), reader, func(file string, r io.Reader, mode fs.FileMode, atime, mtime time.Time, records map[string]string, link string) error {
+		keep, err := s.Filesystem().KeepExisting(file, mtime, policy)
+		if err != nil {
+			return err
+		}
+		if keep {
+			counts.Kept++
+			s.Events().Publish(DaemonMessageEvent, "(keeping existing file): "+file)
+			return nil
+		}
 		s.Events().Publish(DaemonMessageEvent, "(restoring): "+file)
-		if err := s.Filesystem().Writefile(file, r); err != nil {
+		// The file a hardlink points at has already been restored, along with its
+		// mode, ACL and times, which the link shares.
+		if link != "" {
+			if err := s.Filesystem().LinkRestoredFile(link, file); err != nil {
+				return err
+			}
+			counts.Written++
+			return nil
+		}
+		write := s.Filesystem().WriteRestoredFile
+		if filesystem.SparseRecords(records) {
+			write = s.Filesystem().WriteRestoredSparseFile
+		}
+		if err := write(file, r); err != nil {
+			return err
+		}
+		if err := s.Filesystem().ChmodRestored(file, mode); err != nil {
 			return err
 		}
-		if err := s.Filesystem().Chmod(file, mode); err != nil {
+		if err := s.Filesystem().RestoreACL(file, records); err != nil {
 			return err
 		}
+		counts.Written++
 		return s.Filesystem().Chtimes(file, atime, mtime)
 	})
+	if policy == filesystem.ConflictNewerWins || policy == filesystem.ConflictSkip {
+		s.Log().WithField("written", counts.Written).WithField("kept", counts.Kept).WithField("policy", policy).Info("restored backup while keeping existing files")
+		s.Events().Publish(DaemonMessageEvent, fmt.Sprintf("Restored %d files, kept %d existing files.", counts.Written, counts.Kept))
+	}
 
 	return errors.WithStackIf(err)
 }
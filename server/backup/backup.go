@@ -1,6 +1,7 @@
 package backup
 
 import (
+	"archive/tar"
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
@@ -16,6 +17,7 @@ import (
 
 	"github.com/pterodactyl/wings/config"
 	"github.com/pterodactyl/wings/remote"
+	"github.com/pterodactyl/wings/server/filesystem"
 )
 
 type AdapterType string
@@ -26,13 +28,44 @@ const (
 )
 
 // RestoreCallback is a generic restoration callback that exists for both local
-// and remote backups allowing the files to be restored.
-type RestoreCallback func(file string, r io.Reader, mode fs.FileMode, atime, mtime time.Time) error
+// and remote backups allowing the files to be restored. The records are the PAX
+// records of the file in the archive, if any. If the file is a hardlink, link is
+// the name of the file it points at, which has already been restored, and r is
+// empty.
+type RestoreCallback func(file string, r io.Reader, mode fs.FileMode, atime, mtime time.Time, records map[string]string, link string) error
+
+// errRestoreStopped stops walking a backup that is being restored once the
+// restore has been canceled.
+var errRestoreStopped = errors.Sentinel("backup: restore stopped")
+
+// restoreEntry calls the callback for an entry of a backup being restored if it
+// is a regular file or a hardlink, every other entry is skipped. Entries without
+// an access time use their modification time in its place.
+func restoreEntry(header *tar.Header, r io.Reader, callback RestoreCallback) error {
+	atime := header.AccessTime
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeGNUSparse:
+		return callback(header.Name, r, header.FileInfo().Mode(), atime, header.ModTime, header.PAXRecords, "")
+	case tar.TypeLink:
+		return callback(header.Name, r, header.FileInfo().Mode(), atime, header.ModTime, header.PAXRecords, header.Linkname)
+	}
+	return nil
+}
 
 // noinspection GoNameStartsWithPackageName
 type BackupInterface interface {
 	// SetClient sets the API request client on the backup interface.
 	SetClient(remote.Client)
+	// SetProgressEvents sets where the progress of the backup is published while
+	// it is being generated.
+	SetProgressEvents(*filesystem.ProgressEvents)
+	// SetServer sets the UUID of the server that the backup is generated for, under
+	// which the backup is recorded once it has been created, see
+	// filesystem.LastBackup.
+	SetServer(string)
 	// Identifier returns the UUID of this backup as tracked by the panel
 	// instance.
 	Identifier() string
@@ -74,21 +107,78 @@ type Backup struct {
 	client     remote.Client
 	adapter    AdapterType
 	logContext map[string]interface{}
+
+	// path is the location the backup was found at on the disk, see Locate.
+	path string
+
+	// events is where the progress of the backup is published, if anywhere.
+	events *filesystem.ProgressEvents
+
+	// server is the UUID of the server that the backup belongs to, if known.
+	server string
 }
 
 func (b *Backup) SetClient(c remote.Client) {
 	b.client = c
 }
 
+func (b *Backup) SetProgressEvents(e *filesystem.ProgressEvents) {
+	b.events = e
+}
+
+func (b *Backup) SetServer(uuid string) {
+	b.server = uuid
+}
+
 func (b *Backup) Identifier() string {
 	return b.Uuid
 }
 
-// Path returns the path for this specific backup.
+// Path returns the path for this specific backup. This is where the backup was
+// found by Locate, otherwise it is where a new backup is stored using the layout
+// that is currently configured.
 func (b *Backup) Path() string {
+	if b.path != "" {
+		return b.path
+	}
+	if config.Get().System.Backups.ShardedLayout {
+		return b.shardedPath()
+	}
+	return b.flatPath()
+}
+
+// Locate finds the backup on the disk, checking both the flat and sharded layouts
+// so that backups created before the layout was changed can still be found. The
+// path of the backup is returned and used by Path from then on.
+func (b *Backup) Locate() (string, os.FileInfo, error) {
+	paths := []string{b.flatPath(), b.shardedPath()}
+	if config.Get().System.Backups.ShardedLayout {
+		paths[0], paths[1] = paths[1], paths[0]
+	}
+	var err error
+	for _, p := range paths {
+		var st os.FileInfo
+		if st, err = os.Stat(p); err == nil {
+			b.path = p
+			return p, st, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", nil, err
+		}
+	}
+	return "", nil, err
+}
+
+// flatPath returns the path of the backup stored directly in the backup directory.
+func (b *Backup) flatPath() string {
 	return path.Join(config.Get().System.BackupDirectory, b.Identifier()+".tar.gz")
 }
 
+// shardedPath returns the path of the backup when using the sharded layout.
+func (b *Backup) shardedPath() string {
+	return filesystem.ShardedPath(config.Get().System.BackupDirectory, b.Identifier(), ".tar.gz")
+}
+
 // Size returns the size of the generated backup.
 func (b *Backup) Size() (int64, error) {
 	st, err := os.Stat(b.Path())
@@ -1,13 +1,15 @@
 package backup
 
 import (
+	"archive/tar"
 	"context"
 	"io"
 	"os"
+	"time"
 
 	"emperror.dev/errors"
-	"github.com/mholt/archiver/v3"
 
+	"github.com/pterodactyl/wings/config"
 	"github.com/pterodactyl/wings/remote"
 	"github.com/pterodactyl/wings/server/filesystem"
 )
@@ -33,7 +35,7 @@ func NewLocal(client remote.Client, uuid string, ignore string) *LocalBackup {
 // will obviously only work if the backup was created as a local backup.
 func LocateLocal(client remote.Client, uuid string) (*LocalBackup, os.FileInfo, error) {
 	b := NewLocal(client, uuid, "")
-	st, err := os.Stat(b.Path())
+	_, st, err := b.Locate()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -45,8 +47,12 @@ func LocateLocal(client remote.Client, uuid string) (*LocalBackup, os.FileInfo,
 	return b, st, nil
 }
 
-// Remove removes a backup from the system.
+// Remove removes a backup, and the metadata file stored alongside it, from the
+// system.
 func (b *LocalBackup) Remove() error {
+	if err := os.Remove(filesystem.MetaPath(b.Path())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return os.Remove(b.Path())
 }
 
@@ -59,8 +65,17 @@ func (b *LocalBackup) WithLogContext(c map[string]interface{}) {
 // defined location for this instance.
 func (b *LocalBackup) Generate(ctx context.Context, basePath, ignore string) (*ArchiveDetails, error) {
 	a := &filesystem.Archive{
-		BasePath: basePath,
-		Ignore:   ignore,
+		BasePath:       basePath,
+		Ignore:         ignore,
+		MaxDuration:    time.Duration(config.Get().System.Backups.MaxDuration) * time.Second,
+		RecordACLs:     config.Get().System.Backups.PreserveACLs,
+		IgnoreDefaults: config.Get().System.Backups.IgnoreDefaults,
+		TempDir:        config.Get().System.Backups.TempDirectory,
+		ProgressEvents: b.events,
+		Server:         b.server,
+		// The metadata records the uncompressed size of the backup, which is checked
+		// before the backup is restored.
+		WriteMeta: true,
 	}
 
 	b.log().WithField("path", b.Path()).Info("creating backup for server")
@@ -79,16 +94,19 @@ func (b *LocalBackup) Generate(ctx context.Context, basePath, ignore string) (*A
 // Restore will walk over the archive and call the callback function for each
 // file encountered.
 func (b *LocalBackup) Restore(ctx context.Context, _ io.Reader, callback RestoreCallback) error {
-	return archiver.Walk(b.Path(), func(f archiver.File) error {
+	// The format of the backup is detected from its contents, so that a backup which
+	// was renamed or compressed differently can still be restored.
+	err := filesystem.WalkArchive(b.Path(), func(header *tar.Header, r io.Reader) error {
 		select {
 		case <-ctx.Done():
 			// Stop walking if the context is canceled.
-			return archiver.ErrStopWalk
+			return errRestoreStopped
 		default:
-			if f.IsDir() {
-				return nil
-			}
-			return callback(filesystem.ExtractNameFromArchive(f), f, f.Mode(), f.ModTime(), f.ModTime())
+			return restoreEntry(header, r, callback)
 		}
 	})
+	if errors.Is(err, errRestoreStopped) {
+		return nil
+	}
+	return err
 }
@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/pterodactyl/wings/config"
+	"github.com/pterodactyl/wings/server/filesystem"
+)
+
+func TestLocalBackup_Generate(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("Generate", func() {
+		var root string
+
+		g.BeforeEach(func() {
+			var err error
+			root, err = os.MkdirTemp(os.TempDir(), "pterodactyl")
+			g.Assert(err).IsNil()
+			g.Assert(os.MkdirAll(filepath.Join(root, "server"), 0o755)).IsNil()
+			g.Assert(os.MkdirAll(filepath.Join(root, "backups"), 0o755)).IsNil()
+			config.Set(&config.Configuration{
+				AuthenticationToken: "abc",
+				System: config.SystemConfiguration{
+					RootDirectory:   root,
+					BackupDirectory: filepath.Join(root, "backups"),
+				},
+			})
+		})
+
+		g.AfterEach(func() {
+			_ = os.RemoveAll(root)
+		})
+
+		g.It("records the backup as the last backup of its server", func() {
+			err := os.WriteFile(filepath.Join(root, "server", "test.txt"), []byte("hello"), 0o644)
+			g.Assert(err).IsNil()
+
+			b := NewLocal(nil, "backup-1", "")
+			b.SetServer("server-1")
+			ad, err := b.Generate(context.Background(), filepath.Join(root, "server"), "")
+			g.Assert(err).IsNil()
+
+			rec, err := filesystem.LastBackup("server-1")
+			g.Assert(err).IsNil()
+			g.Assert(rec != nil).IsTrue()
+			g.Assert(rec.Path).Equal(b.Path())
+			g.Assert(rec.Size).Equal(ad.Size)
+		})
+
+		g.It("restores a backup compressed with zstd", func() {
+			b := NewLocal(nil, "backup-2", "")
+			var buf bytes.Buffer
+			zw, err := zstd.NewWriter(&buf)
+			g.Assert(err).IsNil()
+			g.Assert(writeTestTarball(zw, map[string]string{"test.txt": "hello"})).IsNil()
+			g.Assert(zw.Close()).IsNil()
+			g.Assert(os.WriteFile(b.Path(), buf.Bytes(), 0o600)).IsNil()
+
+			restored := make(map[string]string)
+			err = b.Restore(context.Background(), nil, func(file string, r io.Reader, _ fs.FileMode, _, _ time.Time, _ map[string]string, _ string) error {
+				c, err := io.ReadAll(r)
+				restored[file] = string(c)
+				return err
+			})
+			g.Assert(err).IsNil()
+			g.Assert(restored).Equal(map[string]string{"test.txt": "hello"})
+		})
+	})
+}
+
+// writeTestTarball writes a tarball containing the given files to w. The files
+// are written in the order of their names, and a file whose contents start with
+// "link:" is written as a hardlink to the file named by the rest of them.
+func writeTestTarball(w io.Writer, files map[string]string) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		header := &tar.Header{Name: name, Mode: 0o644, ModTime: time.Now(), Typeflag: tar.TypeReg, Size: int64(len(files[name]))}
+		if target := files[name]; len(target) > 5 && target[:5] == "link:" {
+			header.Typeflag, header.Linkname, header.Size = tar.TypeLink, target[5:], 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(files[name])); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
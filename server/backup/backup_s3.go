@@ -2,7 +2,6 @@ package backup
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
@@ -55,8 +54,17 @@ func (s *S3Backup) Generate(ctx context.Context, basePath, ignore string) (*Arch
 	defer s.Remove()
 
 	a := &filesystem.Archive{
-		BasePath: basePath,
-		Ignore:   ignore,
+		BasePath:       basePath,
+		Ignore:         ignore,
+		MaxDuration:    time.Duration(config.Get().System.Backups.MaxDuration) * time.Second,
+		RecordACLs:     config.Get().System.Backups.PreserveACLs,
+		IgnoreDefaults: config.Get().System.Backups.IgnoreDefaults,
+		TempDir:        config.Get().System.Backups.TempDirectory,
+		ProgressEvents: s.events,
+		Server:         s.server,
+		// The archive on the disk is removed once it has been uploaded, so the
+		// backup is only recorded once the upload has completed.
+		NoRecord: true,
 	}
 
 	s.log().WithField("path", s.Path()).Info("creating backup for server")
@@ -79,6 +87,18 @@ func (s *S3Backup) Generate(ctx context.Context, basePath, ignore string) (*Arch
 	if err != nil {
 		return nil, errors.WrapIf(err, "backup: failed to get archive details after upload")
 	}
+	if s.server != "" {
+		rec := filesystem.BackupRecord{
+			Uuid:         s.Uuid,
+			Checksum:     ad.Checksum,
+			ChecksumType: ad.ChecksumType,
+			Size:         ad.Size,
+			CompletedAt:  time.Now(),
+		}
+		if err := filesystem.RecordBackup(s.server, rec); err != nil {
+			return nil, err
+		}
+	}
 	return ad, nil
 }
 
@@ -96,12 +116,17 @@ func (s *S3Backup) Restore(ctx context.Context, r io.Reader, callback RestoreCal
 	if writeLimit := int64(config.Get().System.Backups.WriteLimit * 1024 * 1024); writeLimit > 0 {
 		reader = ratelimit.Reader(r, ratelimit.NewBucketWithRate(float64(writeLimit), writeLimit))
 	}
-	gr, err := gzip.NewReader(reader)
+	// The compression of the backup is detected from its contents rather than
+	// assuming that it is always gzipped.
+	dr, format, err := filesystem.NewDecompressingReader(reader)
 	if err != nil {
 		return err
 	}
-	defer gr.Close()
-	tr := tar.NewReader(gr)
+	defer dr.Close()
+	if format == filesystem.FormatZip {
+		return errors.New("backup: zip archives cannot be restored from a stream")
+	}
+	tr := tar.NewReader(dr)
 	for {
 		select {
 		case <-ctx.Done():
@@ -116,10 +141,8 @@ func (s *S3Backup) Restore(ctx context.Context, r io.Reader, callback RestoreCal
 			}
 			return err
 		}
-		if header.Typeflag == tar.TypeReg {
-			if err := callback(header.Name, tr, header.FileInfo().Mode(), header.AccessTime, header.ModTime); err != nil {
-				return err
-			}
+		if err := restoreEntry(header, tr, callback); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/franela/goblin"
+	"github.com/ulikunitz/xz"
+
+	"github.com/pterodactyl/wings/config"
+	"github.com/pterodactyl/wings/remote"
+	"github.com/pterodactyl/wings/server/filesystem"
+)
+
+// uploadClient is a remote.Client that only returns the upload urls of a backup,
+// the part is uploaded to the given url.
+type uploadClient struct {
+	remote.Client
+	url string
+}
+
+func (c *uploadClient) GetBackupRemoteUploadURLs(_ context.Context, _ string, size int64) (remote.BackupRemoteUploadResponse, error) {
+	return remote.BackupRemoteUploadResponse{Parts: []string{c.url}, PartSize: size}, nil
+}
+
+func TestS3Backup_Generate(t *testing.T) {
+	g := Goblin(t)
+
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("ETag", "etag")
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	g.Describe("Generate", func() {
+		var root string
+
+		g.BeforeEach(func() {
+			var err error
+			root, err = os.MkdirTemp(os.TempDir(), "pterodactyl")
+			g.Assert(err).IsNil()
+			g.Assert(os.MkdirAll(filepath.Join(root, "server"), 0o755)).IsNil()
+			g.Assert(os.MkdirAll(filepath.Join(root, "backups"), 0o755)).IsNil()
+			g.Assert(os.WriteFile(filepath.Join(root, "server", "test.txt"), []byte("hello"), 0o644)).IsNil()
+			config.Set(&config.Configuration{
+				AuthenticationToken: "abc",
+				System: config.SystemConfiguration{
+					RootDirectory:   root,
+					BackupDirectory: filepath.Join(root, "backups"),
+				},
+			})
+		})
+
+		g.AfterEach(func() {
+			_ = os.RemoveAll(root)
+		})
+
+		g.It("records the backup once it has been uploaded", func() {
+			status = http.StatusOK
+			b := NewS3(&uploadClient{url: srv.URL}, "backup-1", "")
+			b.SetServer("server-1")
+			ad, err := b.Generate(context.Background(), filepath.Join(root, "server"), "")
+			g.Assert(err).IsNil()
+
+			rec, err := filesystem.LastBackup("server-1")
+			g.Assert(err).IsNil()
+			g.Assert(rec != nil).IsTrue()
+			g.Assert(rec.Path).Equal("")
+			g.Assert(rec.Uuid).Equal("backup-1")
+			g.Assert(rec.Checksum).Equal(ad.Checksum)
+			g.Assert(rec.Size).Equal(ad.Size)
+		})
+
+		g.It("does not record a backup that failed to upload", func() {
+			status = http.StatusForbidden
+			b := NewS3(&uploadClient{url: srv.URL}, "backup-2", "")
+			b.SetServer("server-2")
+			_, err := b.Generate(context.Background(), filepath.Join(root, "server"), "")
+			g.Assert(err == nil).IsFalse()
+
+			rec, err := filesystem.LastBackup("server-2")
+			g.Assert(err).IsNil()
+			g.Assert(rec == nil).IsTrue()
+		})
+	})
+}
+
+func TestS3Backup_Restore(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("Restore", func() {
+		g.BeforeEach(func() {
+			config.Set(&config.Configuration{AuthenticationToken: "abc"})
+		})
+
+		g.It("restores a backup compressed with xz along with its hardlinks", func() {
+			var buf bytes.Buffer
+			xw, err := xz.NewWriter(&buf)
+			g.Assert(err).IsNil()
+			g.Assert(writeTestTarball(xw, map[string]string{"a.txt": "hello", "b.txt": "link:a.txt"})).IsNil()
+			g.Assert(xw.Close()).IsNil()
+
+			restored := make(map[string]string)
+			links := make(map[string]string)
+			err = NewS3(nil, "backup-1", "").Restore(context.Background(), &buf, func(file string, r io.Reader, _ fs.FileMode, _, _ time.Time, _ map[string]string, link string) error {
+				if link != "" {
+					links[file] = link
+					return nil
+				}
+				c, err := io.ReadAll(r)
+				restored[file] = string(c)
+				return err
+			})
+			g.Assert(err).IsNil()
+			g.Assert(restored).Equal(map[string]string{"a.txt": "hello"})
+			g.Assert(links).Equal(map[string]string{"b.txt": "a.txt"})
+		})
+	})
+}
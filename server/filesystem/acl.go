@@ -0,0 +1,29 @@
+package filesystem
+
+import (
+	"github.com/pterodactyl/wings/config"
+)
+
+// ACLRecord is the PAX record key used to store the POSIX access ACL of an entry
+// when Archive.RecordACLs is set. The value is the raw extended attribute the ACL
+// is stored in, the same record written by GNU tar with the --acls option.
+const ACLRecord = "SCHILY.xattr." + aclXattr
+
+// aclXattr is the extended attribute that the access ACL of a file is stored in.
+const aclXattr = "system.posix_acl_access"
+
+// RestoreACL applies the POSIX access ACL stored in the PAX records of an entry
+// that is being extracted from a backup or an archive to the file at the given
+// path. Nothing is done unless the preserve_acls configuration option is enabled,
+// or if the entry does not have an ACL.
+func (fs *Filesystem) RestoreACL(path string, records map[string]string) error {
+	acl, ok := records[ACLRecord]
+	if !ok || !config.Get().System.Backups.PreserveACLs {
+		return nil
+	}
+	cleaned, err := fs.SafePath(path)
+	if err != nil {
+		return err
+	}
+	return setACL(cleaned, []byte(acl))
+}
@@ -0,0 +1,14 @@
+package filesystem
+
+import "emperror.dev/errors"
+
+// getACL is not supported on this platform, files are never recorded as having an
+// ACL.
+func getACL(p string) ([]byte, error) {
+	return nil, nil
+}
+
+// setACL is not supported on this platform.
+func setACL(p string, acl []byte) error {
+	return errors.New("filesystem: acls are not supported on this platform")
+}
@@ -0,0 +1,38 @@
+package filesystem
+
+import (
+	"os"
+	"syscall"
+)
+
+// getACL returns the access ACL of the file at the given path, or nil if it does
+// not have one or the filesystem does not support ACLs.
+func getACL(p string) ([]byte, error) {
+	for {
+		var b []byte
+		n, err := syscall.Getxattr(p, aclXattr, nil)
+		if err == nil {
+			b = make([]byte, n)
+			// The ACL can grow between getting its size and reading it, in which case
+			// it is read again.
+			if n, err = syscall.Getxattr(p, aclXattr, b); err == syscall.ERANGE {
+				continue
+			}
+		}
+		if err == syscall.ENODATA || err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: p, Err: err}
+		}
+		return b[:n], nil
+	}
+}
+
+// setACL sets the access ACL of the file at the given path.
+func setACL(p string, acl []byte) error {
+	if err := syscall.Setxattr(p, aclXattr, acl, 0); err != nil {
+		return &os.PathError{Op: "setxattr", Path: p, Err: err}
+	}
+	return nil
+}
@@ -2,18 +2,30 @@ package filesystem
 
 import (
 	"archive/tar"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"emperror.dev/errors"
 	"github.com/apex/log"
 	"github.com/juju/ratelimit"
 	"github.com/karrick/godirwalk"
+	"github.com/klauspost/compress/zstd"
 	"github.com/klauspost/pgzip"
 	ignore "github.com/sabhiram/go-gitignore"
 
@@ -37,8 +49,12 @@ type Progress struct {
 	written int64
 	// Total is the total size of the archive in bytes.
 	total int64
-	// w .
-	w io.Writer
+
+	// phases are the phases of the progress and phase is the index of the current
+	// one, see SetPhases.
+	mu     sync.Mutex
+	phases []ProgressPhase
+	phase  int
 }
 
 // NewProgress .
@@ -46,6 +62,12 @@ func NewProgress(total int64) *Progress {
 	return &Progress{total: total}
 }
 
+// NewProgressFrom returns a progress that starts with the given number of bytes
+// already written, such as when a transfer is being resumed part way through.
+func NewProgressFrom(written int64, total int64) *Progress {
+	return &Progress{written: written, total: total}
+}
+
 // Written returns the total number of bytes written.
 // This function should be used when the progress is tracking data being written.
 func (p *Progress) Written() int64 {
@@ -57,18 +79,86 @@ func (p *Progress) Total() int64 {
 	return atomic.LoadInt64(&p.total)
 }
 
-// Write totals the number of bytes that have been written to the writer.
+// Adjust changes the total size by the given number of bytes, this is used when
+// a file shrinks after the total size was calculated so that the progress is
+// still able to reach the total. The total will never be adjusted below zero.
+func (p *Progress) Adjust(delta int64) {
+	for {
+		total := atomic.LoadInt64(&p.total)
+		v := total + delta
+		if v < 0 {
+			v = 0
+		}
+		if atomic.CompareAndSwapInt64(&p.total, total, v) {
+			return
+		}
+	}
+}
+
+// Write totals the number of bytes that have been written to the writer. This
+// allows the progress to be used as the end of a pipeline, such as with an
+// io.TeeReader, use Writer to place it in the middle of one.
 func (p *Progress) Write(v []byte) (int, error) {
 	n := len(v)
 	atomic.AddInt64(&p.written, int64(n))
-	if p.w != nil {
-		return p.w.Write(v)
-	}
 	return n, nil
 }
 
-// Progress returns a formatted progress string for the current progress.
+// Writer returns a writer that writes to w, adding the number of bytes written
+// to the progress. This allows the progress to be placed anywhere in a chain of
+// writers, such as before or after the data is compressed.
+func (p *Progress) Writer(w io.Writer) io.Writer {
+	return &progressWriter{p: p, w: w}
+}
+
+// progressWriter counts the bytes written through it towards a progress.
+type progressWriter struct {
+	p *Progress
+	w io.Writer
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	atomic.AddInt64(&pw.p.written, int64(n))
+	return n, err
+}
+
+// setTotal sets the total size in bytes.
+func (p *Progress) setTotal(total int64) {
+	atomic.StoreInt64(&p.total, total)
+}
+
+// advance adds the given number of bytes to the progress without writing them.
+func (p *Progress) advance(n int64) {
+	atomic.AddInt64(&p.written, n)
+}
+
+// Reader returns a reader that reads from r, adding the number of bytes read
+// to the progress. This allows the progress to track data being read, such as
+// when downloading an archive, as well as data being written.
+func (p *Progress) Reader(r io.Reader) io.Reader {
+	return &progressReader{p: p, r: r}
+}
+
+// progressReader counts the bytes read through it towards a progress.
+type progressReader struct {
+	p *Progress
+	r io.Reader
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	atomic.AddInt64(&pr.p.written, int64(n))
+	return n, err
+}
+
+// Progress returns a formatted progress string for the current progress. If the
+// progress has phases the bar shows the overall progress, followed by the name
+// and progress of the current phase.
 func (p *Progress) Progress(width int) string {
+	if p.Phase() != "" {
+		return p.phaseProgress(width)
+	}
 	current := p.Written()
 	total := p.Total()
 
@@ -82,6 +172,16 @@ func (p *Progress) Progress(width int) string {
 
 	// We have to cast these numbers to float in order to get a float result from the division.
 	ticks := ((float64(current) / float64(total)) * 100) / (float64(100) / float64(width))
+	// The written bytes can exceed the total if it was adjusted, never render more
+	// ticks than the width of the bar.
+	if ticks > float64(width) {
+		ticks = float64(width)
+	}
+	// Nothing can be rendered if the total size is not known, such as when an
+	// empty directory is being archived.
+	if total == 0 {
+		ticks = 0
+	}
 	bar := strings.Repeat("=", int(ticks)) + strings.Repeat(" ", width-int(ticks))
 	return "[" + bar + "] " + system.FormatBytes(current) + " / " + system.FormatBytes(total)
 }
@@ -92,105 +192,1255 @@ type Archive struct {
 	BasePath string
 
 	// Ignore is a gitignore string (most likely read from a file) of files to ignore
-	// from the archive.
+	// from the archive. Patterns are evaluated in order and the last pattern that
+	// matches a file wins, so a negated pattern such as "!important.log" includes
+	// a file that was ignored by an earlier "*.log" pattern. Unlike git, a negated
+	// pattern can include a file within an ignored directory.
 	Ignore string
 
+	// IgnoreDefaults leaves the files matched by the DefaultIgnore patterns out of
+	// the archive. The defaults are evaluated before the Ignore option, so a file
+	// can still be included with a negated pattern such as "!Thumbs.db".
+	IgnoreDefaults bool
+
 	// Files specifies the files to archive, this takes priority over the Ignore option, if
 	// unspecified, all files in the BasePath will be archived unless Ignore is set.
 	Files []string
 
-	// Progress wraps the writer of the archive to pass through the progress tracker.
+	// ExtraPaths are additional directories outside of the BasePath to archive,
+	// such as data directories mounted into the server. The contents of each are
+	// nested under its prefix in the archive and matched by the Files and Ignore
+	// options the same as the files of the BasePath. Each path must exist and be a
+	// directory, otherwise creating the archive fails. Extra paths are walked from
+	// the disk every time, the WalkCache only covers the BasePath.
+	ExtraPaths []ExtraPath
+
+	// SourceID identifies the source of the files of the BasePath, such as the uuid
+	// of the server they belong to. If set it is stored in the SourceRecord of every
+	// entry from the BasePath, so that an archive combining several sources can be
+	// split back into them with SplitBySource. See ExtraPath.SourceID.
+	SourceID string
+
+	// PruneDir is called with the relative path of every directory before it is
+	// walked, if it returns true nothing within the directory is archived. Unlike
+	// the Ignore option, which is evaluated for every file within an ignored
+	// directory, a pruned directory is never read at all. This makes it far faster
+	// at excluding large directories such as caches with millions of files, where
+	// the cost of Ignore grows with the number of files that it excludes. The
+	// WalkCache is not used when PruneDir is set, since the function cannot be
+	// part of its key.
+	PruneDir func(relative string) bool
+
+	// Progress tracks the bytes of the tarball written to the archive, before they
+	// are compressed. The data passes through the writers of the archive in the
+	// order: tar, progress, gzip, then the destination. The total of the progress
+	// is the size of the files being archived, which the progress exceeds by the
+	// size of the tar headers.
 	Progress *Progress
+
+	// WeightedProgress advances the Progress by the size of each file as it is
+	// copied, rather than by every byte written to the archive. The size of every
+	// file is estimated before the archive is written and the total of the progress
+	// is set to the sum of them, so the progress moves at an even pace relative to
+	// the work being done and always reaches the total once every file has been
+	// handled, even if files change size or are skipped along the way.
+	WeightedProgress bool
+
+	// Control allows the archive to be paused and resumed while it is being
+	// created, see ArchiveControl.
+	Control *ArchiveControl
+
+	// RecordAbsolutePath stores the original absolute source path of every entry
+	// as a PAX record on its header. The stored entry name remains relative to
+	// BasePath, this is purely informational for tooling inspecting the archive.
+	RecordAbsolutePath bool
+
+	// AbsolutePathKey is the PAX record key used when RecordAbsolutePath is set,
+	// if unspecified AbsolutePathRecord will be used.
+	AbsolutePathKey string
+
+	// RecordACLs stores the POSIX access ACL of every regular file that has one as
+	// a PAX record on its header, see ACLRecord. Standard tar headers only hold the
+	// mode bits of a file, so the ACL is lost otherwise. This is only supported on
+	// Linux, and is ignored on filesystems without ACL support.
+	RecordACLs bool
+
+	// SortBySimilarity defers writing any entries until the walk has completed and
+	// then writes them ordered by extension and name. Since the archive is a single
+	// compression stream, grouping similar files together allows the compressor to
+	// reuse context between them which noticeably improves the ratio for servers
+	// with many small, similar files. This requires holding every matched path in
+	// memory until the walk has finished.
+	SortBySimilarity bool
+
+	// WriteMeta writes a metadata file alongside the archive describing its format,
+	// compression and contents. See ReadArchiveMeta.
+	WriteMeta bool
+
+	// Tags are arbitrary key value pairs describing the archive, such as why it was
+	// created. They are stored in the metadata file of the archive, which will be
+	// written even if WriteMeta is not enabled. See ValidateTags.
+	Tags map[string]string
+
+	// InvalidNames determines how entries with names that are not valid UTF-8, or
+	// that contain null bytes, are handled. By default the raw name is stored as-is
+	// for fidelity, however some tar readers and the Panel do not handle them well.
+	InvalidNames InvalidNamePolicy
+
+	// SymlinkPolicy determines how symlinks are archived. By default every symlink
+	// is stored as a link, see SymlinkFollow for the guarantees made when following
+	// them instead. The WalkCache is not used when following symlinks.
+	SymlinkPolicy SymlinkPolicy
+
+	// QuotaBytes is the maximum total size in bytes of the files being archived. If
+	// the files exceed this size Create will return a QuotaExceededError without
+	// creating the archive. If less than 1 no quota is enforced.
+	QuotaBytes int64
+
+	// MaxSpecialEntries is the maximum number of symlinks, device files and named
+	// pipes that may be written to the archive. Once exceeded the archive is
+	// abandoned and a SpecialEntriesExceededError is returned, since a tree with an
+	// unreasonable number of these is likely crafted and complicates restoring it.
+	// Regular files and directories do not count towards the limit. If less than 1
+	// there is no limit.
+	MaxSpecialEntries int
+
+	// WriteRestoreManifest embeds a RestoreManifest into the archive once all of
+	// the files have been written, see RestoreManifestName.
+	WriteRestoreManifest bool
+
+	// Logger is used for all of the log output while creating the archive, if not
+	// set the default logger is used.
+	Logger log.Interface
+
+	// Server is the identifier of the server being archived. If set, the details
+	// of every successful call to Create are recorded and can be retrieved using
+	// LastBackup, and the progress of the archive can be retrieved using
+	// ActiveBackup while it is being created.
+	Server string
+
+	// NoRecord stops Create from recording the archive as the last backup of the
+	// Server. This is used for backups that are uploaded elsewhere once they have
+	// been created, which are recorded using RecordBackup once the upload is done.
+	NoRecord bool
+
+	// DenyContentTypes skips every file with a content type in the list, such as
+	// "video/mp4". A type ending in "/*" matches every type within it, such as
+	// "video/*". The content type is detected from the first 512 bytes of each
+	// file using http.DetectContentType, so files are excluded regardless of their
+	// extension at the cost of an additional read of every file.
+	DenyContentTypes []string
+
+	// OnSlowFile is called when copying a single file into the archive takes longer
+	// than SlowFileThreshold, and again every SlowFileThreshold until the copy has
+	// finished. It is passed the name of the file and the number of bytes that have
+	// been copied so far. The hook is called from a separate goroutine.
+	OnSlowFile        func(name string, written int64)
+	SlowFileThreshold time.Duration
+
+	// PadTimedOutFiles keeps creating the archive when copying a file exceeds the
+	// configured file timeout, rather than failing. The remaining contents of the
+	// file are replaced with zeros so that the archive remains valid, and the file
+	// is recorded in the archive stats with SkipReasonTimeout.
+	PadTimedOutFiles bool
+
+	// IncludeDevices stores block and character device files in the archive along
+	// with their device numbers. By default device files are skipped with a
+	// warning, game servers should never contain them.
+	IncludeDevices bool
+
+	// TarFormat is the format used for the headers written to the archive, this
+	// must be one of tar.FormatUSTAR, tar.FormatPAX or tar.FormatGNU and defaults
+	// to tar.FormatPAX. Entries that cannot be represented in the selected format,
+	// such as names that are too long for USTAR, are written using PAX instead.
+	TarFormat tar.Format
+
+	// MinCompressSize stores the archive as an uncompressed tarball if the total
+	// size of the files being archived is less than the given number of bytes. The
+	// format of the archive is recorded in its metadata file. Only applies to Create.
+	MinCompressSize int64
+
+	// DeduplicateHardlinks stores files that are hardlinked to a file that has
+	// already been written to the archive as a link to that entry, rather than
+	// storing the contents of the file a second time.
+	DeduplicateHardlinks bool
+
+	// Snapshot copies each file to SnapshotDir before it is written to the archive
+	// so that a file being modified while it is read cannot result in a torn entry
+	// in the archive. Using a reflink makes this nearly free on filesystems that
+	// support it, in which case SnapshotDir must be on the same filesystem as the
+	// BasePath.
+	Snapshot SnapshotMode
+
+	// TempDir is the directory that Create writes the archive to while it is being
+	// created, such as a scratch volume with more space than the destination. The
+	// archive is only moved to its destination once it has been completely written,
+	// being copied if the directory is on a different filesystem. The directory must
+	// exist and be writable. If unspecified the archive is written directly to its
+	// destination.
+	TempDir string
+
+	// SnapshotDir is the directory snapshots are written to, if unspecified the
+	// default temporary directory for the system is used.
+	SnapshotDir string
+
+	// FlushInterval is the minimum amount of time between flushes of the compressed
+	// output. Each flush forces all pending data to be written to the underlying
+	// writer, which keeps data flowing steadily when streaming an archive to a
+	// client at the cost of a slightly worse compression ratio. If zero, the output
+	// is only flushed when the compressor's buffers are full.
+	FlushInterval time.Duration
+
+	// Baseline is the manifest of a previous archive. If set, only regular files that
+	// have been added or changed since the baseline are written to the archive,
+	// making the archive incremental. See Manifest.
+	//
+	// By default a file is considered unchanged if its size and modification time
+	// match the baseline, which avoids reading unchanged files entirely. This will
+	// not detect a file whose contents were changed while its size and modification
+	// time were preserved (for example by a tool that resets the mtime), if that is
+	// a concern enable Paranoid.
+	Baseline *Manifest
+
+	// Paranoid causes the contents of every file that appears unchanged from the
+	// Baseline to be hashed and compared against the baseline checksum.
+	Paranoid bool
+
+	// MaxInactivity causes regular files that have not been accessed or modified
+	// within the given duration to be left out of the archive, these files are
+	// recorded in the archive stats with SkipReasonInactive. This relies on the
+	// access time of files, if the filesystem does not track access times (such
+	// as a noatime mount) a warning is logged and no files are skipped.
+	MaxInactivity time.Duration
+
+	// MaxDuration is the maximum amount of time that creating the archive may take,
+	// including any time spent paused. Once exceeded the archive is abandoned and
+	// ErrTimeBudgetExceeded is returned, an archive being created by Create is
+	// removed from the disk. If zero there is no limit.
+	MaxDuration time.Duration
+
+	// WriteIndex writes an index file alongside the archive listing the checksum and
+	// position of every entry, see ArchiveIndex. Each entry of a compressed archive
+	// is written as a separate gzip member so that it can be read on its own, which
+	// makes the archive slightly larger since the compressor cannot reuse context
+	// between files. Only applies to Create.
+	WriteIndex bool
+
+	// OCILayer produces an archive that can be used as an OCI image layer. An entry
+	// is written for the parent directories of every file and owner names are left
+	// out of the headers. When Baseline is set every file of the baseline that no
+	// longer exists is marked as deleted using a whiteout file, so the archive can
+	// be applied on top of the layer of the baseline. See OCIWhiteoutPrefix.
+	OCILayer bool
+
+	// CompressionResolver picks the compression level of the archive from a sample
+	// of the files that will be written to it, rather than using the level that
+	// has been configured for backups. Adaptive compression is not used when this
+	// is set. See DefaultCompressionResolver.
+	CompressionResolver CompressionResolver
+
+	// Dictionary is a zstd dictionary, if set the archive is compressed with zstd
+	// using the dictionary rather than with gzip. This is intended for incremental
+	// archives, which are made up of many small files that compress poorly on their
+	// own, giving them the dictionary of the base archive lets the compressor reuse
+	// the context of its files. A dictionary must be trained ahead of time, such
+	// as with "zstd --train" on the files of the base archive.
+	//
+	// Create stores the dictionary alongside the archive, see DictionaryPath, and
+	// records its id in the metadata, so that it can be read again. Adaptive
+	// compression and the gzip framing options are not used when this is set, and
+	// it cannot be combined with WriteIndex.
+	Dictionary []byte
+
+	// WalkCache is the path of a file used to cache the files that are included in
+	// the archive by the Files and Ignore options, so that the tree does not need
+	// to be read and every file matched against the ignore rules each time the
+	// archive is created. The cache should be stored outside of the BasePath, since
+	// writing it would otherwise invalidate it. See cachedWalk for when the cache
+	// is used.
+	WalkCache string
+
+	// BuildManifest generates a Manifest of the archive while it is being created,
+	// this is always enabled when Baseline is set.
+	BuildManifest bool
+
+	// ProgressEvents publishes the progress of the archive to an event emitter while
+	// it is being written, such as the event bus of the server being backed up. If
+	// no Progress is provided one is created for the archive with the Total of the
+	// events, the size of the files is never estimated for it.
+	ProgressEvents *ProgressEvents
+
+	// Durable syncs the archive to the disk, along with the directory containing
+	// it, before Create returns so that an archive reported as created survives a
+	// crash or power loss immediately afterwards. This makes creating an archive
+	// noticeably slower on busy disks. The index, metadata and other files written
+	// alongside the archive are not synced themselves.
+	Durable bool
+
+	// AllowUnsafeBasePath allows Create to archive a BasePath that would otherwise
+	// be refused, such as the root of the host, a home directory or any location
+	// outside of the data directory. See UnsafeBasePathError.
+	AllowUnsafeBasePath bool
+
+	// compress is true if the archive currently being written is compressed.
+	compress bool
+
+	// level is the gzip compression level of the archive currently being written.
+	level int
+
+	// onDir is called with every directory encountered while walking the tree.
+	onDir func(path string, st os.FileInfo)
+
+	// gzipHeader is the header written to the gzip stream of the archive being
+	// created, if any.
+	gzipHeader *pgzip.Header
+
+	// inactiveBefore is the time before which files are considered inactive, this
+	// is zero when files should not be skipped for inactivity.
+	inactiveBefore time.Time
+
+	// restore contains the entries of the restore manifest being generated.
+	restore []RestoreEntry
+
+	// index contains the entries of the index being generated for the archive.
+	index []IndexEntry
+
+	// entries is the number of entries other than directories written to the
+	// archive.
+	entries int
+
+	// special is the number of entries counted towards the MaxSpecialEntries of
+	// the archive.
+	special int
+
+	// members is the gzip writer used when each entry starts a new gzip member.
+	members *memberGzipWriter
+
+	// manifest is the manifest being generated for the archive.
+	manifest *Manifest
+
+	// virtual contains the in-memory files queued to be written to the archive.
+	virtual []virtualFile
+
+	// dirs tracks the directories written to an OCI layer.
+	dirs map[string]bool
+
+	// links tracks the entry name of every hardlinked file written to the archive.
+	links map[fileID]string
+
+	// weights is the estimated size of every file the progress is weighted by, see
+	// WeightedProgress.
+	weights map[string]int64
+
+	// following is the resolved target of every symlinked directory currently being
+	// walked when using SymlinkFollow.
+	following []string
+
+	// walkRoot and walkPrefix are the directory being walked and the prefix of the
+	// relative paths within it while walking one of the ExtraPaths.
+	walkRoot   string
+	walkPrefix string
+
+	// size and compressed track the number of bytes written to the archive before
+	// and after compression respectively.
+	size       int64
+	compressed int64
+
+	// stats contains information about the entries processed by the most recent
+	// call to Create.
+	stats ArchiveStats
+	mu    sync.Mutex
+}
+
+// SkipReason describes why an entry was not included in an archive.
+type SkipReason string
+
+const (
+	// SkipReasonPermission is used for directories that could not be read due to
+	// a permission error while walking the tree.
+	SkipReasonPermission SkipReason = "permission_denied"
+	// SkipReasonInvalidName is used for entries skipped because their name is not
+	// valid UTF-8 when using InvalidNameSkip.
+	SkipReasonInvalidName SkipReason = "invalid_name"
+	// SkipReasonCircularSymlink is used for symlinks that point to one of their own
+	// parent directories.
+	SkipReasonCircularSymlink SkipReason = "circular_symlink"
+	// SkipReasonSymlink is used for symlinks when using SymlinkSkip.
+	SkipReasonSymlink SkipReason = "symlink"
+	// SkipReasonSymlinkEscape is used for symlinks that cannot be followed when
+	// using SymlinkFollow, since their target is outside of the directory being
+	// archived or cannot be resolved.
+	SkipReasonSymlinkEscape SkipReason = "symlink_escape"
+	// SkipReasonInactive is used for files that have not been accessed within the
+	// MaxInactivity of the archive.
+	SkipReasonInactive SkipReason = "inactive"
+	// SkipReasonDevice is used for block and character device files, which are
+	// only included if IncludeDevices is enabled.
+	SkipReasonDevice SkipReason = "device"
+	// SkipReasonContentType is used for files with a detected content type that is
+	// in the DenyContentTypes of the archive.
+	SkipReasonContentType SkipReason = "content_type"
+	// SkipReasonTimeout is used for files that could not be copied into the archive
+	// within the configured file timeout.
+	SkipReasonTimeout SkipReason = "timed_out"
+)
+
+// InvalidNamePolicy controls how an Archive handles entries with names that are
+// not valid UTF-8 or contain null bytes.
+type InvalidNamePolicy int
+
+const (
+	// InvalidNameStore stores the raw name in the archive without modification.
+	InvalidNameStore InvalidNamePolicy = iota
+	// InvalidNameSkip leaves the entry out of the archive and records it as skipped.
+	InvalidNameSkip
+	// InvalidNameSanitize replaces any invalid sequences in the name with an
+	// underscore and stores the original name, base64 encoded, in the
+	// RawNameRecord PAX record of the entry.
+	InvalidNameSanitize
+)
+
+// RawNameRecord is the PAX record key used to store the original, base64 encoded
+// name of an entry whose name was sanitized.
+const RawNameRecord = "WINGS.rawname"
+
+// validEntryName returns true if the given name is valid UTF-8 and does not
+// contain any null bytes.
+func validEntryName(name string) bool {
+	return utf8.ValidString(name) && !strings.ContainsRune(name, 0)
+}
+
+// sanitizeEntryName replaces any invalid UTF-8 sequences and null bytes in the
+// given name with an underscore.
+func sanitizeEntryName(name string) string {
+	return strings.ReplaceAll(strings.ToValidUTF8(name, "_"), "\x00", "_")
+}
+
+// SkippedEntry is an entry that was encountered while walking the tree but not
+// included in the final archive.
+type SkippedEntry struct {
+	Path   string     `json:"path"`
+	Reason SkipReason `json:"reason"`
+}
+
+// ArchiveStats contains information about the entries processed while creating
+// an archive.
+type ArchiveStats struct {
+	// Files is the total number of entries written to the archive.
+	Files int `json:"files"`
+	// Skipped contains all of the entries that were intentionally left out of the
+	// archive along with the reason they were skipped.
+	Skipped []SkippedEntry `json:"skipped"`
+	// Unchanged is the number of files that were left out of an incremental archive
+	// because they had not changed since the baseline.
+	Unchanged int `json:"unchanged"`
+	// Size is the number of bytes of the tar stream before compression.
+	Size int64 `json:"size"`
+	// CompressedSize is the number of bytes of the archive after compression.
+	CompressedSize int64 `json:"compressed_size"`
+	// DeduplicatedBytes is the number of bytes that were not written to the archive
+	// because the file was stored as a link to an identical entry.
+	DeduplicatedBytes int64 `json:"deduplicated_bytes"`
+	// CompressionMode is how the data of the archive was stored.
+	CompressionMode CompressionMode `json:"compression_mode"`
+	// GzipLevel is the gzip compression level the archive was written with, this
+	// is zero unless the mode is CompressionGzip and a single level was used for
+	// the entire archive, which is not the case with adaptive compression.
+	GzipLevel int `json:"gzip_level,omitempty"`
+}
+
+// CompressionRatio returns the size of the compressed archive relative to the
+// size of the uncompressed data. Lower values indicate better compression.
+func (s ArchiveStats) CompressionRatio() float64 {
+	if s.Size == 0 {
+		return 0
+	}
+	return float64(s.CompressedSize) / float64(s.Size)
+}
+
+// SpaceSavings returns the fraction of the original data, including any bytes
+// that were deduplicated, that the archive does not need to store.
+func (s ArchiveStats) SpaceSavings() float64 {
+	total := s.Size + s.DeduplicatedBytes
+	if total == 0 {
+		return 0
+	}
+	return 1 - float64(s.CompressedSize)/float64(total)
+}
+
+// Stats returns the stats for the most recent call to Create. It is safe to call
+// this function while the archive is still being created.
+func (a *Archive) Stats() ArchiveStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := a.stats
+	stats.Skipped = append([]SkippedEntry(nil), a.stats.Skipped...)
+	stats.Size = atomic.LoadInt64(&a.size)
+	stats.CompressedSize = atomic.LoadInt64(&a.compressed)
+	return stats
+}
+
+// recordCompressionMode records how the archive being written is stored in the
+// stats of the archive.
+func (a *Archive) recordCompressionMode(compress bool, level int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case !compress:
+		a.stats.CompressionMode = CompressionStore
+	case a.Dictionary != nil:
+		a.stats.CompressionMode = CompressionZstd
+	case level == pgzip.NoCompression:
+		a.stats.CompressionMode = CompressionGzipStored
+	default:
+		a.stats.CompressionMode = CompressionGzip
+		if a.CompressionResolver != nil || !config.Get().System.Backups.AdaptiveCompression {
+			a.stats.GzipLevel = level
+		}
+	}
+}
+
+// skip records the given relative path as being skipped for the provided reason.
+func (a *Archive) skip(rp string, reason SkipReason) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stats.Skipped = append(a.stats.Skipped, SkippedEntry{Path: rp, Reason: reason})
+	a.logEntry(rp, 0, "skipped", string(reason))
+}
+
+// contextWriter is a writer that stops accepting writes once the context has been
+// canceled, returning the error from the context instead.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
 }
 
+func (cw *contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
+
+// intervalFlusher flushes the underlying gzip writer after a write if at least
+// the given interval has passed since the previous flush.
+type intervalFlusher struct {
+	w        gzipStream
+	interval time.Duration
+	last     time.Time
+}
+
+func (f *intervalFlusher) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if time.Since(f.last) >= f.interval {
+		f.last = time.Now()
+		if err := f.w.Flush(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// countingWriter atomically tracks the number of bytes written through it.
+type countingWriter struct {
+	n *int64
+	w io.Writer
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+// archiveEntry is a file that has been matched by the walker and is waiting to
+// be written to the archive.
+type archiveEntry struct {
+	path     string
+	relative string
+}
+
+// AbsolutePathRecord is the default PAX record key used to store the original
+// absolute path of an entry in the archive.
+const AbsolutePathRecord = "SCHILY.realpath"
+
 // Create creates an archive at dst with all the files defined in the
 // included Files array.
-func (a *Archive) Create(dst string) error {
-	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+func (a *Archive) Create(dst string) (err error) {
+	defer func() {
+		err = classifyArchiveError(err)
+	}()
+	if err := ValidateTags(a.Tags); err != nil {
+		return err
+	}
+	if err := a.checkBasePath(); err != nil {
+		return err
+	}
+	var dictID uint32
+	if a.Dictionary != nil {
+		if dictID, err = ZstdDictionaryID(a.Dictionary); err != nil {
+			return err
+		}
+	}
+	writeMeta := a.WriteMeta || len(a.Tags) > 0
+
+	compress := true
+	if a.QuotaBytes > 0 || a.MinCompressSize > 0 {
+		size, err := a.EstimateSize()
+		if err != nil {
+			return err
+		}
+		if a.QuotaBytes > 0 && size > a.QuotaBytes {
+			return errors.WithStack(&QuotaExceededError{Size: size, Quota: a.QuotaBytes})
+		}
+		// Compressing a tiny archive is pointless, the gzip overhead can even make it
+		// larger than the files themselves.
+		compress = size >= a.MinCompressSize
+	}
+
+	if config.Get().System.Backups.LowPriorityIO {
+		if restore, err := lowerIOPriority(); err != nil {
+			a.log().WithField("error", err).Warn("failed to lower i/o priority for archive; continuing with default priority...")
+		} else {
+			defer restore()
+		}
+	}
+
+	// Create any missing parent directories of the destination, such as the shard
+	// directories of a sharded path.
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return errors.WithStack(err)
+	}
+	f, err := a.createDestination(dst)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	if f.Name() != dst {
+		defer os.Remove(f.Name())
+	}
+
+	// If a metadata file is being written alongside the archive, or the backup is
+	// being recorded for the server, hash the bytes as they are written to the disk
+	// so we don't need to read the file back.
+	var writer io.Writer = f
+	h := sha1.New()
+	if writeMeta || a.Server != "" {
+		writer = io.MultiWriter(f, h)
+	}
 
 	// Select a writer based off of the WriteLimit configuration option. If there is no
 	// write limit, use the file as the writer.
-	var writer io.Writer
 	if writeLimit := int64(config.Get().System.Backups.WriteLimit * 1024 * 1024); writeLimit > 0 {
 		// Token bucket with a capacity of "writeLimit" MiB, adding "writeLimit" MiB/s
 		// and then wrap the file writer with the token bucket limiter.
-		writer = ratelimit.Writer(f, ratelimit.NewBucketWithRate(float64(writeLimit), writeLimit))
-	} else {
-		writer = f
-	}
-
-	// Choose which compression level to use based on the compression_level configuration option
-	var compressionLevel int
-	switch config.Get().System.Backups.CompressionLevel {
-	case "none":
-		compressionLevel = pgzip.NoCompression
-	case "best_compression":
-		compressionLevel = pgzip.BestCompression
-	case "best_speed":
-		fallthrough
-	default:
-		compressionLevel = pgzip.BestSpeed
+		writer = ratelimit.Writer(writer, ratelimit.NewBucketWithRate(float64(writeLimit), writeLimit))
+	}
+
+	// Never include the archive being written, or the temporary files created
+	// alongside it, in the archive itself. This can only occur if the destination
+	// is within the BasePath which is a misconfiguration, but would otherwise cause
+	// the archive to grow endlessly.
+	self, err := a.selfExclusionFilter(dst, dst+".tmp", f.Name())
+	if err != nil {
+		return err
 	}
 
-	// Create a new gzip writer around the file.
-	gw, _ := pgzip.NewWriterLevel(writer, compressionLevel)
-	_ = gw.SetConcurrency(1<<20, 1)
-	defer gw.Close()
+	// Name the tarball within the gzip stream and describe where it came from for
+	// anyone inspecting the archive with the standard gzip tools.
+	header := gzipHeaderFor(dst, a.Server, time.Now())
+	a.gzipHeader = &header
+	defer func() { a.gzipHeader = nil }()
 
-	var pw io.Writer
-	if a.Progress != nil {
-		a.Progress.w = gw
-		pw = a.Progress
-	} else {
-		pw = gw
+	if err := a.write(context.Background(), writer, compress, self); err != nil {
+		// An archive that ran out of time is incomplete, remove it rather than leave
+		// it looking like a usable backup.
+		if errors.Is(err, ErrTimeBudgetExceeded) {
+			_ = f.Close()
+			if rerr := os.Remove(f.Name()); rerr != nil && !os.IsNotExist(rerr) {
+				a.log().WithField("path", dst).WithField("error", rerr).Warn("failed to remove incomplete archive")
+			}
+		}
+		return err
+	}
+	if a.Durable && f.Name() == dst {
+		if err := f.Sync(); err != nil {
+			return errors.WrapIf(err, "archive: failed to sync archive to disk")
+		}
+	}
+	if err := a.finishDestination(f, dst); err != nil {
+		return err
+	}
+	if a.Durable {
+		defer func() {
+			if err == nil {
+				err = syncDir(filepath.Dir(dst))
+			}
+		}()
+	}
+
+	if a.WriteIndex {
+		idx := ArchiveIndex{Format: FormatTarGzip, Count: a.entries, Entries: a.index}
+		if !compress {
+			idx.Format = FormatTar
+		}
+		if err := writeArchiveIndex(dst, &idx); err != nil {
+			return err
+		}
+	}
+
+	if compress && a.Dictionary != nil {
+		if err := writeArchiveDictionary(dst, a.Dictionary); err != nil {
+			return err
+		}
+	}
+
+	if !writeMeta && a.Server == "" {
+		return nil
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	if writeMeta {
+		stats := a.Stats()
+		meta := ArchiveMeta{
+			Format:           FormatTarGzip,
+			CompressionLevel: compressionLevelName(),
+			Checksum:         checksum,
+			ChecksumType:     "sha1",
+			CompressionMode:  stats.CompressionMode,
+			Files:            stats.Files,
+			Size:             st.Size(),
+			UncompressedSize: stats.Size,
+			Tags:             a.Tags,
+		}
+		if compress && a.Dictionary != nil {
+			meta.Format = FormatTarZstd
+			meta.ZstdDictID = dictID
+		} else if !compress || a.level == pgzip.NoCompression {
+			meta.CompressionLevel = "none"
+			if !compress {
+				meta.Format = FormatTar
+			}
+		} else if a.CompressionResolver != nil {
+			meta.CompressionLevel = "resolved"
+		} else if config.Get().System.Backups.AdaptiveCompression && meta.CompressionLevel != "none" {
+			meta.CompressionLevel = "adaptive"
+		}
+		if err := writeArchiveMeta(dst, &meta); err != nil {
+			return err
+		}
+	}
+	if a.Server != "" && !a.NoRecord {
+		rec := BackupRecord{
+			Path:         dst,
+			Checksum:     checksum,
+			ChecksumType: "sha1",
+			Size:         st.Size(),
+			CompletedAt:  time.Now(),
+		}
+		if err := recordBackup(a.Server, rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+const (
+	// gzipBlockSize is the size of the blocks that are compressed by the gzip
+	// writer, unless a smaller size is required by the memory budget.
+	gzipBlockSize = 1 << 20
+	// gzipBlocks is the number of compressed blocks that can be waiting to be
+	// written before writes to the gzip writer block, unless the memory budget
+	// allows for more.
+	gzipBlocks = 1
+	// StreamBufferSize is the maximum number of bytes of an archive that are held
+	// in memory while waiting for the destination to accept them. This accounts
+	// for the compressed blocks waiting to be written, the block being compressed
+	// and the block currently being filled by the tar writer, when no memory
+	// budget has been configured.
+	StreamBufferSize = (gzipBlocks + 2) * gzipBlockSize
+)
+
+// Stream generates the archive and writes the compressed output to the provided
+// writer rather than a file on the disk. The writer is not closed by this function.
+// If the context is canceled the archive will stop being generated and the error
+// from the context is returned.
+//
+// Generating the archive is paced by the writer, if it is slow to accept data the
+// walk pauses rather than reading ahead. At most StreamBufferSize bytes of the
+// archive are held in memory while waiting on the writer.
+func (a *Archive) Stream(ctx context.Context, w io.Writer) error {
+	return classifyArchiveError(a.write(ctx, w, true))
+}
+
+// write generates the archive and writes the compressed output to the provided
+// writer. The writer is not closed by this function.
+func (a *Archive) write(ctx context.Context, w io.Writer, compress bool, filters ...func(path string, relative string) error) (err error) {
+	if a.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = withTimeBudget(ctx, a.MaxDuration, &err)
+		defer cancel()
+	}
+
+	// Estimate the size of every file the progress is weighted by before writing
+	// anything to the archive.
+	a.weights = nil
+	if a.WeightedProgress && (a.Progress != nil || a.Server != "" || a.ProgressEvents != nil) {
+		if a.Progress != nil {
+			a.Progress.StartPhase(PhaseEstimating, 0)
+		}
+		weights := make(map[string]int64)
+		total, err := a.estimate(func(rp string, size int64) {
+			weights[rp] = size
+		}, filters...)
+		if err != nil {
+			return err
+		}
+		if a.Progress == nil {
+			a.Progress = NewProgress(total)
+		} else {
+			a.Progress.setTotal(total)
+		}
+		a.weights = weights
+	}
+
+	// Make the progress of the archive available through ActiveBackup and the
+	// progress events while it is being created, a progress is created if one was
+	// not provided. Walking every file to estimate its total here would double
+	// the work of every backup, so only a total that is already known is used.
+	if (a.Server != "" || a.ProgressEvents != nil) && a.Progress == nil {
+		var total int64
+		if a.ProgressEvents != nil {
+			total = a.ProgressEvents.Total
+		}
+		a.Progress = NewProgress(total)
+	}
+	if a.Progress != nil && a.Progress.Phase() != PhaseArchiving {
+		a.Progress.StartPhase(PhaseArchiving, a.Progress.Total())
+	}
+	if a.Server != "" {
+		defer registerActiveBackup(a.Server, a.Progress)()
+	}
+	if a.ProgressEvents != nil {
+		defer a.ProgressEvents.watch(a.Progress)()
+	}
+
+	level := gzipCompressionLevel()
+	if compress {
+		var err error
+		if level, err = a.compressionLevel(filters...); err != nil {
+			return err
+		}
+	}
+	a.begin(compress)
+	a.level = level
+	a.recordCompressionMode(compress, level)
+
+	// Create a new gzip writer around the file, unless the archive is being stored
+	// as a plain tarball.
+	var gw gzipStream
+	var adaptive *adaptiveGzipWriter
+	out := &countingWriter{n: &a.compressed, w: w}
+	var cw io.Writer = out
+	if compress && a.Dictionary != nil {
+		if a.WriteIndex {
+			return errors.New("archive: an index cannot be written for an archive compressed with a dictionary")
+		}
+		zw, err := zstd.NewWriter(out, zstd.WithEncoderDict(a.Dictionary), zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		if err != nil {
+			return errors.WrapIf(err, "archive: failed to open zstd writer")
+		}
+		gw = zw
+		defer gw.Close()
+		cw = gw
+		if a.FlushInterval > 0 {
+			cw = &intervalFlusher{w: gw, interval: a.FlushInterval, last: time.Now()}
+		}
+	} else if compress {
+		if cfg := config.Get().System.Backups; a.CompressionResolver == nil && cfg.AdaptiveCompression && compressionLevelName() != "none" {
+			adaptive = newAdaptiveGzipWriter(out, cfg.MinCompressionLevel, cfg.MaxCompressionLevel)
+			gw = adaptive
+			a.members = adaptive.memberGzipWriter
+		} else if a.WriteIndex {
+			a.members = newMemberGzipWriter(out, level)
+			gw = a.members
+		} else {
+			gw = newGzipWriter(out, level)
+		}
+		defer gw.Close()
+		cw = gw
+		if a.gzipHeader != nil {
+			setGzipHeader(gw, *a.gzipHeader)
+		}
+
+		// Periodically flush the gzip writer if requested so that the consumer of the
+		// archive receives data at a steady pace rather than in large bursts.
+		if a.FlushInterval > 0 {
+			cw = &intervalFlusher{w: gw, interval: a.FlushInterval, last: time.Now()}
+		}
+	}
+
+	pw := cw
+	if a.Progress != nil && a.weights == nil {
+		pw = a.Progress.Writer(cw)
+	}
+
+	// Create a new tar writer around the gzip writer. Any writes to the archive will
+	// begin failing as soon as the context is canceled.
+	tw := tar.NewWriter(&contextWriter{ctx: ctx, w: &countingWriter{n: &a.size, w: pw}})
+
+	// When sorting by similarity every matched file is collected first and only
+	// written once the walk has completed.
+	var entries []archiveEntry
+	addToArchive := func(p string, rp string) error {
+		if err := a.waitIfPaused(ctx); err != nil {
+			return err
+		}
+		if err := a.addToArchive(p, rp, tw); err != nil {
+			return err
+		}
+		// Adjust the compression level to the system load between files.
+		if adaptive != nil {
+			return adaptive.retune()
+		}
+		return nil
+	}
+	add := addToArchive
+	if a.SortBySimilarity {
+		add = func(p string, rp string) error {
+			entries = append(entries, archiveEntry{path: p, relative: rp})
+			return nil
+		}
+	}
+
+	if err := a.writeVirtualFiles(tw, false); err != nil {
+		return err
+	}
+
+	// Recursively walk the path we are archiving.
+	filters = append([]func(string, string) error{func(_ string, _ string) error {
+		return ctx.Err()
+	}}, filters...)
+	if err := a.walk(add, filters...); err != nil {
+		return err
+	}
+
+	if a.SortBySimilarity {
+		sortBySimilarity(entries)
+		for _, e := range entries {
+			if err := addToArchive(e.path, e.relative); err != nil {
+				return err
+			}
+		}
+	}
+
+	if a.OCILayer && a.Baseline != nil {
+		if err := a.writeOCIWhiteouts(tw); err != nil {
+			return err
+		}
+	}
+
+	if a.WriteRestoreManifest {
+		if err := a.writeRestoreManifest(tw); err != nil {
+			return err
+		}
+	}
+
+	if err := a.writeVirtualFiles(tw, true); err != nil {
+		return err
+	}
+
+	// Close the writers explicitly so that any trailing data is flushed and
+	// errors are reported, rather than being silently dropped by the defers.
+	if gw == nil || a.Dictionary != nil {
+		if err := tw.Close(); err != nil {
+			return errors.WrapIf(err, "archive: failed to close tar writer")
+		}
+		if gw != nil {
+			if err := gw.Close(); err != nil {
+				return errors.WrapIf(err, "archive: failed to close zstd writer")
+			}
+		}
+		return nil
+	}
+	// The end of archive marker is written as a separate gzip member, rather than
+	// by closing the tar writer, so that archives can be merged by ConcatArchives
+	// without needing to be decompressed.
+	if err := tw.Flush(); err != nil {
+		return errors.WrapIf(err, "archive: failed to flush tar writer")
+	}
+	if err := gw.Close(); err != nil {
+		return errors.WrapIf(err, "archive: failed to close gzip writer")
 	}
+	if _, err := out.Write(gzipTarTrailer); err != nil {
+		return errors.WrapIf(err, "archive: failed to write end of archive")
+	}
+	return nil
+}
 
-	// Create a new tar writer around the gzip writer.
-	tw := tar.NewWriter(pw)
-	defer tw.Close()
+// QuotaExceededError is returned when the files being archived exceed the
+// QuotaBytes configured for the archive.
+type QuotaExceededError struct {
+	Size  int64
+	Quota int64
+}
 
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("archive: files to archive (%s) exceed the quota of %s", system.FormatBytes(e.Size), system.FormatBytes(e.Quota))
+}
+
+// SpecialEntriesExceededError is returned when the files being archived contain
+// more symlinks and special files than the MaxSpecialEntries of the archive.
+type SpecialEntriesExceededError struct {
+	// Path is the entry that exceeded the limit.
+	Path  string
+	Count int
+	Limit int
+}
+
+func (e *SpecialEntriesExceededError) Error() string {
+	return fmt.Sprintf("archive: files to archive contain more than %d symlinks and special files (%d at '%s')", e.Limit, e.Count, e.Path)
+}
+
+// countSpecial counts the file towards the MaxSpecialEntries of the archive if it
+// is not a regular file or directory, returning an error once the limit has been
+// exceeded.
+func (a *Archive) countSpecial(rp string, mode fs.FileMode) error {
+	if a.MaxSpecialEntries < 1 || mode.IsRegular() || mode.IsDir() {
+		return nil
+	}
+	a.special++
+	if a.special > a.MaxSpecialEntries {
+		return errors.WithStack(&SpecialEntriesExceededError{Path: rp, Count: a.special, Limit: a.MaxSpecialEntries})
+	}
+	return nil
+}
+
+// EstimateSize walks the BasePath of the archive using the same Files and Ignore
+// filtering used when creating an archive, and returns the total size of all of
+// the regular files that would be included. This is the uncompressed size of
+// the data, the final size of the archive will differ.
+func (a *Archive) EstimateSize() (int64, error) {
+	return a.estimate(nil)
+}
+
+// estimate returns the total size of the regular files matched by the archive,
+// calling weigh with the size of each of them if it is provided.
+func (a *Archive) estimate(weigh func(relative string, size int64), filters ...func(path string, relative string) error) (int64, error) {
+	var size int64
+	err := a.walk(func(p string, rp string) error {
+		st, err := os.Lstat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		if st.Mode()&os.ModeSymlink != 0 && a.SymlinkPolicy == SymlinkFollow {
+			if target, err := os.Stat(p); err == nil {
+				st = target
+			}
+		}
+		if st.Mode().IsRegular() {
+			size += st.Size()
+			if weigh != nil {
+				weigh(rp, st.Size())
+			}
+		}
+		return nil
+	}, filters...)
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// selfExclusionFilter returns a walk filter that skips any of the given paths if
+// they are encountered while walking the tree.
+func (a *Archive) selfExclusionFilter(paths ...string) (func(path string, relative string) error, error) {
+	exclude := make(map[string]struct{}, len(paths))
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		exclude[abs] = struct{}{}
+	}
+	return func(p string, rp string) error {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil
+		}
+		if _, ok := exclude[abs]; ok {
+			a.log().WithField("path", rp).Warn("archive destination is inside of the directory being archived; excluding it from the archive, this is likely a misconfiguration")
+			return godirwalk.SkipThis
+		}
+		return nil
+	}, nil
+}
+
+// walk recursively walks the BasePath of the archive, calling add for every
+// file that should be included in the archive based on the Files and Ignore
+// options.
+//
+// Any additional filters provided are called before the Files and Ignore options
+// are evaluated, and follow the same semantics as the callback options.
+func (a *Archive) walk(add func(path string, relative string) error, filters ...func(path string, relative string) error) error {
+	if err := a.validateExtraPaths(); err != nil {
+		return err
+	}
+	if err := a.validateSources(); err != nil {
+		return err
+	}
+	var err error
+	if a.WalkCache != "" && a.PruneDir == nil && a.SymlinkPolicy != SymlinkFollow {
+		err = a.cachedWalk(add, filters...)
+	} else {
+		err = a.walkTree(add, filters...)
+	}
+	if err != nil {
+		return err
+	}
+	return a.walkExtraPaths(add, filters...)
+}
+
+// walkTree walks the BasePath of the archive from the disk, see walk.
+func (a *Archive) walkTree(add func(path string, relative string) error, filters ...func(path string, relative string) error) error {
 	// Configure godirwalk.
 	options := &godirwalk.Options{
 		FollowSymbolicLinks: false,
 		Unsorted:            true,
-		Callback:            a.callback(tw),
+		Callback:            a.callback(add, filters...),
+		ErrorCallback:       a.walkError,
 	}
 
 	// If we're specifically looking for only certain files, or have requested
 	// that certain files be ignored we'll update the callback function to reflect
 	// that request.
-	if len(a.Files) == 0 && len(a.Ignore) > 0 {
-		i := ignore.CompileIgnoreLines(strings.Split(a.Ignore, "\n")...)
+	if patterns := a.ignorePatterns(); len(a.Files) == 0 && len(patterns) > 0 {
+		i := ignore.CompileIgnoreLines(strings.Split(patterns, "\n")...)
 
-		options.Callback = a.callback(tw, func(_ string, rp string) error {
+		options.Callback = a.callback(add, append(filters, func(_ string, rp string) error {
 			if i.MatchesPath(rp) {
 				return godirwalk.SkipThis
 			}
 
 			return nil
-		})
+		})...)
 	} else if len(a.Files) > 0 {
-		options.Callback = a.withFilesCallback(tw)
+		options.Callback = a.withFilesCallback(add, filters...)
 	}
 
-	// Recursively walk the path we are archiving.
-	return godirwalk.Walk(a.BasePath, options)
+	return godirwalk.Walk(a.root(), options)
+}
+
+// gzipCompressionLevel returns the gzip compression level to use based on the
+// compression_level configuration option.
+func gzipCompressionLevel() int {
+	level, _ := Level(compressionLevelName()).gzipLevel()
+	return level
+}
+
+// compressionLevelName returns the compression level configured for backups.
+func compressionLevelName() string {
+	switch l := config.Get().System.Backups.CompressionLevel; l {
+	case "none", "best_compression":
+		return l
+	default:
+		return "best_speed"
+	}
+}
+
+// sortBySimilarity orders the given entries by their extension, followed by
+// their base name and finally their relative path so that the ordering is
+// deterministic for a given tree.
+func sortBySimilarity(entries []archiveEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		ei, ej := strings.ToLower(filepath.Ext(entries[i].relative)), strings.ToLower(filepath.Ext(entries[j].relative))
+		if ei != ej {
+			return ei < ej
+		}
+		bi, bj := filepath.Base(entries[i].relative), filepath.Base(entries[j].relative)
+		if bi != bj {
+			return bi < bj
+		}
+		return entries[i].relative < entries[j].relative
+	})
+}
+
+// walkError handles errors encountered while walking the tree. Directories that
+// cannot be read due to a permission error are logged and skipped rather than
+// failing the entire archive, any other error will halt the walk.
+func (a *Archive) walkError(p string, err error) godirwalk.ErrorAction {
+	if !errors.Is(err, fs.ErrPermission) {
+		return godirwalk.Halt
+	}
+	if st, serr := os.Lstat(p); serr != nil || !st.IsDir() {
+		return godirwalk.Halt
+	}
+	rp := a.relative(p)
+	a.log().WithField("path", rp).WithField("error", err.Error()).Warn("failed reading directory due to permissions; skipping...")
+	a.skip(rp, SkipReasonPermission)
+	return godirwalk.SkipNode
+}
+
+// relative returns the path relative to the BasePath of the archive, or the path
+// within the archive when walking one of the ExtraPaths.
+func (a *Archive) relative(p string) string {
+	rp := filepath.ToSlash(strings.TrimPrefix(p, a.root()+string(filepath.Separator)))
+	if a.walkPrefix != "" {
+		return path.Join(a.walkPrefix, rp)
+	}
+	return rp
+}
+
+// root returns the directory being walked.
+func (a *Archive) root() string {
+	if a.walkRoot != "" {
+		return a.walkRoot
+	}
+	return a.BasePath
 }
 
 // Callback function used to determine if a given file should be included in the archive
 // being generated.
-func (a *Archive) callback(tw *tar.Writer, opts ...func(path string, relative string) error) func(path string, de *godirwalk.Dirent) error {
-	return func(path string, de *godirwalk.Dirent) error {
+func (a *Archive) callback(add func(path string, relative string) error, opts ...func(path string, relative string) error) func(path string, de *godirwalk.Dirent) error {
+	// Track every directory that has been walked so that a symlink pointing back
+	// to one of its own parent directories can be detected.
+	dirs := make(map[string]os.FileInfo)
+	var cb func(path string, de *godirwalk.Dirent) error
+	cb = func(path string, de *godirwalk.Dirent) error {
 		// Skip directories because we are walking them recursively.
 		if de.IsDir() {
+			if a.PruneDir != nil && path != a.root() && a.PruneDir(a.relative(path)) {
+				return godirwalk.SkipThis
+			}
+			if st, err := os.Stat(path); err == nil {
+				dirs[path] = st
+				if a.onDir != nil {
+					a.onDir(path, st)
+				}
+			}
 			return nil
 		}
 
-		relative := filepath.ToSlash(strings.TrimPrefix(path, a.BasePath+string(filepath.Separator)))
+		relative := a.relative(path)
+
+		// A symlink to a directory that is being followed is walked the same as any
+		// other directory, with the filters applied to everything within it.
+		if de.IsSymlink() && a.SymlinkPolicy == SymlinkFollow {
+			if st, err := os.Stat(path); err == nil && st.IsDir() {
+				return a.followDir(path, relative, cb)
+			}
+		}
 
 		// Call the additional options passed to this callback function. If any of them return
 		// a non-nil error we will exit immediately.
@@ -200,19 +1450,44 @@ func (a *Archive) callback(tw *tar.Writer, opts ...func(path string, relative st
 			}
 		}
 
+		if de.IsSymlink() && a.isCircularSymlink(path, dirs) {
+			a.log().WithField("path", relative).Warn("symlink points to one of its parent directories; skipping...")
+			a.skip(relative, SkipReasonCircularSymlink)
+			return nil
+		}
+
 		// Add the file to the archive, if it is nested in a directory,
 		// the directory will be automatically "created" in the archive.
-		return a.addToArchive(path, relative, tw)
+		return add(path, relative)
+	}
+	return cb
+}
+
+// isCircularSymlink returns true if the symlink at the given path resolves to
+// one of the directories it is contained within.
+func (a *Archive) isCircularSymlink(p string, dirs map[string]os.FileInfo) bool {
+	target, err := os.Stat(p)
+	if err != nil || !target.IsDir() {
+		return false
+	}
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		if st, ok := dirs[dir]; ok && os.SameFile(st, target) {
+			return true
+		}
+		if dir == a.root() || dir == filepath.Dir(dir) {
+			return false
+		}
 	}
 }
 
 // Pushes only files defined in the Files key to the final archive.
-func (a *Archive) withFilesCallback(tw *tar.Writer) func(path string, de *godirwalk.Dirent) error {
-	return a.callback(tw, func(p string, rp string) error {
-		for _, f := range a.Files {
-			// If the given doesn't match, or doesn't have the same prefix continue
-			// to the next item in the loop.
-			if p != f && !strings.HasPrefix(strings.TrimSuffix(p, "/")+"/", f) {
+func (a *Archive) withFilesCallback(add func(path string, relative string) error, filters ...func(path string, relative string) error) func(path string, de *godirwalk.Dirent) error {
+	files := normalizeFiles(a.Files)
+	return a.callback(add, append(filters, func(p string, rp string) error {
+		for _, f := range files {
+			// If the given doesn't match, or isn't within the directory continue to the
+			// next item in the loop.
+			if p != f && !strings.HasPrefix(p, strings.TrimSuffix(f, string(filepath.Separator))+string(filepath.Separator)) {
 				continue
 			}
 
@@ -224,7 +1499,117 @@ func (a *Archive) withFilesCallback(tw *tar.Writer) func(path string, de *godirw
 		}
 
 		return godirwalk.SkipThis
+	})...)
+}
+
+// normalizeFiles returns the cleaned and sorted paths of the given files, without
+// any duplicates or paths within a directory that is also included, so that every
+// file is matched by at most one of them.
+func normalizeFiles(files []string) []string {
+	cleaned := make([]string, len(files))
+	for i, f := range files {
+		cleaned[i] = filepath.Clean(f)
+	}
+	// Sort the separator before every other character so that the paths within a
+	// directory immediately follow it.
+	sep := string(filepath.Separator)
+	sort.Slice(cleaned, func(i, j int) bool {
+		return strings.ReplaceAll(cleaned[i], sep, "\x00") < strings.ReplaceAll(cleaned[j], sep, "\x00")
 	})
+	out := cleaned[:0]
+	for _, f := range cleaned {
+		if len(out) > 0 {
+			last := out[len(out)-1]
+			if f == last || strings.HasPrefix(f, strings.TrimSuffix(last, sep)+sep) {
+				continue
+			}
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// begin resets the state of the archive before it is written.
+func (a *Archive) begin(compress bool) {
+	a.mu.Lock()
+	a.stats = ArchiveStats{}
+	a.manifest = nil
+	if a.buildingManifest() {
+		a.manifest = &Manifest{CreatedAt: time.Now(), Entries: make(map[string]ManifestEntry)}
+	}
+	a.mu.Unlock()
+	atomic.StoreInt64(&a.size, 0)
+	atomic.StoreInt64(&a.compressed, 0)
+	a.links = make(map[fileID]string)
+	a.dirs = make(map[string]bool)
+	a.restore = nil
+	a.index = nil
+	a.entries = 0
+	a.special = 0
+	a.members = nil
+	a.compress = compress
+	a.inactiveBefore = time.Time{}
+	if a.MaxInactivity > 0 {
+		if atimeReliable(a.BasePath) {
+			a.inactiveBefore = time.Now().Add(-a.MaxInactivity)
+		} else {
+			a.log().WithField("path", a.BasePath).Warn("filesystem does not track file access times; not skipping inactive files")
+		}
+	}
+}
+
+// tarFormat returns the format to use for the headers written to the archive.
+func (a *Archive) tarFormat() tar.Format {
+	switch a.TarFormat {
+	case tar.FormatUSTAR, tar.FormatGNU:
+		return a.TarFormat
+	default:
+		return tar.FormatPAX
+	}
+}
+
+// writeHeader writes the header to the archive using the configured TarFormat,
+// falling back to PAX if the header cannot be represented in that format.
+func (a *Archive) writeHeader(w *tar.Writer, header *tar.Header) error {
+	header.Format = a.tarFormat()
+	// Access and change times are not kept in the archive, they would otherwise be
+	// written for every entry once a format is explicitly chosen.
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	if header.Format == tar.FormatUSTAR {
+		header.ModTime = header.ModTime.Round(time.Second)
+	}
+	err := w.WriteHeader(header)
+	if err != nil && header.Format != tar.FormatPAX {
+		// Errors caused by the header not being representable in the format are not
+		// fatal to the writer, so the header can be written again. Any other error is
+		// sticky and will simply be returned again.
+		a.log().WithField("name", header.Name).WithField("format", header.Format.String()).WithField("error", err).
+			Debug("tar header cannot be represented in the selected format; falling back to PAX")
+		header.Format = tar.FormatPAX
+		err = w.WriteHeader(header)
+	}
+	if err == nil && header.Typeflag != tar.TypeDir {
+		a.entries++
+	}
+	return err
+}
+
+// inactive reports whether the given file has not been accessed or modified
+// since the MaxInactivity threshold of the archive. A file modified after it
+// was last accessed is judged by its modification time instead.
+func (a *Archive) inactive(s os.FileInfo) bool {
+	if a.inactiveBefore.IsZero() || !s.Mode().IsRegular() {
+		return false
+	}
+	last, ok := accessTime(s)
+	if !ok {
+		return false
+	}
+	if s.ModTime().After(last) {
+		last = s.ModTime()
+	}
+	return last.Before(a.inactiveBefore)
 }
 
 // Adds a given file path to the final archive being created.
@@ -240,9 +1625,74 @@ func (a *Archive) addToArchive(p string, rp string, w *tar.Writer) error {
 		return errors.WrapIff(err, "failed executing os.Lstat on '%s'", rp)
 	}
 
+	source := a.sourceOf(p)
+
+	// Apply the symlink policy before anything else, a followed symlink is archived
+	// exactly as if it was its target.
+	if s.Mode()&fs.ModeSymlink != 0 {
+		switch a.SymlinkPolicy {
+		case SymlinkSkip:
+			a.skip(rp, SkipReasonSymlink)
+			return nil
+		case SymlinkFollow:
+			target, ok := a.resolveSymlink(p, rp)
+			if !ok {
+				return nil
+			}
+			if s, err = os.Stat(target); err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return errors.WrapIff(err, "failed executing os.Stat on '%s'", rp)
+			}
+			// Directories are walked by the callback rather than added.
+			if s.IsDir() {
+				return nil
+			}
+			p = target
+		}
+	}
+
+	// When the progress is weighted it is advanced by the estimated size of the file
+	// as it is copied, whatever remains is completed once the file has been handled
+	// regardless of whether it was written to the archive.
+	var weight int64
+	if a.weights != nil {
+		weight = a.weights[rp]
+		defer func() {
+			a.Progress.advance(weight)
+		}()
+	}
+
+	if a.inactive(s) {
+		a.skip(rp, SkipReasonInactive)
+		return nil
+	}
+
+	// Regular files that have not changed since the baseline are left out of an
+	// incremental archive, but are still included in its manifest.
+	if a.Baseline != nil && s.Mode().IsRegular() {
+		if prev, ok := a.unchanged(p, rp, s); ok {
+			a.recordManifestEntry(rp, prev)
+			a.mu.Lock()
+			a.stats.Unchanged++
+			a.mu.Unlock()
+			a.logEntry(rp, s.Size(), "skipped", "unchanged")
+			return nil
+		}
+	}
+
 	// Skip socket files as they are unsupported by archive/tar.
 	// Error will come from tar#FileInfoHeader: "archive/tar: sockets not supported"
 	if s.Mode()&fs.ModeSocket != 0 {
+		a.logEntry(rp, 0, "skipped", "socket")
+		return nil
+	}
+
+	isDevice := s.Mode()&fs.ModeDevice != 0
+	if isDevice && !a.IncludeDevices {
+		a.log().WithField("path", rp).Warn("file is a device; skipping...")
+		a.skip(rp, SkipReasonDevice)
 		return nil
 	}
 
@@ -253,11 +1703,11 @@ func (a *Archive) addToArchive(p string, rp string, w *tar.Writer) error {
 		// the logs, but we're not going to stop the backup. There are far too many cases of
 		// symlinks causing all sorts of unnecessary pain in this process. Sucks to suck if
 		// it doesn't work.
-		target, err = os.Readlink(s.Name())
+		target, err = os.Readlink(p)
 		if err != nil {
 			// Ignore the not exist errors specifically, since theres nothing important about that.
 			if !os.IsNotExist(err) {
-				log.WithField("path", rp).WithField("readlink_err", err.Error()).Warn("failed reading symlink for target path; skipping...")
+				a.log().WithField("path", rp).WithField("readlink_err", err.Error()).Warn("failed reading symlink for target path; skipping...")
 			}
 			return nil
 		}
@@ -269,18 +1719,173 @@ func (a *Archive) addToArchive(p string, rp string, w *tar.Writer) error {
 		return errors.WrapIff(err, "failed to get tar#FileInfoHeader for '%s'", rp)
 	}
 
-	// Fix the header name if the file is not a symlink.
-	if s.Mode()&fs.ModeSymlink == 0 {
-		header.Name = rp
+	// The header is named after the base name of the file, use the path relative to
+	// the root of the archive instead.
+	header.Name = rp
+
+	// Device files cannot be restored without their device numbers.
+	if isDevice {
+		major, minor, ok := deviceNumbers(s)
+		if !ok {
+			a.log().WithField("path", rp).Warn("failed to read device numbers of file; skipping...")
+			a.skip(rp, SkipReasonDevice)
+			return nil
+		}
+		header.Devmajor = major
+		header.Devminor = minor
+	}
+
+	// If this file is hardlinked to a file that has already been written to the
+	// archive, store it as a link to that entry instead of copying it again. The
+	// first file is only recorded once it has been written under its final name,
+	// so that a link never points at an entry that was skipped or renamed.
+	var link *fileID
+	var deduplicated int64
+	if a.DeduplicateHardlinks && header.Typeflag == tar.TypeReg {
+		if id, nlink, ok := hardlinkID(s); ok && nlink > 1 {
+			if first, ok := a.links[id]; ok {
+				deduplicated = header.Size
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				link = &id
+			}
+		}
+	}
+
+	if !validEntryName(header.Name) {
+		switch a.InvalidNames {
+		case InvalidNameSkip:
+			a.log().WithField("path", sanitizeEntryName(rp)).Warn("file name is not valid UTF-8; skipping...")
+			a.skip(rp, SkipReasonInvalidName)
+			return nil
+		case InvalidNameSanitize:
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords[RawNameRecord] = base64.StdEncoding.EncodeToString([]byte(header.Name))
+			header.Name = sanitizeEntryName(header.Name)
+		}
+	}
+
+	if a.RecordAbsolutePath {
+		key := a.AbsolutePathKey
+		if key == "" {
+			key = AbsolutePathRecord
+		}
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[key] = p
+	}
+
+	if source != "" {
+		if header.PAXRecords == nil {
+			header.PAXRecords = make(map[string]string)
+		}
+		header.PAXRecords[SourceRecord] = source
+	}
+
+	if a.RecordACLs && header.Typeflag == tar.TypeReg {
+		acl, err := getACL(p)
+		if err != nil {
+			return errors.WrapIff(err, "failed to read the acl of '%s'", rp)
+		}
+		if acl != nil {
+			if header.PAXRecords == nil {
+				header.PAXRecords = make(map[string]string)
+			}
+			header.PAXRecords[ACLRecord] = string(acl)
+		}
+	}
+
+	// Open the file before writing the header so that a file which cannot be opened
+	// does not leave a header without any contents in the archive.
+	var f *os.File
+	if header.Typeflag == tar.TypeReg && header.Size > 0 {
+		f, err = openWithRetry(p, uint(config.Get().System.Backups.OpenRetries))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errors.WrapIff(err, "failed to open '%s' for copying", header.Name)
+		}
+		defer f.Close()
+
+		if len(a.DenyContentTypes) > 0 {
+			denied, err := a.deniedContentType(f)
+			if err != nil {
+				return errors.WrapIff(err, "failed to detect content type of '%s'", header.Name)
+			}
+			if denied {
+				a.skip(rp, SkipReasonContentType)
+				return nil
+			}
+		}
+
+		if a.Snapshot != SnapshotNone {
+			snap, err := a.snapshot(f)
+			if err != nil {
+				return errors.WrapIff(err, "failed to snapshot '%s'", header.Name)
+			}
+			if snap != nil {
+				defer snap.Close()
+				st, err := snap.Stat()
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				f = snap
+				header.Size = st.Size()
+				if header.Size == 0 {
+					f = nil
+				}
+			}
+		}
+	}
+
+	if a.OCILayer {
+		normalizeOCIHeader(header)
+		if err := a.writeOCIParents(w, rp, header.Name); err != nil {
+			return err
+		}
+	}
+
+	if err := a.countSpecial(rp, s.Mode()); err != nil {
+		return err
+	}
+
+	offset, err := a.indexOffset(w)
+	if err != nil {
+		return errors.WrapIff(err, "failed to start new archive member for '%s'", rp)
 	}
 
 	// Write the tar FileInfoHeader to the archive.
-	if err := w.WriteHeader(header); err != nil {
+	if err := a.writeHeader(w, header); err != nil {
 		return errors.WrapIff(err, "failed to write tar#FileInfoHeader for '%s'", rp)
 	}
+	if a.WriteRestoreManifest {
+		a.recordRestoreEntry(header)
+	}
+	a.mu.Lock()
+	a.stats.Files++
+	a.stats.DeduplicatedBytes += deduplicated
+	a.mu.Unlock()
 
-	// If the size of the file is less than 1 (most likely for symlinks), skip writing the file.
-	if header.Size < 1 {
+	// If there is no file to copy (most likely for symlinks), skip writing the contents.
+	if f == nil {
+		if link != nil {
+			a.links[*link] = header.Name
+		}
+		if a.buildingManifest() && header.Typeflag == tar.TypeReg {
+			a.recordManifestEntry(rp, ManifestEntry{ModTime: s.ModTime(), Checksum: hex.EncodeToString(sha256.New().Sum(nil))})
+		}
+		if header.Typeflag == tar.TypeReg {
+			a.recordIndexEntry(header, offset, hex.EncodeToString(sha256.New().Sum(nil)))
+		} else {
+			a.recordIndexEntry(header, offset, "")
+		}
+		a.logEntry(header.Name, 0, "stored", "")
 		return nil
 	}
 
@@ -297,20 +1902,118 @@ func (a *Archive) addToArchive(p string, rp string, w *tar.Writer) error {
 		}()
 	}
 
-	// Open the file.
-	f, err := os.Open(p)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return errors.WrapIff(err, "failed to open '%s' for copying", header.Name)
+	// Hash the contents of the file as it is copied if a manifest or index is being
+	// built.
+	var dst io.Writer = w
+	h := sha256.New()
+	if a.buildingManifest() || a.WriteIndex {
+		dst = io.MultiWriter(w, h)
+	}
+
+	// Report the file if copying it takes longer than the configured threshold.
+	if a.SlowFileThreshold > 0 && a.OnSlowFile != nil {
+		var written int64
+		dst = &countingWriter{n: &written, w: dst}
+		defer a.watchSlowFile(header.Name, &written)()
+	}
+
+	if weight > 0 {
+		dst = &weightedWriter{p: a.Progress, remaining: &weight, w: dst}
 	}
-	defer f.Close()
 
 	// Copy the file's contents to the archive using our buffer.
-	if _, err := io.CopyBuffer(w, io.LimitReader(f, header.Size), buf); err != nil {
+	var n int64
+	if timeout := time.Duration(config.Get().System.Backups.FileTimeout) * time.Second; timeout > 0 {
+		n, err = copyWithTimeout(dst, io.LimitReader(f, header.Size), buf, timeout)
+		if errors.Is(err, errFileTimeout) && a.PadTimedOutFiles {
+			a.log().WithField("path", rp).WithField("timeout", timeout.String()).Warn("timed out copying file to archive; padding remaining contents with zeros...")
+			a.skip(rp, SkipReasonTimeout)
+			var pad int64
+			pad, err = io.CopyBuffer(dst, io.LimitReader(zeroReader{}, header.Size-n), buf)
+			n += pad
+		}
+	} else {
+		n, err = io.CopyBuffer(dst, io.LimitReader(f, header.Size), buf)
+	}
+	if err != nil {
 		return errors.WrapIff(err, "failed to copy '%s' to archive", header.Name)
 	}
+	// If the file was truncated after its header was written fewer bytes will have
+	// been read than expected. The tar writer still expects the size in the header,
+	// so pad the rest of the entry with zeros, then remove the difference from the
+	// progress total since it is not part of the file.
+	if n < header.Size {
+		a.log().WithField("path", rp).WithField("size", header.Size).WithField("read", n).Warn("file was truncated while it was being archived; padding remaining contents with zeros...")
+		if _, err := io.CopyBuffer(dst, io.LimitReader(zeroReader{}, header.Size-n), buf); err != nil {
+			return errors.WrapIff(err, "failed to copy '%s' to archive", header.Name)
+		}
+		if a.Progress != nil && a.weights == nil {
+			a.Progress.Adjust(n - header.Size)
+		}
+	}
+	if !a.compress || a.level == pgzip.NoCompression {
+		a.logEntry(header.Name, n, "stored", "")
+	} else {
+		a.logEntry(header.Name, n, "compressed", "")
+	}
+
+	if a.buildingManifest() {
+		a.recordManifestEntry(rp, ManifestEntry{Size: header.Size, ModTime: s.ModTime(), Checksum: hex.EncodeToString(h.Sum(nil))})
+	}
+	a.recordIndexEntry(header, offset, hex.EncodeToString(h.Sum(nil)))
+	if link != nil {
+		a.links[*link] = header.Name
+	}
 
 	return nil
 }
+
+// weightedWriter advances a progress by the bytes written through it, up to the
+// remaining weight of the file being copied.
+type weightedWriter struct {
+	p         *Progress
+	remaining *int64
+	w         io.Writer
+}
+
+func (ww *weightedWriter) Write(b []byte) (int, error) {
+	n, err := ww.w.Write(b)
+	adv := int64(n)
+	if adv > *ww.remaining {
+		adv = *ww.remaining
+	}
+	*ww.remaining -= adv
+	ww.p.advance(adv)
+	return n, err
+}
+
+// openFile opens the files being archived, and openRetryBackoff is the delay
+// before the first time an open is retried by openWithRetry. They are only
+// replaced by tests.
+var (
+	openFile         = os.Open
+	openRetryBackoff = 100 * time.Millisecond
+)
+
+// openWithRetry opens the file at the given path for reading. If the file cannot
+// be opened due to a transient error, which is most commonly seen on network
+// mounted storage, the open will be retried up to "attempts" number of times
+// using a backoff before the error is returned to the caller.
+func openWithRetry(p string, attempts uint) (*os.File, error) {
+	var tries uint
+	for {
+		f, err := openFile(p)
+		if err != nil && tries < attempts && isTransientError(err) {
+			time.Sleep(openRetryBackoff << tries)
+			tries++
+			continue
+		}
+		return f, err
+	}
+}
+
+// isTransientError returns true if the error is one that may resolve itself if
+// the operation is retried.
+func isTransientError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.EINTR)
+}
@@ -0,0 +1,40 @@
+package filesystem
+
+import (
+	"sync"
+)
+
+// activeBackups tracks the progress of every archive currently being created
+// for a server, keyed by the server identifier.
+var activeBackups = struct {
+	sync.RWMutex
+	m map[string]*Progress
+}{m: make(map[string]*Progress)}
+
+// ActiveBackup returns the progress of the archive currently being created for
+// the given server, if there is one.
+func ActiveBackup(server string) (*Progress, bool) {
+	activeBackups.RLock()
+	defer activeBackups.RUnlock()
+	p, ok := activeBackups.m[server]
+	return p, ok
+}
+
+// registerActiveBackup registers the progress as the active backup for the
+// server. The returned function removes the registration and should be deferred
+// so that it also runs if creating the archive panics.
+func registerActiveBackup(server string, p *Progress) func() {
+	activeBackups.Lock()
+	activeBackups.m[server] = p
+	activeBackups.Unlock()
+
+	return func() {
+		activeBackups.Lock()
+		defer activeBackups.Unlock()
+		// Only remove the registration if it has not been replaced by another backup
+		// of the same server that was started in the meantime.
+		if activeBackups.m[server] == p {
+			delete(activeBackups.m, server)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package filesystem
+
+import (
+	"io"
+	"math"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/klauspost/pgzip"
+)
+
+// gzipStream is a writer producing a gzip compressed stream.
+type gzipStream interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// newGzipWriter returns a gzip writer compressing at the given level to w, using
+// as much concurrency as the memory budget allows.
+func newGzipWriter(w io.Writer, level int) *pgzip.Writer {
+	gw, _ := pgzip.NewWriterLevel(w, level)
+	_ = gw.SetConcurrency(gzipConcurrency())
+	return gw
+}
+
+// setGzipHeader sets the header written at the start of the gzip stream. This
+// must be called before anything is written to the stream, only the first gzip
+// member of the stream is given the header.
+func setGzipHeader(gw gzipStream, header pgzip.Header) {
+	switch z := gw.(type) {
+	case *pgzip.Writer:
+		z.Header = header
+	case *memberGzipWriter:
+		z.gw.Header = header
+	case *adaptiveGzipWriter:
+		z.gw.Header = header
+	}
+}
+
+// gzipHeaderFor returns the gzip header for an archive being created at dst,
+// naming the tarball within it and recording when it was created, and for which
+// server if one is set. Gzip header strings must be Latin-1, a name that is not
+// printable ASCII is left out rather than failing the archive.
+func gzipHeaderFor(dst string, server string, now time.Time) pgzip.Header {
+	header := pgzip.Header{ModTime: now, Comment: "created by wings at " + now.UTC().Format(time.RFC3339)}
+	if server != "" && printableASCII(server) {
+		header.Comment = "server " + server + " " + header.Comment
+	}
+	// Name the contents the same as gzip does when decompressing the archive.
+	name := filepath.Base(dst)
+	if strings.HasSuffix(name, ".tgz") {
+		name = strings.TrimSuffix(name, ".tgz") + ".tar"
+	} else {
+		name = strings.TrimSuffix(name, ".gz")
+	}
+	if printableASCII(name) {
+		header.Name = name
+	}
+	return header
+}
+
+// printableASCII returns true if every character of the string is printable
+// ASCII.
+func printableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// memberGzipWriter is a gzip writer that is able to end the current gzip member
+// and start a new one. Since gzip readers treat multiple members as a single
+// stream the output is still read back as one continuous stream, but each
+// member can also be decompressed on its own.
+type memberGzipWriter struct {
+	w     io.Writer
+	gw    *pgzip.Writer
+	level int
+	// dirty is true if anything has been written to the current member.
+	dirty bool
+}
+
+// newMemberGzipWriter returns a member gzip writer compressing at the given
+// level to w.
+func newMemberGzipWriter(w io.Writer, level int) *memberGzipWriter {
+	return &memberGzipWriter{w: w, gw: newGzipWriter(w, level), level: level}
+}
+
+func (z *memberGzipWriter) Write(p []byte) (int, error) {
+	z.dirty = true
+	return z.gw.Write(p)
+}
+
+func (z *memberGzipWriter) Flush() error {
+	return z.gw.Flush()
+}
+
+func (z *memberGzipWriter) Close() error {
+	return z.gw.Close()
+}
+
+// next ends the current gzip member, once it returns everything written so far
+// has been written to the underlying writer. The following writes are written
+// to a new member using the given compression level. If nothing has been
+// written to the current member it is reused, unless the level is different.
+func (z *memberGzipWriter) next(level int) error {
+	if !z.dirty && level == z.level {
+		return nil
+	}
+	if err := z.gw.Close(); err != nil {
+		return err
+	}
+	z.gw = newGzipWriter(z.w, level)
+	z.level = level
+	z.dirty = false
+	return nil
+}
+
+// adaptiveSampleInterval is the minimum amount of time between samples of the
+// system load when adapting the compression level.
+const adaptiveSampleInterval = 5 * time.Second
+
+// adaptiveGzipWriter is a gzip writer that adjusts its compression level based on
+// the load of the system, starting a new gzip member whenever the level changes.
+type adaptiveGzipWriter struct {
+	*memberGzipWriter
+	min      int
+	max      int
+	interval time.Duration
+	sampled  time.Time
+	load     func() (float64, bool)
+}
+
+// newAdaptiveGzipWriter returns an adaptive gzip writer that will compress to w
+// using a level between min and max.
+func newAdaptiveGzipWriter(w io.Writer, min int, max int) *adaptiveGzipWriter {
+	min = clampCompressionLevel(min)
+	max = clampCompressionLevel(max)
+	if min > max {
+		min, max = max, min
+	}
+	z := &adaptiveGzipWriter{min: min, max: max, interval: adaptiveSampleInterval, load: systemLoad}
+	z.memberGzipWriter = newMemberGzipWriter(w, z.levelFor())
+	z.sampled = time.Now()
+	return z
+}
+
+// retune samples the system load, if it has not been sampled recently, and
+// switches to a new gzip member if the compression level should be changed.
+func (z *adaptiveGzipWriter) retune() error {
+	if time.Since(z.sampled) < z.interval {
+		return nil
+	}
+	z.sampled = time.Now()
+	if level := z.levelFor(); level != z.level {
+		return z.next(level)
+	}
+	return nil
+}
+
+// levelFor returns the compression level to use for the current system load.
+// The maximum level is used while the load per CPU is at or below 0.5, and the
+// minimum level once it reaches 1, scaling linearly in between.
+func (z *adaptiveGzipWriter) levelFor() int {
+	load, ok := z.load()
+	if !ok {
+		return z.max
+	}
+	r := load / float64(runtime.NumCPU())
+	switch {
+	case r <= 0.5:
+		return z.max
+	case r >= 1:
+		return z.min
+	default:
+		return z.max - int(math.Round((r-0.5)/0.5*float64(z.max-z.min)))
+	}
+}
+
+// clampCompressionLevel limits the level to the range of gzip levels that
+// actually compress the data.
+func clampCompressionLevel(level int) int {
+	if level < pgzip.BestSpeed {
+		return pgzip.BestSpeed
+	}
+	if level > pgzip.BestCompression {
+		return pgzip.BestCompression
+	}
+	return level
+}
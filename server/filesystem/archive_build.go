@@ -0,0 +1,130 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+// FileSpec describes an entry of an archive built by BuildArchive.
+type FileSpec struct {
+	// Content is the contents of a regular file.
+	Content []byte
+	// Mode is the mode of the entry, a directory is created by setting fs.ModeDir.
+	// If no permission bits are set the entry defaults to 0644, or 0755 for a
+	// directory.
+	Mode fs.FileMode
+	// SymlinkTarget makes the entry a symlink pointing to the given target, the
+	// content and mode are ignored.
+	SymlinkTarget string
+	// ModTime is the modification time of the entry, defaults to the time the
+	// archive is built.
+	ModTime time.Time
+}
+
+// BuildArchive writes a gzipped tarball containing the given entries to w without
+// reading anything from the disk, keyed by their path within the archive. The
+// headers are generated and written the same as they are by Create for a file
+// with the same details, and the gzip stream is framed the same way, which makes
+// this useful for building archives in tests. Entries are written in the order of
+// their names, and the directories containing an entry are not written unless
+// they are included themselves.
+func BuildArchive(w io.Writer, files map[string]FileSpec) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		cleaned := path.Clean(strings.TrimPrefix(name, "/"))
+		if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return errors.Errorf("archive: invalid file name '%s'", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	a := &Archive{}
+	gw := newGzipWriter(w, gzipCompressionLevel())
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	now := time.Now()
+	for _, name := range names {
+		spec := files[name]
+		info := specInfo{name: path.Base(name), spec: spec}
+		if spec.ModTime.IsZero() {
+			info.spec.ModTime = now
+		}
+		header, err := tar.FileInfoHeader(info, spec.SymlinkTarget)
+		if err != nil {
+			return errors.WrapIff(err, "failed to get tar#FileInfoHeader for '%s'", name)
+		}
+		header.Name = path.Clean(strings.TrimPrefix(name, "/"))
+		if err := a.writeHeader(tw, header); err != nil {
+			return errors.WrapIff(err, "failed to write tar#FileInfoHeader for '%s'", name)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(spec.Content); err != nil {
+				return errors.WrapIff(err, "failed to copy '%s' to archive", name)
+			}
+		}
+	}
+
+	// Write the end of archive marker as a separate gzip member, the same as Create.
+	if err := tw.Flush(); err != nil {
+		return errors.WrapIf(err, "archive: failed to flush tar writer")
+	}
+	if err := gw.Close(); err != nil {
+		return errors.WrapIf(err, "archive: failed to close gzip writer")
+	}
+	if _, err := w.Write(gzipTarTrailer); err != nil {
+		return errors.WrapIf(err, "archive: failed to write end of archive")
+	}
+	return nil
+}
+
+// specInfo is the fs.FileInfo of an entry described by a FileSpec.
+type specInfo struct {
+	name string
+	spec FileSpec
+}
+
+func (i specInfo) Name() string {
+	return i.name
+}
+
+func (i specInfo) Size() int64 {
+	if !i.Mode().IsRegular() {
+		return 0
+	}
+	return int64(len(i.spec.Content))
+}
+
+func (i specInfo) Mode() fs.FileMode {
+	if i.spec.SymlinkTarget != "" {
+		return fs.ModeSymlink | 0o777
+	}
+	mode := i.spec.Mode
+	if mode.Perm() == 0 {
+		if mode.IsDir() {
+			mode |= 0o755
+		} else {
+			mode |= 0o644
+		}
+	}
+	return mode
+}
+
+func (i specInfo) ModTime() time.Time {
+	return i.spec.ModTime
+}
+
+func (i specInfo) IsDir() bool {
+	return i.Mode().IsDir()
+}
+
+func (i specInfo) Sys() interface{} {
+	return nil
+}
@@ -0,0 +1,93 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"emperror.dev/errors"
+	"github.com/klauspost/pgzip"
+)
+
+// gzipTarTrailer is the end of archive marker of a tarball, two empty blocks, as a
+// standalone gzip member. Archives created by Wings end with this member so that
+// it can be dropped when merging archives.
+var gzipTarTrailer = func() []byte {
+	var b bytes.Buffer
+	gw, _ := gzip.NewWriterLevel(&b, gzip.BestCompression)
+	_, _ = gw.Write(make([]byte, 1024))
+	_ = gw.Close()
+	return b.Bytes()
+}()
+
+// ConcatArchives merges the given archives into a single gzipped tarball at dst.
+// The gzip members of archives created by Wings are copied as they are, only the
+// end of archive marker between them is dropped, so merging does not require the
+// archives to be decompressed. Any other archives are decompressed and their
+// entries compressed again into dst. Entries in later archives take precedence
+// over entries with the same name in earlier archives when extracted, so an
+// incremental archive can be merged on top of its base.
+func ConcatArchives(dst string, srcs ...string) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	for _, src := range srcs {
+		if err := concatArchive(f, src); err != nil {
+			return errors.WrapIff(err, "archive: failed to merge '%s'", src)
+		}
+	}
+	if _, err := f.Write(gzipTarTrailer); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
+
+// concatArchive writes the entries of the archive at src to w without an end of
+// archive marker.
+func concatArchive(w io.Writer, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// If the archive ends with the standalone end of archive member everything
+	// before it can be copied as is.
+	if n := int64(len(gzipTarTrailer)); st.Size() >= n {
+		tail := make([]byte, n)
+		if _, err := f.ReadAt(tail, st.Size()-n); err != nil {
+			return errors.WithStack(err)
+		}
+		if bytes.Equal(tail, gzipTarTrailer) {
+			_, err := io.Copy(w, io.NewSectionReader(f, 0, st.Size()-n))
+			return errors.WithStack(err)
+		}
+	}
+
+	gw, _ := pgzip.NewWriterLevel(w, gzipCompressionLevel())
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	err = walkArchive(src, func(header *tar.Header, r io.Reader) error {
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.WithStack(err)
+		}
+		_, err := io.Copy(tw, r)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(gw.Close())
+}
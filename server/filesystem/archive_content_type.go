@@ -0,0 +1,30 @@
+package filesystem
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// deniedContentType reports whether the content type of the file is in the
+// DenyContentTypes of the archive. The file is read without changing its offset.
+func (a *Archive) deniedContentType(f *os.File) (bool, error) {
+	buf := make([]byte, 512)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	ct, _, err := mime.ParseMediaType(http.DetectContentType(buf[:n]))
+	if err != nil {
+		return false, nil
+	}
+	for _, deny := range a.DenyContentTypes {
+		deny = strings.ToLower(deny)
+		if ct == deny || (strings.HasSuffix(deny, "/*") && strings.HasPrefix(ct, strings.TrimSuffix(deny, "*"))) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,75 @@
+package filesystem
+
+import (
+	"context"
+	"sync"
+)
+
+// ArchiveControl allows an archive that is being created to be paused and then
+// resumed, without canceling it. Pausing takes effect at the next file boundary,
+// the file being copied when Pause is called is always finished first. A paused
+// archive holds no locks, the stats and progress of the archive can still be
+// read and other operations on the filesystem are unaffected.
+//
+// The zero value is ready to use and a control can be shared between archives.
+type ArchiveControl struct {
+	mu sync.Mutex
+	// resume is closed to resume the archive, it is nil while not paused.
+	resume chan struct{}
+}
+
+// Pause pauses the archive at the next file boundary.
+func (c *ArchiveControl) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resume == nil {
+		c.resume = make(chan struct{})
+	}
+}
+
+// Resume resumes a paused archive.
+func (c *ArchiveControl) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resume != nil {
+		close(c.resume)
+		c.resume = nil
+	}
+}
+
+// Paused returns true if the archive is currently paused.
+func (c *ArchiveControl) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resume != nil
+}
+
+// wait blocks while the archive is paused, returning the error from the context
+// if it is canceled first.
+func (c *ArchiveControl) wait(ctx context.Context) error {
+	c.mu.Lock()
+	resume := c.resume
+	c.mu.Unlock()
+	if resume == nil {
+		return nil
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// waitIfPaused blocks while the Control of the archive is paused.
+func (a *Archive) waitIfPaused(ctx context.Context) error {
+	if a.Control == nil || !a.Control.Paused() {
+		return nil
+	}
+	a.log().WithField("path", a.BasePath).Info("archive has been paused; waiting to be resumed...")
+	if err := a.Control.wait(ctx); err != nil {
+		return err
+	}
+	a.log().WithField("path", a.BasePath).Info("archive has been resumed")
+	return nil
+}
@@ -0,0 +1,144 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"emperror.dev/errors"
+	"github.com/apex/log"
+	"github.com/klauspost/pgzip"
+)
+
+// ConvertArchive streams the archive at src into a new archive at dst using the
+// provided format, without extracting any of the files to the disk. File modes,
+// modification times and symlinks are preserved where the target format is able
+// to represent them. Entries that cannot be represented in the target format,
+// such as hardlinks or device files in a zip, are logged and left out.
+func ConvertArchive(src, dst string, toFormat Format) error {
+	switch toFormat {
+	case FormatZip, FormatTar, FormatTarGzip:
+	default:
+		return errors.Errorf("archive: cannot convert to unsupported format '%s'", toFormat)
+	}
+	// Writing over the source would truncate it before it has been read.
+	if sameFile(src, dst) {
+		return errors.Errorf("archive: cannot convert '%s' into itself", src)
+	}
+
+	// The archive is written to a temporary file which is renamed over dst once it
+	// is complete, so that a failed conversion never leaves a partial archive.
+	f, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := convertArchive(src, f, toFormat); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(f.Name(), dst))
+}
+
+// sameFile reports whether a and b are the same file, either because they are
+// the same path or because they both exist and point at the same file.
+func sameFile(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	sa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	sb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(sa, sb)
+}
+
+// convertArchive writes the entries of the archive at src to out in the given
+// format, which must be one of the formats supported by ConvertArchive.
+func convertArchive(src string, out io.Writer, toFormat Format) error {
+	if toFormat == FormatZip {
+		zw := zip.NewWriter(out)
+		defer zw.Close()
+		if err := walkArchive(src, func(header *tar.Header, r io.Reader) error {
+			return writeZipEntry(zw, header, r)
+		}); err != nil {
+			return err
+		}
+		return errors.WithStack(zw.Close())
+	}
+
+	var w io.Writer = out
+	var gw *pgzip.Writer
+	if toFormat == FormatTarGzip {
+		gw, _ = pgzip.NewWriterLevel(out, gzipCompressionLevel())
+		defer gw.Close()
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	if err := walkArchive(src, func(header *tar.Header, r io.Reader) error {
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.WrapIff(err, "failed to write tar#FileInfoHeader for '%s'", header.Name)
+		}
+		if _, err := io.Copy(tw, r); err != nil {
+			return errors.WrapIff(err, "failed to copy '%s' to archive", header.Name)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	if gw != nil {
+		return errors.WithStack(gw.Close())
+	}
+	return nil
+}
+
+// writeZipEntry writes the given tar entry into the zip archive.
+func writeZipEntry(zw *zip.Writer, header *tar.Header, r io.Reader) error {
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeSymlink:
+	default:
+		log.WithField("path", header.Name).WithField("type", string(header.Typeflag)).Warn("entry type cannot be represented in a zip archive; skipping...")
+		return nil
+	}
+
+	zh, err := zip.FileInfoHeader(header.FileInfo())
+	if err != nil {
+		return errors.WrapIff(err, "failed to create zip header for '%s'", header.Name)
+	}
+	zh.Name = header.Name
+	zh.Method = zip.Deflate
+	if header.Typeflag == tar.TypeDir {
+		zh.Name = strings.TrimSuffix(zh.Name, "/") + "/"
+		zh.Method = zip.Store
+	}
+
+	w, err := zw.CreateHeader(zh)
+	if err != nil {
+		return errors.WrapIff(err, "failed to write zip header for '%s'", header.Name)
+	}
+	// Zip archives store the target of a symlink as the contents of the entry.
+	if header.Typeflag == tar.TypeSymlink {
+		_, err = w.Write([]byte(header.Linkname))
+	} else if header.Typeflag == tar.TypeReg {
+		_, err = io.Copy(w, r)
+	}
+	if err != nil {
+		return errors.WrapIff(err, "failed to copy '%s' to archive", header.Name)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package filesystem
+
+import (
+	"encoding/binary"
+	"os"
+
+	"emperror.dev/errors"
+)
+
+// zstdDictMagic is the magic number at the start of a zstd dictionary.
+const zstdDictMagic = 0xEC30A437
+
+// DictionaryPath returns the path of the zstd dictionary stored alongside the
+// archive at the given path, see Archive.Dictionary.
+func DictionaryPath(p string) string {
+	return p + ".dict"
+}
+
+// ZstdDictionaryID returns the id of the given zstd dictionary, which is stored
+// in the frames compressed with it as well as the metadata of the archive.
+func ZstdDictionaryID(dict []byte) (uint32, error) {
+	if len(dict) < 8 || binary.LittleEndian.Uint32(dict) != zstdDictMagic {
+		return 0, errors.New("archive: invalid zstd dictionary")
+	}
+	return binary.LittleEndian.Uint32(dict[4:]), nil
+}
+
+// ReadArchiveDictionary reads the zstd dictionary stored alongside the archive at
+// the given path.
+func ReadArchiveDictionary(p string) ([]byte, error) {
+	b, err := os.ReadFile(DictionaryPath(p))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return b, nil
+}
+
+// archiveDictionaries returns the dictionary stored alongside the archive at the
+// given path, if there is one, to be passed to NewDecompressingReader.
+func archiveDictionaries(p string) ([][]byte, error) {
+	b, err := ReadArchiveDictionary(p)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return [][]byte{b}, nil
+}
+
+// writeArchiveDictionary writes the zstd dictionary for the archive at the given
+// path.
+func writeArchiveDictionary(p string, dict []byte) error {
+	if err := os.WriteFile(DictionaryPath(p), dict, 0o600); err != nil {
+		return errors.WrapIf(err, "archive: failed to write dictionary file")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+// FileEntry describes a single file contained within an archive.
+type FileEntry struct {
+	Name     string      `json:"name"`
+	Size     int64       `json:"size"`
+	Mode     fs.FileMode `json:"mode"`
+	ModTime  time.Time   `json:"modified"`
+	Linkname string      `json:"linkname,omitempty"`
+	// Checksum is the hex encoded SHA256 hash of the contents of the entry, this
+	// is only present for regular files when it is available.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// newFileEntry returns the FileEntry for the given tar header.
+func newFileEntry(header *tar.Header) FileEntry {
+	return FileEntry{
+		Name:     header.Name,
+		Size:     header.Size,
+		Mode:     header.FileInfo().Mode(),
+		ModTime:  header.ModTime,
+		Linkname: header.Linkname,
+	}
+}
+
+// ModifiedEntry is an entry that exists in both archives being compared, but
+// that differs between them.
+type ModifiedEntry struct {
+	Before FileEntry `json:"before"`
+	After  FileEntry `json:"after"`
+}
+
+// ArchiveDiff contains the differences between two archives.
+type ArchiveDiff struct {
+	Added    []FileEntry     `json:"added"`
+	Removed  []FileEntry     `json:"removed"`
+	Modified []ModifiedEntry `json:"modified"`
+}
+
+// DiffArchives compares the archive at a against the archive at b and returns
+// the entries that were added, removed or modified in b. Both archives are read
+// as streams, an entry is considered modified if its type, size, link target or
+// the checksum of its contents differ between the archives. Directories are not
+// compared.
+func DiffArchives(a, b string) (*ArchiveDiff, error) {
+	before, err := archiveEntries(a)
+	if err != nil {
+		return nil, errors.WrapIff(err, "archive: failed to read '%s'", a)
+	}
+	after, err := archiveEntries(b)
+	if err != nil {
+		return nil, errors.WrapIff(err, "archive: failed to read '%s'", b)
+	}
+	return diffEntries(before, after), nil
+}
+
+// diffEntries compares two sets of entries keyed by their name.
+func diffEntries(before, after map[string]FileEntry) *ArchiveDiff {
+	diff := &ArchiveDiff{
+		Added:    []FileEntry{},
+		Removed:  []FileEntry{},
+		Modified: []ModifiedEntry{},
+	}
+	for name, e := range after {
+		prev, ok := before[name]
+		if !ok {
+			diff.Added = append(diff.Added, e)
+			continue
+		}
+		if entryModified(prev, e) {
+			diff.Modified = append(diff.Modified, ModifiedEntry{Before: prev, After: e})
+		}
+	}
+	for name, e := range before {
+		if _, ok := after[name]; !ok {
+			diff.Removed = append(diff.Removed, e)
+		}
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].Name < diff.Added[j].Name })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Name < diff.Removed[j].Name })
+	sort.Slice(diff.Modified, func(i, j int) bool { return diff.Modified[i].After.Name < diff.Modified[j].After.Name })
+	return diff
+}
+
+// entryModified returns true if the two entries differ. Checksums are only
+// compared when they are present for both entries.
+func entryModified(a, b FileEntry) bool {
+	if a.Mode.Type() != b.Mode.Type() || a.Size != b.Size || a.Linkname != b.Linkname {
+		return true
+	}
+	return a.Checksum != "" && b.Checksum != "" && a.Checksum != b.Checksum
+}
+
+// archiveEntries reads every non-directory entry from the archive at the given
+// path, computing the checksum of any regular files as they are read.
+func archiveEntries(src string) (map[string]FileEntry, error) {
+	entries := make(map[string]FileEntry)
+	err := walkArchive(src, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag == tar.TypeDir {
+			return nil
+		}
+		e := newFileEntry(header)
+		if header.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			if _, err := io.Copy(h, r); err != nil {
+				return errors.WrapIff(err, "failed to read '%s' from archive", header.Name)
+			}
+			e.Checksum = hex.EncodeToString(h.Sum(nil))
+		}
+		entries[header.Name] = e
+		return nil
+	})
+	return entries, err
+}
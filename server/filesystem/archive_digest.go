@@ -0,0 +1,82 @@
+package filesystem
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+
+	"emperror.dev/errors"
+)
+
+// DigestTree returns a map of each relative path in the tree at root to a SHA256
+// hash of its contents, filtered the same as a backup of root would be. See
+// Archive.DigestTree to digest a tree using the Files and Ignore options of an
+// archive.
+func DigestTree(root string) (map[string]string, error) {
+	return (&Archive{BasePath: root}).DigestTree()
+}
+
+// DigestTree walks the BasePath of the archive using the same Files and Ignore
+// filtering that would be applied when creating an archive, and returns a map
+// of each relative path to a SHA256 hash of its contents. No archive is created
+// by this function.
+//
+// Symlinks are included using a hash of their target rather than the contents
+// of the file they point to. Comparing the output of two calls makes it simple
+// to determine exactly which files have changed between them.
+func (a *Archive) DigestTree() (map[string]string, error) {
+	digests := make(map[string]string)
+	err := a.walk(func(p string, rp string) error {
+		sum, err := digestFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errors.WrapIff(err, "failed to compute digest for '%s'", rp)
+		}
+		if sum != "" {
+			digests[rp] = sum
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+// digestFile returns the hex encoded SHA256 hash of the file at the given path.
+// An empty string is returned for file types that would not be archived.
+func digestFile(p string) (string, error) {
+	st, err := os.Lstat(p)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	switch {
+	case st.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(target))
+	case st.Mode().IsRegular():
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		buf := pool.Get().([]byte)
+		defer pool.Put(buf)
+		if _, err := io.CopyBuffer(h, f, buf); err != nil {
+			return "", err
+		}
+	default:
+		return "", nil
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
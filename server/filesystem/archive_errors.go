@@ -0,0 +1,85 @@
+package filesystem
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+
+	"emperror.dev/errors"
+)
+
+// The causes that creating or extracting an archive can fail with. These are
+// matched using errors.Is by the errors returned from Create, Stream and the
+// functions extracting archives, see ArchiveError.
+var (
+	// ErrNoSpace is matched when there is not enough disk space, or the disk quota
+	// has been exceeded, while writing an archive or the files extracted from one.
+	ErrNoSpace = errors.Sentinel("archive: not enough disk space")
+	// ErrPermission is matched when a file could not be read or written due to its
+	// permissions.
+	ErrPermission = errors.Sentinel("archive: permission denied")
+	// ErrPathTraversal is matched when a path resolves to a location outside of the
+	// root it is confined to, such as an entry of an archive named "../file".
+	ErrPathTraversal = errors.Sentinel("archive: path resolves outside of the root")
+	// ErrArchiveTooLarge is matched when the files to archive exceed the quota of the
+	// archive.
+	ErrArchiveTooLarge = errors.Sentinel("archive: archive is too large")
+	// ErrCancelled is matched when the operation was canceled, either by the context
+	// it was performed with or by exceeding the MaxDuration of the archive.
+	ErrCancelled = errors.Sentinel("archive: canceled")
+)
+
+// ArchiveError is an error that creating or extracting an archive failed with,
+// classified by its cause. The message is that of the underlying error, which can
+// still be unwrapped to inspect it further.
+type ArchiveError struct {
+	// Kind is the sentinel that the error was classified as, such as ErrNoSpace.
+	Kind error
+	err  error
+}
+
+func (e *ArchiveError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ArchiveError) Unwrap() error {
+	return e.err
+}
+
+func (e *ArchiveError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// classifyArchiveError returns the error as an ArchiveError if its cause is one of
+// the sentinels, otherwise the error is returned as it is.
+func classifyArchiveError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var aerr *ArchiveError
+	if errors.As(err, &aerr) {
+		return err
+	}
+	// The archiver library formats the errors returned while walking an archive into
+	// a new error, dropping the original, so fall back to checking the message.
+	msg := err.Error()
+	var qerr *QuotaExceededError
+	var kind error
+	switch {
+	case errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) || IsErrorCode(err, ErrCodeDiskSpace) ||
+		strings.Contains(msg, syscall.ENOSPC.Error()) || strings.Contains(msg, "filesystem: not enough disk space"):
+		kind = ErrNoSpace
+	case errors.Is(err, os.ErrPermission) || strings.Contains(msg, syscall.EACCES.Error()):
+		kind = ErrPermission
+	case IsErrorCode(err, ErrCodePathResolution) || strings.Contains(msg, "resolves to a location outside the server root"):
+		kind = ErrPathTraversal
+	case errors.As(err, &qerr):
+		kind = ErrArchiveTooLarge
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrTimeBudgetExceeded):
+		kind = ErrCancelled
+	default:
+		return err
+	}
+	return &ArchiveError{Kind: kind, err: err}
+}
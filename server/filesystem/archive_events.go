@@ -0,0 +1,88 @@
+package filesystem
+
+import (
+	"math"
+	"time"
+)
+
+// progressEventInterval is the minimum amount of time between the progress
+// events published for an archive.
+const progressEventInterval = time.Second
+
+// EventEmitter publishes events to the listeners of a server, such as its
+// websocket connections. It is satisfied by events.Bus, and allows archives to
+// publish events without depending on the package of the event bus.
+type EventEmitter interface {
+	Publish(topic string, data interface{})
+}
+
+// ProgressEvents configures the progress events published for an archive while
+// it is being written, see ProgressEvent.
+type ProgressEvents struct {
+	// Emitter is where the events are published.
+	Emitter EventEmitter
+	// Topic is the topic the events are published with.
+	Topic string
+	// ID identifies the archive in every event, such as the uuid of a backup.
+	ID string
+	// Total is the expected size of the files being archived, such as the disk
+	// usage already tracked for a server. It is the total of the progress created
+	// when the archive has no Progress, which is 0 if the size is not known.
+	Total int64
+}
+
+// ProgressEvent is the data of an event reporting the progress of an archive.
+type ProgressEvent struct {
+	ID      string `json:"uuid,omitempty"`
+	Written int64  `json:"written"`
+	Total   int64  `json:"total"`
+	// Percentage is the percentage of the archive that has been written, between
+	// 0 and 100.
+	Percentage float64 `json:"percentage"`
+	// Phase is the current phase of the progress, if it has any, in which case the
+	// other fields refer to that phase and Overall to the whole progress.
+	Phase   string  `json:"phase,omitempty"`
+	Overall float64 `json:"overall,omitempty"`
+}
+
+// watch publishes an event whenever the progress has changed, at most once every
+// progressEventInterval, until the returned function is called. A final event is
+// always published when the returned function is called.
+func (pe *ProgressEvents) watch(p *Progress) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(progressEventInterval)
+		defer t.Stop()
+		last := int64(-1)
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				if written := p.Written(); written != last {
+					last = written
+					pe.publish(p)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		pe.publish(p)
+	}
+}
+
+// publish publishes the current state of the progress.
+func (pe *ProgressEvents) publish(p *Progress) {
+	e := ProgressEvent{ID: pe.ID, Written: p.Written(), Total: p.Total(), Phase: p.Phase()}
+	if e.Total > 0 {
+		e.Percentage = math.Min(100, math.Round(float64(e.Written)/float64(e.Total)*10000)/100)
+	}
+	if e.Phase != "" {
+		e.Overall = math.Round(p.Overall()*10000) / 100
+	}
+	pe.Emitter.Publish(pe.Topic, e)
+}
@@ -0,0 +1,67 @@
+package filesystem
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"emperror.dev/errors"
+)
+
+// ExtraPath is a directory outside of the BasePath of an archive that is written
+// to it, see Archive.ExtraPaths.
+type ExtraPath struct {
+	// Source is the absolute path of the directory to archive.
+	Source string
+	// ArchivePrefix is the path within the archive that the contents of the
+	// directory are nested under, such as "volumes/data".
+	ArchivePrefix string
+	// SourceID identifies the source of the files of the directory, it is stored
+	// in the SourceRecord of every entry from it. See Archive.SourceID.
+	SourceID string
+}
+
+// validateExtraPaths checks that every extra path of the archive is an existing
+// directory with a prefix that stays within the archive.
+func (a *Archive) validateExtraPaths() error {
+	for _, e := range a.ExtraPaths {
+		if !filepath.IsAbs(e.Source) {
+			return errors.Errorf("archive: extra path '%s' must be absolute", e.Source)
+		}
+		st, err := os.Stat(e.Source)
+		if err != nil {
+			return errors.WrapIff(err, "archive: failed to stat extra path '%s'", e.Source)
+		}
+		if !st.IsDir() {
+			return errors.Errorf("archive: extra path '%s' is not a directory", e.Source)
+		}
+		if p := extraPathPrefix(e.ArchivePrefix); p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			return errors.Errorf("archive: invalid prefix '%s' for extra path '%s'", e.ArchivePrefix, e.Source)
+		}
+	}
+	return nil
+}
+
+// walkExtraPaths walks each of the extra paths of the archive the same as the
+// BasePath is walked by walkTree, with the relative path of every file nested
+// under the prefix of the extra path it is in.
+func (a *Archive) walkExtraPaths(add func(path string, relative string) error, filters ...func(path string, relative string) error) error {
+	defer func() {
+		a.walkRoot = ""
+		a.walkPrefix = ""
+	}()
+	for _, e := range a.ExtraPaths {
+		a.walkRoot = filepath.Clean(e.Source)
+		a.walkPrefix = extraPathPrefix(e.ArchivePrefix)
+		if err := a.walkTree(add, filters...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extraPathPrefix returns the cleaned prefix of an extra path within the archive.
+func extraPathPrefix(prefix string) string {
+	return path.Clean(strings.TrimPrefix(filepath.ToSlash(prefix), "/"))
+}
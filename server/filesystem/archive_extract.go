@@ -0,0 +1,548 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"emperror.dev/errors"
+
+	"github.com/pterodactyl/wings/config"
+)
+
+// Ownership determines which user owns the files written by ExtractToDir.
+type Ownership string
+
+const (
+	// OwnershipNone leaves the files owned by the user running Wings.
+	OwnershipNone Ownership = ""
+	// OwnershipServer gives the files to the system user that owns the files of
+	// servers, the same as files restored to a server.
+	OwnershipServer Ownership = "server"
+	// OwnershipArchive gives the files to the user and group ids recorded in the
+	// archive.
+	OwnershipArchive Ownership = "archive"
+)
+
+// ExtractOptions are the options for extracting an archive with ExtractToDir.
+type ExtractOptions struct {
+	// Policy determines what happens when a file being extracted already exists,
+	// by default it is overwritten.
+	Policy ConflictPolicy
+	// Ownership determines which user owns the extracted files.
+	Ownership Ownership
+	// ExpectedChecksum is the checksum of the whole archive, such as the one stored
+	// in its metadata or reported for a backup. If set the archive is verified
+	// against it before anything is extracted.
+	ExpectedChecksum string
+	// ChecksumType is the algorithm of the ExpectedChecksum, either "sha1" or
+	// "sha256". Defaults to the checksum type stored in the metadata of the
+	// archive, or "sha1" which is what archives and backups are created with.
+	ChecksumType string
+	// Verify checks that the files written are exactly the files listed by the
+	// index or restore manifest of the archive once it has been extracted, and
+	// returns a RestoreMismatchError if they are not. Files kept due to the Policy
+	// count as missing. If the archive has neither, the number of files written is
+	// compared with the number of files in the archive instead.
+	Verify bool
+	// MetadataOnly recreates the structure of the archive without the contents of
+	// any file, such as to rebuild the directories of a server with the correct
+	// permissions before selectively restoring files into it. Directories, empty
+	// files and symlinks are created with the mode, ownership and modification time
+	// of their entry, and counted as created. Entries that already exist are never
+	// truncated, only their mode and ownership are restored, so the Policy does not
+	// apply. This cannot be combined with Verify.
+	MetadataOnly bool
+}
+
+// ArchiveChecksumError is returned by ExtractToDir when the checksum of the
+// archive does not match the ExpectedChecksum, it matches ErrChecksumMismatch.
+type ArchiveChecksumError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *ArchiveChecksumError) Error() string {
+	return fmt.Sprintf("%s: expected %s but the archive is %s", ErrChecksumMismatch.Error(), e.Expected, e.Actual)
+}
+
+func (e *ArchiveChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// ErrRestoreMismatch is matched by the error returned from ExtractToDir when the
+// files that were written do not match the files of the archive, see
+// ExtractOptions.Verify.
+var ErrRestoreMismatch = errors.Sentinel("archive: restored files do not match the archive")
+
+// RestoreMismatchError lists the differences between the files written by
+// ExtractToDir and the files listed by the archive. Missing and Extra are only
+// known when the archive has an index or restore manifest, otherwise only the
+// number of files is compared.
+type RestoreMismatchError struct {
+	Expected int
+	Written  int
+	Missing  []string
+	Extra    []string
+}
+
+func (e *RestoreMismatchError) Error() string {
+	msg := fmt.Sprintf("%s: expected %d files but %d were written", ErrRestoreMismatch.Error(), e.Expected, e.Written)
+	if len(e.Missing) > 0 {
+		msg += ", missing: " + strings.Join(e.Missing, ", ")
+	}
+	if len(e.Extra) > 0 {
+		msg += ", extra: " + strings.Join(e.Extra, ", ")
+	}
+	return msg
+}
+
+func (e *RestoreMismatchError) Is(target error) bool {
+	return target == ErrRestoreMismatch
+}
+
+// ExtractToDir expands the archive at src into the directory dst, creating it if
+// it does not exist, rather than restoring it over the files of a server. Any of
+// the formats supported by NewDecompressingReader can be extracted. Only regular
+// files and the hardlinks between them are written, along with the directories
+// containing them, and their mode and modification time are restored.
+//
+// Every entry must resolve to a location within dst, an entry that does not, or a
+// directory within dst that is a symlink pointing outside of it, fails the
+// extraction. If a progress is provided it tracks the bytes of the files that
+// have been written. The number of files that were written and kept due to the
+// conflict policy is returned.
+//
+// If an ExpectedChecksum is given the archive is hashed before any file is
+// written, and an ArchiveChecksumError is returned if it does not match, so a
+// corrupt archive never leaves partially extracted files behind.
+func ExtractToDir(src string, dst string, progress *Progress, opts ExtractOptions) (_ RestoreCounts, err error) {
+	defer func() {
+		err = classifyArchiveError(err)
+	}()
+
+	var counts RestoreCounts
+	if opts.MetadataOnly && opts.Verify {
+		return counts, errors.New("archive: cannot verify an archive extracted without its contents")
+	}
+	if opts.ExpectedChecksum != "" {
+		if err := verifyArchiveChecksum(src, opts.ExpectedChecksum, opts.ChecksumType); err != nil {
+			return counts, err
+		}
+	}
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return counts, errors.WithStack(err)
+	}
+	root, err := filepath.EvalSymlinks(dst)
+	if err != nil {
+		return counts, errors.WithStack(err)
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return counts, errors.WithStack(err)
+	}
+
+	var verify *restoreVerifier
+	if opts.Verify {
+		verify = &restoreVerifier{}
+	}
+	err = walkArchive(src, func(header *tar.Header, r io.Reader) error {
+		if opts.MetadataOnly {
+			created, err := extractMetadata(root, header, opts.Ownership)
+			if created {
+				counts.Created++
+			}
+			return err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeGNUSparse && header.Typeflag != tar.TypeLink {
+			return nil
+		}
+		if verify != nil {
+			var err error
+			if r, err = verify.entry(header, r); err != nil {
+				return err
+			}
+		}
+		p, err := extractPath(root, header.Name)
+		if err != nil {
+			return err
+		}
+
+		st, err := os.Lstat(p)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		if st != nil {
+			if keepExisting(st, header.ModTime, opts.Policy) {
+				counts.Kept++
+				return nil
+			}
+			// Replace a symlink rather than writing to wherever it points.
+			if st.Mode()&os.ModeSymlink != 0 {
+				if err := os.Remove(p); err != nil {
+					return errors.WithStack(err)
+				}
+			}
+		}
+		if header.Typeflag == tar.TypeLink {
+			err = extractLink(root, p, header)
+		} else {
+			err = extractFile(p, header, r, progress, opts.Ownership)
+		}
+		if err != nil {
+			return errors.WrapIff(err, "archive: failed to extract '%s'", header.Name)
+		}
+		counts.Written++
+		if verify != nil {
+			verify.written(header)
+		}
+		return nil
+	})
+	if err == nil && verify != nil {
+		err = verify.verify(src)
+	}
+	return counts, err
+}
+
+// restoreVerifier tracks the files written by ExtractToDir, see
+// ExtractOptions.Verify.
+type restoreVerifier struct {
+	// entries is the number of files in the archive, other than the manifest.
+	entries  int
+	files    []string
+	manifest *RestoreManifest
+}
+
+// entry records a regular file of the archive, returning the reader its contents
+// should be extracted from. The restore manifest is read as it is encountered.
+func (v *restoreVerifier) entry(header *tar.Header, r io.Reader) (io.Reader, error) {
+	if entryName(header.Name) != RestoreManifestName {
+		v.entries++
+		return r, nil
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var m RestoreManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.WrapIf(err, "archive: failed to parse restore manifest")
+	}
+	v.manifest = &m
+	return bytes.NewReader(b), nil
+}
+
+// written records a file that was written.
+func (v *restoreVerifier) written(header *tar.Header) {
+	if name := entryName(header.Name); name != RestoreManifestName {
+		v.files = append(v.files, name)
+	}
+}
+
+// verify compares the files that were written with the files listed by the index
+// of the archive at src, or its restore manifest.
+func (v *restoreVerifier) verify(src string) error {
+	var expected []string
+	idx, err := ReadArchiveIndex(src)
+	switch {
+	case err == nil:
+		for _, e := range idx.Entries {
+			if e.Mode.IsRegular() {
+				expected = append(expected, entryName(e.Name))
+			}
+		}
+	case !os.IsNotExist(errors.Cause(err)):
+		return err
+	case v.manifest != nil:
+		for _, e := range v.manifest.Entries {
+			// Hardlinks are written as files, just as the index lists them.
+			if e.Type == "file" || e.Type == "hardlink" {
+				expected = append(expected, entryName(e.Path))
+			}
+		}
+	default:
+		if v.entries != len(v.files) {
+			return errors.WithStack(&RestoreMismatchError{Expected: v.entries, Written: len(v.files)})
+		}
+		return nil
+	}
+
+	want := make(map[string]bool, len(expected))
+	for _, name := range expected {
+		want[name] = true
+	}
+	mismatch := RestoreMismatchError{Expected: len(want), Written: len(v.files)}
+	for _, name := range v.files {
+		if !want[name] {
+			mismatch.Extra = append(mismatch.Extra, name)
+		}
+		delete(want, name)
+	}
+	for name := range want {
+		mismatch.Missing = append(mismatch.Missing, name)
+	}
+	if len(mismatch.Missing) == 0 && len(mismatch.Extra) == 0 {
+		return nil
+	}
+	sort.Strings(mismatch.Missing)
+	sort.Strings(mismatch.Extra)
+	return errors.WithStack(&mismatch)
+}
+
+// entryName returns the name of an entry without any leading "/" or "./".
+func entryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// verifyArchiveChecksum hashes the archive at src and returns an
+// ArchiveChecksumError if it does not match the expected checksum.
+func verifyArchiveChecksum(src string, expected string, checksumType string) error {
+	if checksumType == "" {
+		checksumType = "sha1"
+		if meta, err := ReadArchiveMeta(src); err == nil && meta.ChecksumType != "" {
+			checksumType = meta.ChecksumType
+		}
+	}
+	var h hash.Hash
+	switch checksumType {
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return errors.Errorf("archive: unsupported checksum type '%s'", checksumType)
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return errors.WrapIff(err, "archive: failed to hash '%s'", src)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, expected) {
+		return errors.WithStack(&ArchiveChecksumError{Expected: expected, Actual: actual})
+	}
+	return nil
+}
+
+// confineWithin returns an error if the nearest existing directory containing p
+// resolves to a location outside of root, such as through a symlink.
+func confineWithin(root string, name string, p string) error {
+	for dir := filepath.Dir(p); ; dir = filepath.Dir(dir) {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+				return NewBadPathResolution(name, resolved)
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) || dir == root || dir == filepath.Dir(dir) {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+// extractPath returns the path within root that the entry with the given name is
+// extracted to, checking that it does not escape root in any way.
+func extractPath(root string, name string) (string, error) {
+	p, err := safeJoin(root, name)
+	if err != nil {
+		return "", err
+	}
+	if err := checkRestoredPath(strings.TrimPrefix(p, root)); err != nil {
+		return "", err
+	}
+	if err := confineWithin(root, name, p); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// extractMetadata recreates the entry within root without its contents, see
+// ExtractOptions.MetadataOnly. It returns true if anything was created.
+func extractMetadata(root string, header *tar.Header, ownership Ownership) (bool, error) {
+	switch header.Typeflag {
+	case tar.TypeDir, tar.TypeReg, tar.TypeGNUSparse, tar.TypeSymlink, tar.TypeLink:
+	default:
+		return false, nil
+	}
+	// The root of the archive is the directory being extracted into.
+	if path.Clean(strings.TrimLeft(header.Name, "/")) == "." {
+		return false, nil
+	}
+	p, err := extractPath(root, header.Name)
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return false, errors.WithStack(err)
+	}
+	st, err := os.Lstat(p)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.WithStack(err)
+	}
+	exists := st != nil
+
+	if header.Typeflag == tar.TypeLink {
+		if exists {
+			return false, nil
+		}
+		return true, extractLink(root, p, header)
+	}
+
+	if header.Typeflag == tar.TypeSymlink {
+		// Replace an existing symlink, but never a file or directory.
+		if exists {
+			if st.Mode()&os.ModeSymlink == 0 {
+				return false, nil
+			}
+			if err := os.Remove(p); err != nil {
+				return false, errors.WithStack(err)
+			}
+		}
+		if err := os.Symlink(header.Linkname, p); err != nil {
+			return false, errors.WithStack(err)
+		}
+		return true, errors.WithStack(chownRestored(p, header, ownership, os.Lchown))
+	}
+
+	mode, err := restoredMode(header.FileInfo().Mode().Perm())
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case header.Typeflag == tar.TypeDir:
+		if exists && !st.IsDir() {
+			return false, nil
+		}
+		if err := os.MkdirAll(p, mode); err != nil {
+			return false, errors.WithStack(err)
+		}
+	case !exists:
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		if err := f.Close(); err != nil {
+			return false, errors.WithStack(err)
+		}
+	case !st.Mode().IsRegular():
+		return false, nil
+	}
+	// The mode given when creating the entry is masked by the umask of the process,
+	// and is not applied at all to an existing one.
+	if err := os.Chmod(p, mode); err != nil {
+		return false, errors.WithStack(err)
+	}
+	if err := chownRestored(p, header, ownership, os.Chown); err != nil {
+		return false, errors.WithStack(err)
+	}
+	if header.Typeflag != tar.TypeDir && !exists {
+		if err := os.Chtimes(p, header.ModTime, header.ModTime); err != nil {
+			return false, errors.WithStack(err)
+		}
+	}
+	return !exists, nil
+}
+
+// extractLink creates the file at p as a hardlink to the entry of the archive it
+// is linked to, which must already have been extracted into root. Any existing
+// file at p is replaced.
+func extractLink(root string, p string, header *tar.Header) error {
+	target, err := extractPath(root, header.Linkname)
+	if err != nil {
+		return err
+	}
+	return linkFile(target, p)
+}
+
+// linkFile creates the file at p as a hardlink to target, replacing any existing
+// file at p.
+func linkFile(target string, p string) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Link(target, p))
+}
+
+// chownRestored changes the owner of the extracted entry at p according to the
+// ownership it is being extracted with.
+func chownRestored(p string, header *tar.Header, ownership Ownership, chown func(string, int, int) error) error {
+	switch ownership {
+	case OwnershipServer:
+		return chown(p, config.Get().System.User.Uid, config.Get().System.User.Gid)
+	case OwnershipArchive:
+		return chown(p, header.Uid, header.Gid)
+	}
+	return nil
+}
+
+// extractFile writes the contents of an entry to the file at p.
+func extractFile(p string, header *tar.Header, r io.Reader, progress *Progress, ownership Ownership) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	mode, err := restoredMode(header.FileInfo().Mode().Perm())
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	// The holes of a sparse file are read as zeros, skip over them rather than
+	// writing them so that the file is not restored at its full size on the disk.
+	var w io.Writer = f
+	var sw *sparseWriter
+	if isSparseHeader(header) {
+		sw = newSparseWriter(f)
+		w = sw
+	}
+	if progress != nil {
+		w = progress.Writer(w)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return errors.WithStack(err)
+	}
+	if sw != nil {
+		if err := sw.finish(); err != nil {
+			return err
+		}
+	}
+	// The mode given when creating the file is masked by the umask of the process,
+	// and is not applied at all to an existing file.
+	if err := f.Chmod(mode); err != nil {
+		return errors.WithStack(err)
+	}
+	switch ownership {
+	case OwnershipServer:
+		err = f.Chown(config.Get().System.User.Uid, config.Get().System.User.Gid)
+	case OwnershipArchive:
+		err = f.Chown(header.Uid, header.Gid)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Chtimes(p, header.ModTime, header.ModTime))
+}
@@ -0,0 +1,44 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"strings"
+
+	"emperror.dev/errors"
+)
+
+// FindInArchive returns every entry of the archive at src with a name matching
+// the given pattern, without extracting any of the files. The pattern uses the
+// syntax of path.Match and is matched against the full name of each entry, if
+// the pattern does not contain a "/" it is also matched against the base name of
+// each entry so that "*.yml" matches configuration files in any directory.
+// Directories are not included in the results.
+func FindInArchive(src string, pattern string) ([]FileEntry, error) {
+	pattern = strings.TrimPrefix(pattern, "/")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, errors.WrapIff(err, "archive: invalid pattern '%s'", pattern)
+	}
+	base := !strings.Contains(pattern, "/")
+
+	var matches []FileEntry
+	err := walkArchive(src, func(header *tar.Header, _ io.Reader) error {
+		if header.Typeflag == tar.TypeDir {
+			return nil
+		}
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		ok, _ := path.Match(pattern, name)
+		if !ok && base {
+			ok, _ = path.Match(pattern, path.Base(name))
+		}
+		if ok {
+			matches = append(matches, newFileEntry(header))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WrapIff(err, "archive: failed to read '%s'", src)
+	}
+	return matches, nil
+}
@@ -0,0 +1,85 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pterodactyl/wings/config"
+)
+
+// unsafeBasePaths are the directories of the host that are never archived unless
+// AllowUnsafeBasePath is set, since archiving them is almost certainly caused by
+// a misconfigured BasePath.
+var unsafeBasePaths = []string{
+	"/",
+	"/bin",
+	"/boot",
+	"/dev",
+	"/etc",
+	"/home",
+	"/lib",
+	"/opt",
+	"/proc",
+	"/root",
+	"/srv",
+	"/sys",
+	"/usr",
+	"/var",
+	"/var/lib",
+}
+
+// UnsafeBasePathError is returned by Create when the BasePath of the archive is a
+// directory of the host that should not be archived, see AllowUnsafeBasePath.
+type UnsafeBasePathError struct {
+	Path   string
+	Reason string
+}
+
+func (e *UnsafeBasePathError) Error() string {
+	return fmt.Sprintf("archive: refusing to archive '%s': %s", e.Path, e.Reason)
+}
+
+// resolvePath returns the absolute path of p with any symlinks resolved, or just
+// the cleaned absolute path if it cannot be resolved.
+func resolvePath(p string) string {
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		p = resolved
+	}
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	return filepath.Clean(p)
+}
+
+// checkBasePath returns an UnsafeBasePathError if the BasePath resolves to one of
+// the directories of the host, a home directory, the data directory itself or
+// a location outside of the data directory.
+func (a *Archive) checkBasePath() error {
+	if a.AllowUnsafeBasePath {
+		return nil
+	}
+	p := resolvePath(a.BasePath)
+	for _, unsafe := range unsafeBasePaths {
+		if p == unsafe {
+			return &UnsafeBasePathError{Path: p, Reason: "it is a system directory"}
+		}
+	}
+	if filepath.Dir(p) == "/home" {
+		return &UnsafeBasePathError{Path: p, Reason: "it is a home directory"}
+	}
+	if home, err := os.UserHomeDir(); err == nil && p == resolvePath(home) {
+		return &UnsafeBasePathError{Path: p, Reason: "it is a home directory"}
+	}
+	if data := config.Get().System.Data; data != "" {
+		data = resolvePath(data)
+		if p == data {
+			return &UnsafeBasePathError{Path: p, Reason: "it is the data directory"}
+		}
+		if !strings.HasPrefix(p, data+string(filepath.Separator)) {
+			return &UnsafeBasePathError{Path: p, Reason: "it is not within the data directory"}
+		}
+	}
+	return nil
+}
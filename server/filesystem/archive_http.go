@@ -0,0 +1,53 @@
+package filesystem
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// StreamHTTP generates the archive on-the-fly and streams it to the client as
+// the response for the given request using the provided file name. Since the
+// final size of the archive is unknown the response will be sent using chunked
+// transfer encoding, and the SHA256 checksum of the archive is sent as the
+// "X-Checksum" trailer once the archive has been completely written.
+//
+// If the client disconnects the context of the request is canceled, which in turn
+// stops generating the archive. If a Progress is set on the archive it can be
+// used to monitor the amount of data sent to the client.
+func (a *Archive) StreamHTTP(w http.ResponseWriter, r *http.Request, name string) error {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	w.Header().Set("Trailer", "X-Checksum")
+	w.Header().Set("X-Mime-Type", "application/tar+gzip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+
+	h := sha256.New()
+	if err := a.Stream(ctx, &flushWriter{w: io.MultiWriter(w, h), f: w}); err != nil {
+		return err
+	}
+	w.Header().Set("X-Checksum", hex.EncodeToString(h.Sum(nil)))
+	return nil
+}
+
+// flushWriter flushes the underlying response after every write so that the
+// client receives data as soon as it has been generated.
+type flushWriter struct {
+	w io.Writer
+	f http.ResponseWriter
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if fl, ok := fw.f.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return n, err
+}
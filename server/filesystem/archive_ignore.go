@@ -0,0 +1,44 @@
+package filesystem
+
+import (
+	"strings"
+)
+
+// DefaultIgnore are the gitignore patterns of files that are left out of an
+// archive when IgnoreDefaults is set. These are files created by operating
+// systems and editors that are never wanted in a backup:
+//
+//	.DS_Store      folder metadata written by macOS
+//	._*            resource forks written by macOS to non-Apple filesystems
+//	Thumbs.db      thumbnail caches written by Windows
+//	ehthumbs.db    thumbnail caches written by Windows Media Center
+//	desktop.ini    folder settings written by Windows
+//	*.swp, *.swo   swap files of open Vim buffers
+//	*~             backup files written by many editors
+//	.~lock.*#      lock files of documents open in LibreOffice
+//	*.lck          lock files left behind by running Java applications
+var DefaultIgnore = []string{
+	".DS_Store",
+	"._*",
+	"Thumbs.db",
+	"ehthumbs.db",
+	"desktop.ini",
+	"*.swp",
+	"*.swo",
+	"*~",
+	".~lock.*#",
+	"*.lck",
+}
+
+// ignorePatterns returns the gitignore patterns that files of the archive are
+// matched against, the DefaultIgnore patterns come first when IgnoreDefaults is
+// set so that they can be negated by the Ignore option.
+func (a *Archive) ignorePatterns() string {
+	if !a.IgnoreDefaults {
+		return a.Ignore
+	}
+	if a.Ignore == "" {
+		return strings.Join(DefaultIgnore, "\n")
+	}
+	return strings.Join(DefaultIgnore, "\n") + "\n" + a.Ignore
+}
@@ -0,0 +1,109 @@
+package filesystem
+
+import (
+	"os"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/goccy/go-json"
+)
+
+// Manifest describes every regular file contained within an archive, including
+// files that were not written to an incremental archive because they had not
+// changed since the baseline. The manifest of an archive can be used as the
+// Baseline of the next archive to produce a chain of incremental archives.
+type Manifest struct {
+	// CreatedAt is the time at which the archive began being created.
+	CreatedAt time.Time                `json:"created_at"`
+	Entries   map[string]ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry describes a single file within a Manifest.
+type ManifestEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+	// Checksum is the hex encoded SHA256 hash of the contents of the file.
+	Checksum string `json:"checksum"`
+}
+
+// ReadManifest reads a manifest previously written using Manifest.Write.
+func ReadManifest(p string) (*Manifest, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.WrapIf(err, "archive: failed to parse manifest")
+	}
+	return &m, nil
+}
+
+// Write writes the manifest to the given path as JSON.
+func (m *Manifest) Write(p string) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(p, b, 0o600))
+}
+
+// Manifest returns the manifest generated by the most recent call to Create.
+// A manifest is only generated when BuildManifest or Baseline is set.
+func (a *Archive) Manifest() *Manifest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.manifest == nil {
+		return nil
+	}
+	m := &Manifest{CreatedAt: a.manifest.CreatedAt, Entries: make(map[string]ManifestEntry, len(a.manifest.Entries))}
+	for k, v := range a.manifest.Entries {
+		m.Entries[k] = v
+	}
+	return m
+}
+
+// buildingManifest returns true if a manifest should be generated for the
+// archive being created.
+func (a *Archive) buildingManifest() bool {
+	return a.BuildManifest || a.Baseline != nil
+}
+
+// recordManifestEntry adds the given file to the manifest being generated.
+func (a *Archive) recordManifestEntry(rp string, e ManifestEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.manifest != nil {
+		a.manifest.Entries[rp] = e
+	}
+}
+
+// unchanged determines if the regular file at the given path is unchanged from
+// the Baseline of the archive. If it is, the baseline entry for the file is
+// returned.
+//
+// Files with a different size or modification time than the baseline are always
+// considered changed. Files with the same size and modification time are
+// considered unchanged without reading them, unless the archive is in Paranoid
+// mode or the file was modified at the same moment the baseline was created (in
+// which case it may have been modified again after being read), in which case
+// the contents of the file are hashed and compared against the baseline.
+func (a *Archive) unchanged(p string, rp string, st os.FileInfo) (ManifestEntry, bool) {
+	prev, ok := a.Baseline.Entries[rp]
+	if !ok || prev.Size != st.Size() || !prev.ModTime.Equal(st.ModTime()) {
+		return ManifestEntry{}, false
+	}
+
+	ambiguous := !st.ModTime().Truncate(time.Second).Before(a.Baseline.CreatedAt.Truncate(time.Second))
+	if !a.Paranoid && !ambiguous {
+		return prev, true
+	}
+	if prev.Checksum == "" {
+		return ManifestEntry{}, false
+	}
+	sum, err := digestFile(p)
+	if err != nil || sum != prev.Checksum {
+		return ManifestEntry{}, false
+	}
+	return prev, true
+}
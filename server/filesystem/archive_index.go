@@ -0,0 +1,253 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"emperror.dev/errors"
+	"github.com/goccy/go-json"
+	"github.com/klauspost/pgzip"
+)
+
+// ErrChecksumMismatch is returned when the contents of an entry read from an
+// archive do not match the checksum recorded for it.
+var ErrChecksumMismatch = errors.Sentinel("archive: checksum mismatch")
+
+// IndexEntry is an entry of an archive index.
+type IndexEntry struct {
+	FileEntry
+	// Offset is the position in the archive file at which the entry begins. For a
+	// compressed archive this is the start of the gzip member containing the entry,
+	// which can be decompressed without reading anything before it.
+	Offset int64 `json:"offset"`
+}
+
+// ArchiveIndex lists every entry written to an archive along with its checksum
+// and its position within the archive, allowing a single entry to be read or
+// verified without decompressing the entire archive. It is stored as a JSON file
+// alongside the archive, see IndexPath.
+type ArchiveIndex struct {
+	Format Format `json:"format"`
+	// Count is the number of entries in the archive other than directories. This
+	// can be more than the number of indexed entries since files that were not
+	// read from the disk, such as the restore manifest, are not indexed.
+	Count   int          `json:"count"`
+	Entries []IndexEntry `json:"entries"`
+}
+
+// IndexPath returns the path of the index file for the archive at the given
+// path.
+func IndexPath(p string) string {
+	return p + ".sums"
+}
+
+// ReadArchiveIndex reads the index file stored alongside the archive at the
+// given path.
+func ReadArchiveIndex(p string) (*ArchiveIndex, error) {
+	b, err := os.ReadFile(IndexPath(p))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var idx ArchiveIndex
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, errors.WrapIf(err, "archive: failed to parse index file")
+	}
+	return &idx, nil
+}
+
+// writeArchiveIndex writes the index file for the archive at the given path.
+func writeArchiveIndex(p string, idx *ArchiveIndex) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.WriteFile(IndexPath(p), b, 0o600); err != nil {
+		return errors.WrapIf(err, "archive: failed to write index file")
+	}
+	return nil
+}
+
+// Lookup returns the entry of the index with the given name.
+func (idx *ArchiveIndex) Lookup(name string) (IndexEntry, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for _, e := range idx.Entries {
+		if strings.TrimPrefix(path.Clean("/"+e.Name), "/") == name {
+			return e, true
+		}
+	}
+	return IndexEntry{}, false
+}
+
+// ReadEntry copies the contents of the given entry of the archive at src to w,
+// reading only the part of the archive containing the entry. If the index has a
+// checksum for the entry the contents are verified against it as they are read,
+// and ErrChecksumMismatch is returned if they do not match. Since the contents
+// have already been written to w when this occurs, callers should discard them
+// if an error is returned.
+func (idx *ArchiveIndex) ReadEntry(src string, e IndexEntry, w io.Writer) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	header, tr, closer, err := idx.openEntry(f, e)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), tr); err != nil {
+		return errors.WrapIff(err, "archive: failed to read '%s'", e.Name)
+	}
+	if e.Checksum != "" && hex.EncodeToString(h.Sum(nil)) != e.Checksum {
+		return errors.WithStack(ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// openEntry reads the header of the given entry from the archive, returning a tar
+// reader positioned at the contents of the entry. The returned closer must be
+// closed once the contents have been read.
+func (idx *ArchiveIndex) openEntry(f *os.File, e IndexEntry) (*tar.Header, *tar.Reader, io.Closer, error) {
+	if _, err := f.Seek(e.Offset, io.SeekStart); err != nil {
+		return nil, nil, nil, errors.WithStack(err)
+	}
+
+	var r io.ReadCloser = io.NopCloser(f)
+	switch idx.Format {
+	case FormatTar:
+	case FormatTarGzip:
+		gr, err := pgzip.NewReader(f)
+		if err != nil {
+			return nil, nil, nil, errors.WrapIf(err, "archive: failed to open gzip reader")
+		}
+		// Every indexed entry begins a new gzip member, there is no need to read
+		// any further than the end of it.
+		gr.Multistream(false)
+		r = gr
+	default:
+		return nil, nil, nil, errors.Errorf("archive: cannot read indexed entries from %s archives", idx.Format)
+	}
+
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		r.Close()
+		return nil, nil, nil, errors.WrapIff(err, "archive: failed to read header of '%s'", e.Name)
+	}
+	if header.Name != e.Name {
+		r.Close()
+		return nil, nil, nil, errors.Errorf("archive: expected '%s' at offset %d but found '%s'", e.Name, e.Offset, header.Name)
+	}
+	return header, tr, r, nil
+}
+
+// CountEntries returns the number of entries in the archive at the given path,
+// not including directories. If the archive has an index that appears to match
+// it the count is read from the index without reading the archive, otherwise
+// every entry of the archive is read to count them.
+//
+// An index is only trusted if the format it records is the format of the archive,
+// it does not list more entries than it counts, the offsets of its entries are in
+// order and the last indexed entry is found at its offset in the archive. This
+// catches an index left behind by a different archive at the same path, but an
+// index that has been tampered with can still report the wrong count.
+func CountEntries(p string) (int, error) {
+	if idx, err := ReadArchiveIndex(p); err == nil {
+		ok, err := idx.matches(p)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return idx.Count, nil
+		}
+	}
+
+	var n int
+	err := walkArchive(p, func(header *tar.Header, _ io.Reader) error {
+		if header.Typeflag != tar.TypeDir {
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.WrapIff(err, "archive: failed to read '%s'", p)
+	}
+	return n, nil
+}
+
+// matches returns true if the index appears to belong to the archive at the
+// given path, see CountEntries.
+func (idx *ArchiveIndex) matches(p string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	format, err := detectFormat(bufio.NewReaderSize(f, formatPeekSize))
+	if err != nil {
+		return false, err
+	}
+	if format != idx.Format || idx.Count < len(idx.Entries) {
+		return false, nil
+	}
+	if len(idx.Entries) == 0 {
+		return true, nil
+	}
+	for i := 1; i < len(idx.Entries); i++ {
+		if idx.Entries[i].Offset < idx.Entries[i-1].Offset {
+			return false, nil
+		}
+	}
+	_, _, closer, err := idx.openEntry(f, idx.Entries[len(idx.Entries)-1])
+	if err != nil {
+		return false, nil
+	}
+	closer.Close()
+	return true, nil
+}
+
+// indexOffset returns the offset at which the next entry written to the archive
+// will begin, ending the current gzip member so that the entry starts a new one.
+func (a *Archive) indexOffset(w *tar.Writer) (int64, error) {
+	if !a.WriteIndex {
+		return 0, nil
+	}
+	// Pad the previous entry so that everything written before this entry has been
+	// passed through to the compressor.
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if a.members == nil {
+		return atomic.LoadInt64(&a.size), nil
+	}
+	if err := a.members.next(a.members.level); err != nil {
+		return 0, err
+	}
+	return atomic.LoadInt64(&a.compressed), nil
+}
+
+// recordIndexEntry adds an entry to the index being generated for the archive.
+func (a *Archive) recordIndexEntry(header *tar.Header, offset int64, checksum string) {
+	if !a.WriteIndex {
+		return
+	}
+	e := IndexEntry{FileEntry: newFileEntry(header), Offset: offset}
+	e.Checksum = checksum
+	a.mu.Lock()
+	a.index = append(a.index, e)
+	a.mu.Unlock()
+}
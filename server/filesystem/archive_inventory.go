@@ -0,0 +1,76 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"emperror.dev/errors"
+)
+
+// Inventory walks the BasePath of the archive exactly as Create would, returning
+// every entry that would be written to the archive along with the stats of the
+// walk, without reading the contents of any file or writing anything. The Size
+// of the returned stats is the total size of the files. This is useful for
+// integrations that transfer the files themselves and only need to know which
+// files a backup would contain.
+func (a *Archive) Inventory() ([]FileEntry, *ArchiveStats, error) {
+	a.begin(false)
+
+	var entries []FileEntry
+	var size int64
+	err := a.walk(func(p string, rp string) error {
+		s, err := os.Lstat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errors.WrapIff(err, "failed executing os.Lstat on '%s'", rp)
+		}
+		if a.inactive(s) {
+			a.skip(rp, SkipReasonInactive)
+			return nil
+		}
+		if s.Mode()&fs.ModeSocket != 0 {
+			return nil
+		}
+		if s.Mode()&fs.ModeDevice != 0 && !a.IncludeDevices {
+			a.skip(rp, SkipReasonDevice)
+			return nil
+		}
+		if !validEntryName(rp) && a.InvalidNames == InvalidNameSkip {
+			a.skip(rp, SkipReasonInvalidName)
+			return nil
+		}
+
+		var target string
+		if s.Mode()&fs.ModeSymlink != 0 {
+			if target, err = os.Readlink(p); err != nil {
+				return nil
+			}
+		}
+		header, err := tar.FileInfoHeader(s, filepath.ToSlash(target))
+		if err != nil {
+			return errors.WrapIff(err, "failed to get tar#FileInfoHeader for '%s'", rp)
+		}
+		header.Name = rp
+		if !validEntryName(rp) && a.InvalidNames == InvalidNameSanitize {
+			header.Name = sanitizeEntryName(rp)
+		}
+
+		entries = append(entries, newFileEntry(header))
+		size += header.Size
+		a.mu.Lock()
+		a.stats.Files++
+		a.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stats := a.Stats()
+	stats.Size = size
+	return entries, &stats, nil
+}
@@ -0,0 +1,374 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strconv"
+
+	"emperror.dev/errors"
+)
+
+// CorruptEntry describes part of an archive that could not be read when it was
+// extracted leniently.
+type CorruptEntry struct {
+	// Name is the name of the entry that could not be read, this is empty if the
+	// header of the entry itself was unreadable.
+	Name string `json:"name,omitempty"`
+	// Offset is the offset within the uncompressed tar stream at which the
+	// corruption was found.
+	Offset int64  `json:"offset"`
+	Error  string `json:"error"`
+}
+
+// corruptReadError is returned when reading the contents of an entry fails
+// while walking an archive leniently.
+type corruptReadError struct {
+	err error
+}
+
+func (e *corruptReadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *corruptReadError) Unwrap() error {
+	return e.err
+}
+
+// isCorruptRead returns true if the error was caused by reading the contents of
+// an entry that is corrupt while walking an archive leniently.
+func isCorruptRead(err error) bool {
+	var cerr *corruptReadError
+	return errors.As(err, &cerr)
+}
+
+// errGzipResynced is matched by the error returned from a gzipResyncReader when
+// the current gzip member was corrupt and reading has skipped ahead to the start
+// of the next member. The data read after this error does not continue from the
+// data read before it.
+var errGzipResynced = errors.Sentinel("archive: skipped corrupt gzip member")
+
+// gzipResyncError is the error returned when a gzipResyncReader skips a corrupt
+// gzip member, wrapping the error that was encountered reading it.
+type gzipResyncError struct {
+	err error
+}
+
+func (e *gzipResyncError) Error() string {
+	return errGzipResynced.Error() + ": " + e.err.Error()
+}
+
+func (e *gzipResyncError) Unwrap() error {
+	return e.err
+}
+
+func (e *gzipResyncError) Is(target error) bool {
+	return target == errGzipResynced
+}
+
+// walkArchiveLenient calls fn for every entry of the tar based archive at src
+// the same as walkArchive, except that corrupt entries are skipped rather than
+// aborting the walk. Every entry, or part of the archive, that could not be read
+// is returned. If fn returns an error caused by reading the contents of a corrupt
+// entry the entry is recorded and the walk continues, any other error from fn
+// stops the walk and is returned.
+//
+// A corrupt tar header is skipped by scanning forward for the next valid header.
+// Corrupt compressed data cannot be skipped in general, for gzip archives the
+// walk resumes at the start of the next gzip member if there is one. Archives
+// created with WriteIndex start a new member for every entry, so only the
+// corrupt entries of such an archive are lost.
+func walkArchiveLenient(src string, fn func(header *tar.Header, r io.Reader) error) ([]CorruptEntry, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	format, err := detectFormat(bufio.NewReaderSize(f, formatPeekSize))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	switch format {
+	case FormatZip:
+		return nil, errors.New("archive: zip archives cannot be read leniently")
+	case FormatTarGzip:
+		return walkTarLenient(&gzipResyncReader{f: f}, fn)
+	}
+	dicts, err := archiveDictionaries(src)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := NewDecompressingReader(f, dicts...)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return walkTarLenient(r, fn)
+}
+
+// walkTarLenient calls fn for every readable entry in the tar stream, see
+// walkArchiveLenient.
+func walkTarLenient(r io.Reader, fn func(header *tar.Header, r io.Reader) error) ([]CorruptEntry, error) {
+	var n int64
+	cr := &countingReader{n: &n, r: bufio.NewReaderSize(r, 32*1024)}
+	corrupt := []CorruptEntry{}
+	record := func(name string, offset int64, err error) {
+		corrupt = append(corrupt, CorruptEntry{Name: name, Offset: offset, Error: err.Error()})
+	}
+
+	// damaged is true while scanning for a valid header after a corrupt one, so
+	// that a run of unreadable blocks is only recorded once.
+	var damaged bool
+	block := make([]byte, blockSize)
+	for {
+		start := n
+		if _, err := io.ReadFull(cr, block); err != nil {
+			if err == io.EOF {
+				return corrupt, nil
+			}
+			if !damaged {
+				record("", start, err)
+			}
+			// Skipping corrupt compressed data is only possible if the reader was
+			// able to resync to the next part of the stream.
+			if errors.Is(err, errGzipResynced) {
+				damaged = false
+				continue
+			}
+			return corrupt, nil
+		}
+		if isZeroBlock(block) {
+			continue
+		}
+		if !validTarHeader(block) {
+			if !damaged {
+				record("", start, errors.New("archive: invalid tar header"))
+				damaged = true
+			}
+			continue
+		}
+		damaged = false
+
+		tr := tar.NewReader(io.MultiReader(bytes.NewReader(block), cr))
+		header, err := tr.Next()
+		if err != nil {
+			record("", start, err)
+			if errors.Is(err, errGzipResynced) {
+				continue
+			}
+			damaged = true
+			continue
+		}
+
+		er := &entryReader{r: tr}
+		err = fn(header, er)
+		if err == nil {
+			// Discard anything that was not read by the callback along with the
+			// padding of the entry, so the next block read is the next header.
+			if _, err = io.Copy(io.Discard, er); err == nil {
+				if pad := (blockSize - header.Size%blockSize) % blockSize; pad > 0 {
+					if _, err = io.CopyN(io.Discard, cr, pad); err != nil {
+						err = &corruptReadError{err: err}
+					}
+				}
+			}
+		}
+		if err != nil {
+			if !isCorruptRead(err) {
+				return corrupt, err
+			}
+			record(header.Name, start, err)
+			if !errors.Is(err, errGzipResynced) {
+				// The position of the stream is unknown, scan for the next header.
+				damaged = true
+			}
+		}
+	}
+}
+
+// blockSize is the size of a block in a tar archive.
+const blockSize = 512
+
+// isZeroBlock returns true if every byte of the block is zero, these are used to
+// mark the end of a tar archive.
+func isZeroBlock(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validTarHeader returns true if the checksum stored in the tar header block is
+// correct. Both the unsigned and historical signed checksums are accepted.
+func validTarHeader(b []byte) bool {
+	field := bytes.TrimRight(bytes.TrimLeft(b[148:156], " "), " \x00")
+	stored, err := strconv.ParseInt(string(field), 8, 64)
+	if err != nil {
+		return false
+	}
+	var unsigned, signed int64
+	for i, c := range b {
+		if i >= 148 && i < 156 {
+			c = ' '
+		}
+		unsigned += int64(c)
+		signed += int64(int8(c))
+	}
+	return stored == unsigned || stored == signed
+}
+
+// entryReader reads the contents of an entry, marking any error encountered as
+// being caused by a corrupt entry.
+type entryReader struct {
+	r io.Reader
+}
+
+func (er *entryReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &corruptReadError{err: err}
+	}
+	return n, err
+}
+
+// countingReader counts the number of bytes read from the underlying reader.
+type countingReader struct {
+	n *int64
+	r io.Reader
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	*cr.n += int64(n)
+	return n, err
+}
+
+// gzipResyncReader decompresses a gzip stream one member at a time. If a member
+// is corrupt errGzipResynced is returned and reading continues from the start of
+// the next member that can be found in the file.
+type gzipResyncReader struct {
+	f *os.File
+	// start is the offset in the file of the member currently being read, and
+	// next is the offset of the following member once it is known.
+	start int64
+	next  int64
+	raw   *byteCounter
+	zr    *gzip.Reader
+	done  bool
+}
+
+func (r *gzipResyncReader) Read(p []byte) (int, error) {
+	for {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.zr == nil {
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		n, err := r.zr.Read(p)
+		if err == io.EOF {
+			// The member has been read completely, the next one begins immediately
+			// after it.
+			r.next = r.start + r.raw.n
+			r.zr = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		if err != nil {
+			r.zr = nil
+			r.resync(r.start + 1)
+			return n, &gzipResyncError{err: err}
+		}
+		return n, nil
+	}
+}
+
+// open begins reading the member at r.next. If there is not a valid member there
+// the reader is resynced to the next member and errGzipResynced is returned.
+func (r *gzipResyncReader) open() error {
+	if _, err := r.f.Seek(r.next, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	r.start = r.next
+	r.raw = &byteCounter{r: bufio.NewReader(r.f)}
+	b, err := r.raw.r.Peek(1)
+	if err == io.EOF {
+		r.done = true
+		return io.EOF
+	}
+	// Trailing zeros are commonly written by tools padding the archive.
+	if err == nil && b[0] == 0 {
+		if rest, err := io.ReadAll(r.raw.r); err == nil && isZeroBlock(rest) {
+			r.done = true
+			return io.EOF
+		}
+	}
+	zr, err := gzip.NewReader(r.raw)
+	if err != nil {
+		r.resync(r.start + 1)
+		return &gzipResyncError{err: err}
+	}
+	zr.Multistream(false)
+	r.zr = zr
+	return nil
+}
+
+// resync finds the offset of the next gzip member beginning at or after the
+// given offset in the file. If there is none the reader is marked as done.
+func (r *gzipResyncReader) resync(from int64) {
+	if _, err := r.f.Seek(from, io.SeekStart); err != nil {
+		r.done = true
+		return
+	}
+	br := bufio.NewReader(r.f)
+	magic := []byte{0x1f, 0x8b, 0x08}
+	for offset := from; ; offset++ {
+		b, err := br.Peek(len(magic))
+		if err != nil {
+			r.done = true
+			return
+		}
+		if bytes.Equal(b, magic) {
+			r.next = offset
+			return
+		}
+		_, _ = br.ReadByte()
+	}
+}
+
+// byteCounter is a reader that also implements io.ByteReader so that a gzip
+// reader does not read beyond the end of the member it is decompressing, and
+// counts the number of bytes that have been consumed.
+type byteCounter struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (b *byteCounter) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *byteCounter) ReadByte() (byte, error) {
+	c, err := b.r.ReadByte()
+	if err == nil {
+		b.n++
+	}
+	return c, err
+}
@@ -0,0 +1,202 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+
+	. "github.com/franela/goblin"
+
+	"github.com/pterodactyl/wings/config"
+)
+
+func TestArchive_Devices(t *testing.T) {
+	g := Goblin(t)
+	fs, rfs := NewFs()
+
+	g.Describe("Archive", func() {
+		g.AfterEach(func() {
+			rfs.reset()
+		})
+
+		g.It("handles device files", func() {
+			// Creating device files requires root.
+			if err := syscall.Mknod(filepath.Join(rfs.root, "/server/null"), syscall.S_IFCHR|0o666, 1<<8|3); err != nil {
+				return
+			}
+
+			dst := filepath.Join(rfs.root, "devices.tar.gz")
+			a := &Archive{BasePath: fs.Path()}
+			g.Assert(a.Create(dst)).IsNil()
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["null"] == nil).IsTrue()
+			g.Assert(a.Stats().Skipped).Equal([]SkippedEntry{{Path: "null", Reason: SkipReasonDevice}})
+
+			a = &Archive{BasePath: fs.Path(), IncludeDevices: true}
+			g.Assert(a.Create(dst)).IsNil()
+			headers, err = readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["null"].Typeflag).Equal(byte(tar.TypeChar))
+			g.Assert(headers["null"].Devmajor).Equal(int64(1))
+			g.Assert(headers["null"].Devminor).Equal(int64(3))
+		})
+
+		g.It("records and restores the acl of files", func() {
+			defer config.Update(func(c *config.Configuration) {
+				c.System.Backups.PreserveACLs = false
+			})
+			g.Assert(rfs.CreateServerFileFromString("acl.txt", "hello")).IsNil()
+
+			// An access ACL granting read access to the user with the uid 1000, in the
+			// format the kernel stores it as an extended attribute.
+			entries := [][3]uint32{{0x01, 6, ^uint32(0)}, {0x02, 4, 1000}, {0x04, 4, ^uint32(0)}, {0x10, 4, ^uint32(0)}, {0x20, 4, ^uint32(0)}}
+			acl := make([]byte, 4+8*len(entries))
+			binary.LittleEndian.PutUint32(acl, 2)
+			for i, e := range entries {
+				binary.LittleEndian.PutUint16(acl[4+8*i:], uint16(e[0]))
+				binary.LittleEndian.PutUint16(acl[6+8*i:], uint16(e[1]))
+				binary.LittleEndian.PutUint32(acl[8+8*i:], e[2])
+			}
+			// Setting an ACL requires a filesystem mounted with ACL support.
+			if err := setACL(filepath.Join(fs.Path(), "acl.txt"), acl); err != nil {
+				return
+			}
+
+			dst := filepath.Join(rfs.root, "acl.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path(), RecordACLs: true}).Create(dst)).IsNil()
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert([]byte(headers["acl.txt"].PAXRecords[ACLRecord])).Equal(acl)
+
+			rfs.reset()
+			b, err := os.ReadFile(dst)
+			g.Assert(err).IsNil()
+			g.Assert(rfs.CreateServerFile("acl.tar.gz", b)).IsNil()
+			g.Assert(fs.DecompressFile("/", "acl.tar.gz")).IsNil()
+			restored, err := getACL(filepath.Join(fs.Path(), "acl.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(restored == nil).IsTrue()
+
+			config.Update(func(c *config.Configuration) {
+				c.System.Backups.PreserveACLs = true
+			})
+			g.Assert(fs.DecompressFile("/", "acl.tar.gz")).IsNil()
+			restored, err = getACL(filepath.Join(fs.Path(), "acl.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(restored).Equal(acl)
+		})
+
+		g.It("restores the holes of sparse files", func() {
+			const size = 8 << 20
+			data := bytes.Repeat([]byte("x"), 4096)
+			g.Assert(rfs.CreateServerFile("sparse.tar.gz", sparseArchive("sparse.bin", size, 4<<20, data))).IsNil()
+
+			allocated := func(p string) int64 {
+				st, err := os.Stat(p)
+				g.Assert(err).IsNil()
+				g.Assert(st.Size()).Equal(int64(size))
+				return st.Sys().(*syscall.Stat_t).Blocks * 512
+			}
+
+			g.Assert(fs.DecompressFile("/", "sparse.tar.gz")).IsNil()
+			g.Assert(allocated(filepath.Join(fs.Path(), "sparse.bin")) < 1<<20).IsTrue()
+			b, err := os.ReadFile(filepath.Join(fs.Path(), "sparse.bin"))
+			g.Assert(err).IsNil()
+			g.Assert(bytes.Equal(b[4<<20:4<<20+len(data)], data)).IsTrue()
+			g.Assert(bytes.Count(b, []byte("x"))).Equal(len(data))
+
+			out := filepath.Join(rfs.root, "sparse")
+			counts, err := ExtractToDir(filepath.Join(fs.Path(), "sparse.tar.gz"), out, nil, ExtractOptions{})
+			g.Assert(err).IsNil()
+			g.Assert(counts.Written).Equal(1)
+			g.Assert(allocated(filepath.Join(out, "sparse.bin")) < 1<<20).IsTrue()
+		})
+
+		g.It("archives at the idle i/o priority when requested", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "ioprio/nested"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("ioprio/nested/test.txt", "hello")).IsNil()
+			config.Update(func(c *config.Configuration) {
+				c.System.Backups.LowPriorityIO = true
+			})
+			defer config.Update(func(c *config.Configuration) {
+				c.System.Backups.LowPriorityIO = false
+			})
+
+			// The priority is per-thread, keep the test on the thread Create runs on.
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			ioprio := func() uintptr {
+				prio, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_GET, ioprioWhoProcess, 0, 0)
+				g.Assert(errno == 0).IsTrue()
+				return prio
+			}
+			before := ioprio()
+
+			var during uintptr
+			a := &Archive{
+				BasePath: filepath.Join(fs.Path(), "ioprio"),
+				PruneDir: func(string) bool {
+					during = ioprio()
+					return false
+				},
+			}
+			g.Assert(a.Create(filepath.Join(rfs.root, "ioprio.tar.gz"))).IsNil()
+			g.Assert(during >> ioprioClassShift).Equal(uintptr(ioprioClassIdle))
+			g.Assert(ioprio()).Equal(before)
+		})
+	})
+}
+
+// sparseArchive returns a gzipped tarball containing a single file of the given
+// size stored in the GNU 1.0 sparse format, where the only data is at the given
+// offset and the rest of the file is a hole. The archive/tar writer cannot write
+// sparse files, so the PAX header is written as a regular file and retyped.
+func sparseArchive(name string, size int64, offset int64, data []byte) []byte {
+	var records string
+	for _, r := range [][2]string{
+		{"GNU.sparse.major", "1"},
+		{"GNU.sparse.minor", "0"},
+		{"GNU.sparse.name", name},
+		{"GNU.sparse.realsize", strconv.FormatInt(size, 10)},
+	} {
+		record := " " + r[0] + "=" + r[1] + "\n"
+		n := len(record) + len(strconv.Itoa(len(record)))
+		n = len(record) + len(strconv.Itoa(n))
+		records += strconv.Itoa(n) + record
+	}
+	sparseMap := []byte(fmt.Sprintf("1\n%d\n%d\n", offset, len(data)))
+	sparseMap = append(sparseMap, make([]byte, 512-len(sparseMap))...)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	_ = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "PaxHeader", Mode: 0o644, Size: int64(len(records)), Format: tar.FormatUSTAR})
+	_, _ = tw.Write([]byte(records))
+	_ = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "GNUSparseFile.0/" + name, Mode: 0o644, Size: int64(len(sparseMap) + len(data)), Format: tar.FormatUSTAR})
+	_, _ = tw.Write(sparseMap)
+	_, _ = tw.Write(data)
+	_ = tw.Close()
+
+	b := buf.Bytes()
+	b[156] = tar.TypeXHeader
+	copy(b[148:156], "        ")
+	var sum int64
+	for _, c := range b[:512] {
+		sum += int64(c)
+	}
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	_, _ = gw.Write(b)
+	_ = gw.Close()
+	return out.Bytes()
+}
@@ -0,0 +1,42 @@
+package filesystem
+
+import (
+	"github.com/apex/log"
+)
+
+// log returns the logger used while creating the archive.
+func (a *Archive) log() log.Interface {
+	if a.Logger != nil {
+		return a.Logger
+	}
+	return log.Log
+}
+
+// debugEnabled reports whether the logger used for the archive will output debug
+// messages. This is checked before building any per-entry log output so that it
+// costs next to nothing when debug logging is turned off. Loggers that are not
+// provided by apex/log are always assumed to have debug output enabled.
+func (a *Archive) debugEnabled() bool {
+	switch l := a.log().(type) {
+	case *log.Logger:
+		return l.Level <= log.DebugLevel
+	case *log.Entry:
+		return l.Logger == nil || l.Logger.Level <= log.DebugLevel
+	default:
+		return true
+	}
+}
+
+// logEntry outputs a debug message describing what was done with an entry of the
+// archive. The action is one of "compressed", "stored" or "skipped", with reason
+// describing why the entry was skipped.
+func (a *Archive) logEntry(name string, size int64, action string, reason string) {
+	if !a.debugEnabled() {
+		return
+	}
+	e := a.log().WithField("path", name).WithField("size", size).WithField("action", action)
+	if reason != "" {
+		e = e.WithField("reason", reason)
+	}
+	e.Debug("processed archive entry")
+}
@@ -0,0 +1,42 @@
+package filesystem
+
+import (
+	"runtime"
+
+	"github.com/pterodactyl/wings/config"
+)
+
+// gzipMinBlockSize is the smallest block size used by the gzip writer when it is
+// constrained by the memory budget, smaller blocks compress very poorly.
+const gzipMinBlockSize = 64 * 1024
+
+// gzipMemory returns the approximate number of bytes of memory used by the gzip
+// writer with the given concurrency. Each block being filled, compressed, or
+// waiting to be written holds an uncompressed buffer, a compressed buffer and
+// the state of its compressor.
+func gzipMemory(blockSize int, blocks int) int {
+	return (blocks + 2) * 3 * blockSize
+}
+
+// gzipConcurrency returns the block size and number of blocks used by the gzip
+// writer, keeping its memory usage within the configured memory budget.
+func gzipConcurrency() (blockSize int, blocks int) {
+	budget := config.Get().System.Backups.MemoryBudget * 1024 * 1024
+	if budget <= 0 {
+		return gzipBlockSize, gzipBlocks
+	}
+	// Use as many full size blocks as the budget allows, there is no benefit to
+	// compressing more blocks at once than there are processors to do so.
+	if blocks := budget/(3*gzipBlockSize) - 2; blocks >= 1 {
+		if max := runtime.GOMAXPROCS(0); blocks > max {
+			blocks = max
+		}
+		return gzipBlockSize, blocks
+	}
+	// Otherwise shrink the single block until it fits.
+	blockSize = budget / gzipMemory(1, 1)
+	if blockSize < gzipMinBlockSize {
+		blockSize = gzipMinBlockSize
+	}
+	return blockSize, 1
+}
@@ -0,0 +1,142 @@
+package filesystem
+
+import (
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"emperror.dev/errors"
+	"github.com/goccy/go-json"
+)
+
+// Format is the container and compression format of an archive.
+type Format string
+
+const (
+	FormatTar      Format = "tar"
+	FormatTarGzip  Format = "tar.gz"
+	FormatTarZstd  Format = "tar.zst"
+	FormatTarBzip2 Format = "tar.bz2"
+	FormatTarXz    Format = "tar.xz"
+	FormatZip      Format = "zip"
+)
+
+// ArchiveMeta describes an archive created by Wings. It is stored as a JSON
+// file alongside the archive so that consumers do not need to infer the format
+// of a backup from its file extension.
+type ArchiveMeta struct {
+	Format           Format `json:"format"`
+	CompressionLevel string `json:"compression_level"`
+	// CompressionMode is how the data of the archive was stored. Metadata written
+	// before this was recorded has it inferred from the format and level.
+	CompressionMode CompressionMode `json:"compression_mode"`
+	Checksum        string          `json:"checksum"`
+	ChecksumType    string          `json:"checksum_type"`
+	// Files is the number of entries contained within the archive.
+	Files int `json:"files"`
+	// Size is the size of the archive on the disk in bytes.
+	Size int64 `json:"size"`
+	// UncompressedSize is the size of the tarball before it was compressed, which
+	// is slightly larger than the total size of the files it contains.
+	UncompressedSize int64 `json:"uncompressed_size,omitempty"`
+	// Tags are the tags that were assigned to the archive when it was created.
+	Tags map[string]string `json:"tags,omitempty"`
+	// ZstdDictID is the id of the zstd dictionary the archive was compressed with,
+	// which is stored alongside it, see DictionaryPath.
+	ZstdDictID uint32 `json:"zstd_dict_id,omitempty"`
+}
+
+const (
+	// MaxTagKeyLength is the maximum length of the key of an archive tag.
+	MaxTagKeyLength = 64
+	// MaxTagValueLength is the maximum length of the value of an archive tag.
+	MaxTagValueLength = 256
+)
+
+// ValidateTags checks that the given archive tags can be stored. Keys must be
+// between 1 and MaxTagKeyLength characters long and consist of only letters,
+// numbers, "-", "_", "." and ":". Values can be at most MaxTagValueLength bytes
+// long and must be valid UTF-8 without any control characters.
+func ValidateTags(tags map[string]string) error {
+	for k, v := range tags {
+		if k == "" || len(k) > MaxTagKeyLength {
+			return errors.Errorf("archive: tag key '%s' must be between 1 and %d characters", k, MaxTagKeyLength)
+		}
+		for _, r := range k {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+				return errors.Errorf("archive: tag key '%s' contains invalid characters", k)
+			}
+		}
+		if len(v) > MaxTagValueLength {
+			return errors.Errorf("archive: value of tag '%s' cannot be longer than %d bytes", k, MaxTagValueLength)
+		}
+		if !utf8.ValidString(v) {
+			return errors.Errorf("archive: value of tag '%s' is not valid UTF-8", k)
+		}
+		for _, r := range v {
+			if unicode.IsControl(r) {
+				return errors.Errorf("archive: value of tag '%s' contains control characters", k)
+			}
+		}
+	}
+	return nil
+}
+
+// CompressionMode describes how the data of an archive was stored.
+type CompressionMode string
+
+const (
+	// CompressionStore is a plain tarball, without any gzip framing.
+	CompressionStore CompressionMode = "store"
+	// CompressionGzipStored is a gzip stream written without compression, the data
+	// is stored as is but wrapped in gzip framing which adds a small overhead.
+	CompressionGzipStored CompressionMode = "gzip_stored"
+	// CompressionGzip is a compressed gzip stream.
+	CompressionGzip CompressionMode = "gzip"
+	// CompressionZstd is a zstd stream compressed using a dictionary, see
+	// Archive.Dictionary.
+	CompressionZstd CompressionMode = "zstd"
+)
+
+// MetaPath returns the path of the metadata file for the archive at the given
+// path.
+func MetaPath(p string) string {
+	return p + ".meta.json"
+}
+
+// ReadArchiveMeta reads the metadata file stored alongside the archive at the
+// given path.
+func ReadArchiveMeta(p string) (*ArchiveMeta, error) {
+	b, err := os.ReadFile(MetaPath(p))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var meta ArchiveMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, errors.WrapIf(err, "archive: failed to parse metadata file")
+	}
+	if meta.CompressionMode == "" {
+		switch {
+		case meta.Format == FormatTar:
+			meta.CompressionMode = CompressionStore
+		case meta.Format == FormatTarGzip && meta.CompressionLevel == "none":
+			meta.CompressionMode = CompressionGzipStored
+		case meta.Format == FormatTarGzip:
+			meta.CompressionMode = CompressionGzip
+		}
+	}
+	return &meta, nil
+}
+
+// writeArchiveMeta writes the metadata file for the archive at the given path.
+func writeArchiveMeta(p string, meta *ArchiveMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.WriteFile(MetaPath(p), b, 0o600); err != nil {
+		return errors.WrapIf(err, "archive: failed to write metadata file")
+	}
+	return nil
+}
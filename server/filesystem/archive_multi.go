@@ -0,0 +1,143 @@
+package filesystem
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// DestinationBufferSize is the maximum number of bytes of an archive that are
+// held in memory for each destination of StreamMulti that has not yet accepted
+// them.
+const DestinationBufferSize = 4 * gzipBlockSize
+
+// StreamMulti generates the archive once and writes the compressed output to
+// every one of the provided writers. None of the writers are closed by this
+// function.
+//
+// Each writer is fed from its own goroutine with a buffer of up to
+// DestinationBufferSize bytes, so a destination that is briefly slower than the
+// others does not hold them up. Once the buffer of a destination is full the
+// archive is paced by that destination, the same as it would be with Stream,
+// which keeps the memory used bounded at the cost of the fastest destination
+// waiting on the slowest.
+//
+// If writing to any of the destinations fails the archive stops being generated
+// and the error is returned, the other destinations will have received an
+// incomplete archive and should be discarded.
+func (a *Archive) StreamMulti(ctx context.Context, writers ...io.Writer) error {
+	dests := make(multiDestination, len(writers))
+	for i, w := range writers {
+		dests[i] = newBufferedDestination(w, DestinationBufferSize)
+	}
+
+	err := a.write(ctx, dests, true)
+	// Wait for every destination to finish writing the data buffered for it, even
+	// if the archive failed, so that no writer is used after this returns.
+	for _, d := range dests {
+		if cerr := d.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// multiDestination writes to every one of the buffered destinations.
+type multiDestination []*bufferedDestination
+
+func (m multiDestination) Write(p []byte) (int, error) {
+	for _, d := range m {
+		if _, err := d.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// bufferedDestination is a writer that buffers up to limit bytes in memory while
+// they are written to the underlying writer by a separate goroutine.
+type bufferedDestination struct {
+	w     io.Writer
+	limit int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte
+	size   int
+	closed bool
+	err    error
+	done   chan struct{}
+}
+
+// newBufferedDestination returns a buffered destination writing to w and starts
+// the goroutine writing to it.
+func newBufferedDestination(w io.Writer, limit int) *bufferedDestination {
+	d := &bufferedDestination{w: w, limit: limit, done: make(chan struct{})}
+	d.cond = sync.NewCond(&d.mu)
+	go d.run()
+	return d
+}
+
+// Write queues a copy of p to be written to the underlying writer, blocking
+// while the buffer is full. Any error returned by the underlying writer is
+// returned by the next call to Write.
+func (d *bufferedDestination) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Always accept a write into an empty buffer, otherwise a write larger than the
+	// limit would block forever.
+	for d.err == nil && d.size > 0 && d.size+len(p) > d.limit {
+		d.cond.Wait()
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	d.chunks = append(d.chunks, append([]byte(nil), p...))
+	d.size += len(p)
+	d.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close waits for all of the buffered data to be written to the underlying
+// writer and returns the error encountered while writing it, if any.
+func (d *bufferedDestination) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+	<-d.done
+	return d.err
+}
+
+// run writes the buffered chunks to the underlying writer until the destination
+// is closed or a write fails.
+func (d *bufferedDestination) run() {
+	defer close(d.done)
+	for {
+		d.mu.Lock()
+		for len(d.chunks) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if len(d.chunks) == 0 {
+			d.mu.Unlock()
+			return
+		}
+		b := d.chunks[0]
+		d.chunks = d.chunks[1:]
+		d.mu.Unlock()
+
+		_, err := d.w.Write(b)
+
+		d.mu.Lock()
+		d.size -= len(b)
+		if err != nil {
+			d.err = err
+			d.chunks = nil
+		}
+		d.cond.Broadcast()
+		d.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
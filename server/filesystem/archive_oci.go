@@ -0,0 +1,90 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+// OCIWhiteoutPrefix is the prefix of the name of the empty file written to an OCI
+// layer in place of a file that has been deleted since the Baseline.
+const OCIWhiteoutPrefix = ".wh."
+
+// normalizeOCIHeader removes the details of a header that should not be stored
+// in an OCI image layer. Owner names do not resolve to the same users inside of
+// a container, only the numeric ids are kept.
+func normalizeOCIHeader(header *tar.Header) {
+	header.Uname = ""
+	header.Gname = ""
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+}
+
+// writeOCIParents writes an entry for every parent directory of the entry with
+// the given name that has not already been written to the layer, since OCI
+// layers are expected to contain the directories of the files within them. The
+// relative path is used to read the mode and owner of each directory from the
+// disk, which may differ from the name if it has been sanitized.
+func (a *Archive) writeOCIParents(w *tar.Writer, rp string, name string) error {
+	dir, rdir := path.Dir(name), path.Dir(filepath.ToSlash(rp))
+	if dir == "." || dir == "/" || a.dirs[dir] {
+		return nil
+	}
+	if err := a.writeOCIParents(w, rdir, dir); err != nil {
+		return err
+	}
+	a.dirs[dir] = true
+
+	st, err := os.Lstat(filepath.Join(a.BasePath, filepath.FromSlash(rdir)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WrapIff(err, "failed executing os.Lstat on '%s'", rdir)
+	}
+	header, err := tar.FileInfoHeader(st, "")
+	if err != nil {
+		return errors.WrapIff(err, "failed to get tar#FileInfoHeader for '%s'", rdir)
+	}
+	header.Name = dir + "/"
+	normalizeOCIHeader(header)
+	return a.writeHeader(w, header)
+}
+
+// writeOCIWhiteouts writes a whiteout entry to the layer for every file in the
+// Baseline that was not encountered while creating the archive, marking it as
+// deleted when the layer is applied on top of the layer of the baseline.
+func (a *Archive) writeOCIWhiteouts(w *tar.Writer) error {
+	a.mu.Lock()
+	var deleted []string
+	for rp := range a.Baseline.Entries {
+		if _, ok := a.manifest.Entries[rp]; !ok {
+			deleted = append(deleted, rp)
+		}
+	}
+	a.mu.Unlock()
+	sort.Strings(deleted)
+
+	for _, rp := range deleted {
+		rp = filepath.ToSlash(rp)
+		name := path.Join(path.Dir(rp), OCIWhiteoutPrefix+path.Base(rp))
+		if err := a.writeOCIParents(w, rp, name); err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			ModTime:  time.Now(),
+		}
+		if err := a.writeHeader(w, header); err != nil {
+			return errors.WrapIff(err, "failed to write whiteout for '%s'", rp)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package filesystem
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pterodactyl/wings/system"
+)
+
+// The names of the phases entered by an archive while it is being created, when
+// they have been configured on its Progress with SetPhases. PhaseVerifying is
+// never entered by the archive itself, it is intended for callers verifying the
+// archive once it has been created.
+const (
+	PhaseEstimating = "Estimating"
+	PhaseArchiving  = "Archiving"
+	PhaseVerifying  = "Verifying"
+)
+
+// ProgressPhase is a named stage of an operation tracked by a Progress, such as
+// estimating the size of the files of a backup before archiving them.
+type ProgressPhase struct {
+	Name string
+	// Weight is the share of the overall progress that the phase makes up relative
+	// to the other phases. Defaults to 1.
+	Weight float64
+}
+
+// SetPhases splits the progress into the given phases, which are expected to be
+// entered in order using StartPhase. The progress starts in the first phase.
+// Written and Total always refer to the current phase, Overall combines them with
+// the phases that have completed.
+func (p *Progress) SetPhases(phases ...ProgressPhase) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.phases = append([]ProgressPhase(nil), phases...)
+	p.phase = 0
+}
+
+// StartPhase moves the progress to the named phase, resetting the bytes written
+// and setting the total to that of the new phase. Every phase before it counts
+// as complete towards the overall progress. Phases that were not configured with
+// SetPhases are ignored, leaving the progress unchanged.
+func (p *Progress) StartPhase(name string, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, phase := range p.phases {
+		if phase.Name == name {
+			p.phase = i
+			atomic.StoreInt64(&p.written, 0)
+			atomic.StoreInt64(&p.total, total)
+			return
+		}
+	}
+}
+
+// Phase returns the name of the current phase, or an empty string if the progress
+// has no phases.
+func (p *Progress) Phase() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.phases) == 0 {
+		return ""
+	}
+	return p.phases[p.phase].Name
+}
+
+// Overall returns the fraction of the whole operation that has completed, between
+// 0 and 1, weighting every phase by its Weight. Without phases this is the
+// fraction of the total that has been written.
+func (p *Progress) Overall() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	current := p.fraction()
+	if len(p.phases) == 0 {
+		return current
+	}
+	var done, sum float64
+	for i, phase := range p.phases {
+		w := phase.Weight
+		if w <= 0 {
+			w = 1
+		}
+		switch {
+		case i < p.phase:
+			done += w
+		case i == p.phase:
+			done += w * current
+		}
+		sum += w
+	}
+	return done / sum
+}
+
+// fraction returns the fraction of the total of the current phase that has been
+// written, between 0 and 1.
+func (p *Progress) fraction() float64 {
+	total := p.Total()
+	if total <= 0 {
+		return 0
+	}
+	return math.Min(1, float64(p.Written())/float64(total))
+}
+
+// phaseProgress returns a formatted progress string for a progress with phases,
+// where the bar shows the overall progress followed by the current phase.
+func (p *Progress) phaseProgress(width int) string {
+	overall := p.Overall()
+	ticks := int(overall * float64(width))
+	bar := strings.Repeat("=", ticks) + strings.Repeat(" ", width-ticks)
+	out := "[" + bar + "] " + fmt.Sprintf("%d%%", int(overall*100)) + " " + p.Phase()
+	// Nothing more can be shown for a phase without a known total, such as while
+	// the size of the files is being estimated.
+	if p.Total() == 0 {
+		return out + "..."
+	}
+	return out + " " + system.FormatBytes(p.Written()) + " / " + system.FormatBytes(p.Total())
+}
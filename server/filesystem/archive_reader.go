@@ -0,0 +1,213 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"io"
+	"os"
+
+	"emperror.dev/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+)
+
+// The number of bytes that need to be read from the start of a file in order to
+// determine the format of an archive.
+const formatPeekSize = 262
+
+// detectFormat determines the format of the archive being read by inspecting the
+// magic bytes at the start of the stream. The reader is not advanced.
+func detectFormat(r *bufio.Reader) (Format, error) {
+	b, err := r.Peek(formatPeekSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", errors.WithStack(err)
+	}
+	switch {
+	case bytes.HasPrefix(b, []byte{0x1f, 0x8b}):
+		return FormatTarGzip, nil
+	case bytes.HasPrefix(b, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return FormatTarZstd, nil
+	case bytes.HasPrefix(b, []byte("BZh")):
+		return FormatTarBzip2, nil
+	case bytes.HasPrefix(b, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return FormatTarXz, nil
+	case bytes.HasPrefix(b, []byte("PK\x03\x04")), bytes.HasPrefix(b, []byte("PK\x05\x06")):
+		return FormatZip, nil
+	case len(b) >= formatPeekSize && bytes.Equal(b[257:262], []byte("ustar")):
+		return FormatTar, nil
+	}
+	return "", newFilesystemError(ErrCodeUnknownArchive, nil)
+}
+
+// DetectFormat returns the format of the archive at the given path, and whether
+// the archive is compressed, by reading only the first few bytes of the file. The
+// format is detected from the contents of the file regardless of its extension.
+// Zip archives are always reported as compressed, although the individual files
+// within them may be stored without compression.
+//
+// The format of a compressed archive is detected by the compression alone, which
+// is assumed to contain a tarball. If the format cannot be determined an error
+// with the ErrCodeUnknownArchive code is returned.
+func DetectFormat(p string) (Format, bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	format, err := detectFormat(bufio.NewReaderSize(f, formatPeekSize))
+	if err != nil {
+		return "", false, err
+	}
+	return format, format != FormatTar, nil
+}
+
+// NewDecompressingReader inspects the start of the provided stream to determine
+// the format of the archive and returns a reader that provides the decompressed
+// tar stream, along with the detected format. Closing the returned reader does
+// not close the underlying reader.
+//
+// Zip archives cannot be decompressed as a stream, if one is detected the
+// returned reader provides the raw bytes of the archive and FormatZip is
+// returned, it is up to the caller to handle it appropriately.
+//
+// Any zstd dictionaries provided are used to decompress zstd archives that were
+// compressed with one of them, see Archive.Dictionary.
+func NewDecompressingReader(r io.Reader, dicts ...[]byte) (io.ReadCloser, Format, error) {
+	br := bufio.NewReaderSize(r, 32*1024)
+	format, err := detectFormat(br)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch format {
+	case FormatTarGzip:
+		gr, err := pgzip.NewReader(br)
+		if err != nil {
+			return nil, format, errors.WrapIf(err, "archive: failed to open gzip reader")
+		}
+		return gr, format, nil
+	case FormatTarZstd:
+		zr, err := zstd.NewReader(br, zstd.WithDecoderDicts(dicts...))
+		if err != nil {
+			return nil, format, errors.WrapIf(err, "archive: failed to open zstd reader")
+		}
+		return zr.IOReadCloser(), format, nil
+	case FormatTarBzip2:
+		return io.NopCloser(bzip2.NewReader(br)), format, nil
+	case FormatTarXz:
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, format, errors.WrapIf(err, "archive: failed to open xz reader")
+		}
+		return io.NopCloser(xr), format, nil
+	}
+	return io.NopCloser(br), format, nil
+}
+
+// WalkArchive streams the archive at the given path and calls fn for every entry
+// contained within it, in the order they are stored. This allows entries to be
+// processed without extracting them, such as to index or scan the files of a
+// backup. The format and compression of the archive are detected from its
+// contents, any format supported by NewDecompressingReader can be walked and a
+// zstd dictionary stored alongside the archive is used.
+//
+// The reader passed to fn is limited to the contents of the entry and is only
+// valid until fn returns, an entry that is not read is skipped. Zip archives have
+// their entries converted into tar headers. If fn returns an error the walk stops
+// and the error is returned.
+func WalkArchive(src string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	return classifyArchiveError(walkArchive(src, func(header *tar.Header, r io.Reader) error {
+		return fn(header, io.LimitReader(r, header.Size))
+	}))
+}
+
+// walkArchive opens the archive at the given path and calls fn for every entry
+// contained within it. The reader passed to fn is only valid until fn returns.
+// Zip archives have their entries converted into tar headers so that callers
+// only need to handle a single header type. A zstd dictionary stored alongside
+// the archive is used to decompress it.
+func walkArchive(src string, fn func(header *tar.Header, r io.Reader) error) error {
+	dicts, err := archiveDictionaries(src)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	r, format, err := NewDecompressingReader(f, dicts...)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if format == FormatZip {
+		return walkZip(src, fn)
+	}
+	return walkTar(r, fn)
+}
+
+// walkTar calls fn for every entry in the tar stream.
+func walkTar(r io.Reader, fn func(header *tar.Header, r io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.WrapIf(err, "archive: failed to read tar header")
+		}
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// walkZip calls fn for every entry in the zip archive at the given path.
+func walkZip(src string, fn func(header *tar.Header, r io.Reader) error) error {
+	zr, err := zip.OpenReader(src)
+	if err != nil {
+		return errors.WrapIf(err, "archive: failed to open zip reader")
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		if err := walkZipFile(zf, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkZipFile(zf *zip.File, fn func(header *tar.Header, r io.Reader) error) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return errors.WrapIff(err, "archive: failed to open '%s' in zip", zf.Name)
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	header, err := tar.FileInfoHeader(zf.FileInfo(), "")
+	if err != nil {
+		return errors.WrapIff(err, "archive: failed to create header for '%s'", zf.Name)
+	}
+	header.Name = zf.Name
+	// Zip archives store the target of a symlink as the contents of the entry.
+	if header.Typeflag == tar.TypeSymlink {
+		b, err := io.ReadAll(io.LimitReader(rc, 4096))
+		if err != nil {
+			return errors.WrapIff(err, "archive: failed to read symlink target for '%s'", zf.Name)
+		}
+		header.Linkname = string(b)
+		r = bytes.NewReader(nil)
+	}
+	return fn(header, r)
+}
@@ -0,0 +1,133 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"emperror.dev/errors"
+	"github.com/klauspost/pgzip"
+)
+
+// Level is a compression level for an archive, named the same as the values of
+// the compression_level configuration option for backups.
+type Level string
+
+const (
+	LevelNone            Level = "none"
+	LevelBestSpeed       Level = "best_speed"
+	LevelBestCompression Level = "best_compression"
+)
+
+// gzipLevel returns the gzip compression level for the level.
+func (l Level) gzipLevel() (int, error) {
+	switch l {
+	case LevelNone:
+		return pgzip.NoCompression, nil
+	case LevelBestSpeed:
+		return pgzip.BestSpeed, nil
+	case LevelBestCompression:
+		return pgzip.BestCompression, nil
+	default:
+		return 0, errors.Errorf("archive: unknown compression level '%s'", l)
+	}
+}
+
+// Recompress writes the entries of the archive at src to a gzipped tarball at dst
+// compressed at the given level, such as to shrink existing backups that were
+// created at the fastest level. The entries are streamed from one archive to the
+// other without being extracted, and every header is kept as it is. Any of the
+// formats supported by NewDecompressingReader can be recompressed, and src and
+// dst may be the same path, the archive is only replaced once it has been
+// completely written.
+//
+// If src has a metadata file one is written for dst describing the recompressed
+// archive, the tags and other details are carried over. An index cannot be
+// carried over since the offsets of the entries change, any index at dst is
+// removed, as is any dictionary since the archive is no longer compressed with
+// it.
+func Recompress(src string, dst string, level Level) (err error) {
+	defer func() {
+		err = classifyArchiveError(err)
+	}()
+
+	gl, err := level.gzipLevel()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha1.New()
+	out := io.MultiWriter(f, h)
+	gw := newGzipWriter(out, gl)
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	err = walkArchive(src, func(header *tar.Header, r io.Reader) error {
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.WithStack(err)
+		}
+		_, err := io.Copy(tw, r)
+		return errors.WithStack(err)
+	})
+	if err != nil {
+		return errors.WrapIff(err, "archive: failed to recompress '%s'", src)
+	}
+	// Write the end of archive marker as a separate gzip member, the same as Create,
+	// so that the archive can still be merged by ConcatArchives.
+	if err := tw.Flush(); err != nil {
+		return errors.WrapIf(err, "archive: failed to flush tar writer")
+	}
+	if err := gw.Close(); err != nil {
+		return errors.WrapIf(err, "archive: failed to close gzip writer")
+	}
+	if _, err := out.Write(gzipTarTrailer); err != nil {
+		return errors.WrapIf(err, "archive: failed to write end of archive")
+	}
+	if err := f.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	meta, err := ReadArchiveMeta(src)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	if err := os.Rename(f.Name(), dst); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Remove(IndexPath(dst)); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	if err := os.Remove(DictionaryPath(dst)); err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	if meta == nil {
+		return nil
+	}
+	meta.Format = FormatTarGzip
+	meta.CompressionLevel = string(level)
+	meta.CompressionMode = CompressionGzip
+	if gl == pgzip.NoCompression {
+		meta.CompressionMode = CompressionGzipStored
+	}
+	meta.Checksum = hex.EncodeToString(h.Sum(nil))
+	meta.ChecksumType = "sha1"
+	meta.Size = st.Size()
+	meta.ZstdDictID = 0
+	return writeArchiveMeta(dst, meta)
+}
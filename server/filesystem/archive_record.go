@@ -0,0 +1,108 @@
+package filesystem
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"emperror.dev/errors"
+
+	"github.com/pterodactyl/wings/config"
+)
+
+// recordsMu guards the backup records file against concurrent updates.
+var recordsMu sync.Mutex
+
+// BackupRecord contains the details of a successfully created backup. The path
+// is empty for a backup that was uploaded to a remote location, which is
+// identified by the uuid of the backup instead.
+type BackupRecord struct {
+	Path         string    `json:"path"`
+	Uuid         string    `json:"uuid,omitempty"`
+	Checksum     string    `json:"checksum"`
+	ChecksumType string    `json:"checksum_type"`
+	Size         int64     `json:"size"`
+	CompletedAt  time.Time `json:"completed_at"`
+}
+
+// LastBackup returns the record of the last backup that was successfully
+// created for the given server. If no backup has been recorded for the server
+// a nil record is returned.
+func LastBackup(server string) (*BackupRecord, error) {
+	recordsMu.Lock()
+	defer recordsMu.Unlock()
+
+	records, err := readBackupRecords()
+	if err != nil {
+		return nil, err
+	}
+	if rec, ok := records[server]; ok {
+		return &rec, nil
+	}
+	return nil, nil
+}
+
+// RecordBackup stores the record as the last successful backup for the server,
+// for a backup that was not recorded when it was created, see Archive.NoRecord.
+func RecordBackup(server string, rec BackupRecord) error {
+	return recordBackup(server, rec)
+}
+
+// recordBackup stores the record as the last successful backup for the server.
+func recordBackup(server string, rec BackupRecord) error {
+	recordsMu.Lock()
+	defer recordsMu.Unlock()
+
+	records, err := readBackupRecords()
+	if err != nil {
+		return err
+	}
+	records[server] = rec
+	return writeBackupRecords(records)
+}
+
+// readBackupRecords returns the backup records stored on the disk.
+func readBackupRecords() (map[string]BackupRecord, error) {
+	records := make(map[string]BackupRecord)
+	b, err := os.ReadFile(config.Get().System.GetBackupRecordsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return records, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, errors.WrapIf(err, "filesystem: failed to parse backup records")
+	}
+	return records, nil
+}
+
+// writeBackupRecords writes the backup records to the disk. The records are
+// written to a temporary file which is then renamed over the existing file, so
+// that a crash part way through never leaves a partially written file behind.
+func writeBackupRecords(records map[string]BackupRecord) error {
+	b, err := json.Marshal(records)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	p := config.Get().System.GetBackupRecordsPath()
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(f.Name(), p))
+}
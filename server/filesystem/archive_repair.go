@@ -0,0 +1,144 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+
+	"emperror.dev/errors"
+	"github.com/apex/log"
+	"github.com/klauspost/pgzip"
+)
+
+// ErrUnrepairableArchive is matched by the error returned from RepairTarTail when
+// not a single entry of the archive can be read, so there is nothing to salvage.
+var ErrUnrepairableArchive = errors.Sentinel("archive: archive cannot be repaired")
+
+// RepairTarTail salvages a tar based archive that was cut short, such as a backup
+// whose write was interrupted. Such an archive can often still be decompressed up
+// to the point it was cut off, but the tarball lacks its end of archive marker
+// and the last entry may be incomplete, causing strict readers to fail at the end
+// even though the data before it is intact.
+//
+// Every entry that can be read completely is written to a new gzipped tarball,
+// compressed at the configured level, which properly ends with an end of archive
+// marker and replaces the archive once it has been completely written. Anything
+// after the first entry that cannot be read is dropped. If the archive has a
+// metadata file it is updated to describe the repaired archive, and any index
+// is removed.
+//
+// An archive that is not damaged is rewritten the same way. If no entry of the
+// archive can be read ErrUnrepairableArchive is returned and the archive is left
+// untouched. Zip archives cannot be repaired.
+func RepairTarTail(p string) (err error) {
+	defer func() {
+		err = classifyArchiveError(err)
+	}()
+
+	format, _, err := DetectFormat(p)
+	if err != nil {
+		return err
+	}
+	if format == FormatZip {
+		return errors.New("archive: zip archives cannot be repaired")
+	}
+
+	// Count the entries that can be read completely before writing anything, so
+	// that the entry the archive was cut off in can be left out.
+	var complete int
+	walkErr := walkArchive(p, func(_ *tar.Header, r io.Reader) error {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return errors.WithStack(err)
+		}
+		complete++
+		return nil
+	})
+	if walkErr != nil && complete == 0 {
+		return errors.WithStack(&ArchiveError{Kind: ErrUnrepairableArchive, err: walkErr})
+	}
+
+	level := gzipCompressionLevel()
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha1.New()
+	out := io.MultiWriter(f, h)
+	gw := newGzipWriter(out, level)
+	defer gw.Close()
+	var size int64
+	tw := tar.NewWriter(&countingWriter{n: &size, w: gw})
+	var written int
+	err = walkArchive(p, func(header *tar.Header, r io.Reader) error {
+		if written == complete {
+			return io.EOF
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := io.Copy(tw, r); err != nil {
+			return errors.WithStack(err)
+		}
+		written++
+		return nil
+	})
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errors.WrapIff(err, "archive: failed to repair '%s'", p)
+	}
+	// Close the tar writer to write the end of archive marker as part of the same
+	// gzip member, repaired archives are not expected to be merged.
+	if err := tw.Close(); err != nil {
+		return errors.WrapIf(err, "archive: failed to close tar writer")
+	}
+	if err := gw.Close(); err != nil {
+		return errors.WrapIf(err, "archive: failed to close gzip writer")
+	}
+	if err := f.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	meta, err := ReadArchiveMeta(p)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		return errors.WithStack(err)
+	}
+	if walkErr != nil {
+		log.WithField("path", p).WithField("entries", written).WithField("error", walkErr).Warn("repaired truncated archive; dropped the entries that could not be read")
+	}
+	for _, sidecar := range []string{IndexPath(p), DictionaryPath(p)} {
+		if err := os.Remove(sidecar); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+	if meta == nil {
+		return nil
+	}
+	meta.Format = FormatTarGzip
+	meta.CompressionLevel = compressionLevelName()
+	meta.CompressionMode = CompressionGzip
+	if level == pgzip.NoCompression {
+		meta.CompressionMode = CompressionGzipStored
+	}
+	meta.Checksum = hex.EncodeToString(h.Sum(nil))
+	meta.ChecksumType = "sha1"
+	meta.Files = written
+	meta.Size = st.Size()
+	meta.UncompressedSize = size
+	meta.ZstdDictID = 0
+	return writeArchiveMeta(p, meta)
+}
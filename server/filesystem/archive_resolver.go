@@ -0,0 +1,119 @@
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"emperror.dev/errors"
+	"github.com/klauspost/pgzip"
+)
+
+// resolverSampleFiles is the maximum number of files sampled from the tree before
+// calling the CompressionResolver of an archive.
+const resolverSampleFiles = 1000
+
+// errSampleComplete is returned from the walk callback to stop sampling the tree
+// once enough files have been seen.
+var errSampleComplete = errors.Sentinel("archive: sample complete")
+
+// SampleStats describes a sample of the files that will be written to an archive,
+// it is passed to the CompressionResolver of the archive to pick a compression
+// level.
+type SampleStats struct {
+	// Files is the number of regular files that were sampled.
+	Files int
+	// Size is the total size of the sampled files in bytes.
+	Size int64
+	// Compressed is the total size of the sampled files in bytes that have an
+	// extension of a format that is already compressed, and will not get any
+	// smaller by compressing it again.
+	Compressed int64
+	// Extensions is the total size of the sampled files in bytes for each of the
+	// lowercase file extensions encountered, files without an extension are
+	// counted under an empty string.
+	Extensions map[string]int64
+}
+
+// CompressionResolver returns the gzip compression level to use for an archive
+// based on a sample of the files in it, between pgzip.NoCompression and
+// pgzip.BestCompression.
+type CompressionResolver func(stats SampleStats) int
+
+// compressedExtensions are the extensions of file formats that are already
+// compressed. Minecraft region files are compressed per chunk and are the
+// majority of the data in most world saves.
+var compressedExtensions = map[string]bool{
+	".7z": true, ".bz2": true, ".gz": true, ".jar": true, ".jpeg": true, ".jpg": true,
+	".mca": true, ".mcr": true, ".mp3": true, ".mp4": true, ".ogg": true, ".png": true,
+	".rar": true, ".tgz": true, ".webm": true, ".webp": true, ".xz": true, ".zip": true,
+	".zst": true,
+}
+
+// DefaultCompressionResolver picks a compression level by the share of the sample
+// that is already compressed. Trees made up mostly of compressed files, such as
+// game worlds, are written at the fastest level since compressing them harder
+// costs a lot of time for almost no reduction in size. Trees made up mostly of
+// text, such as the files of a web application, use the default level of gzip,
+// which compresses them noticeably better for a modest amount of time.
+func DefaultCompressionResolver(stats SampleStats) int {
+	if stats.Size == 0 {
+		return pgzip.BestSpeed
+	}
+	if r := float64(stats.Compressed) / float64(stats.Size); r >= 0.5 {
+		return pgzip.BestSpeed
+	}
+	return pgzip.DefaultCompression
+}
+
+// sample collects the SampleStats of up to resolverSampleFiles of the regular
+// files that will be written to the archive.
+func (a *Archive) sample(filters ...func(path string, relative string) error) (SampleStats, error) {
+	stats := SampleStats{Extensions: make(map[string]int64)}
+	err := a.walk(func(p string, _ string) error {
+		st, err := os.Lstat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return errors.WithStack(err)
+		}
+		if !st.Mode().IsRegular() {
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(p))
+		stats.Files++
+		stats.Size += st.Size()
+		stats.Extensions[ext] += st.Size()
+		if compressedExtensions[ext] {
+			stats.Compressed += st.Size()
+		}
+		if stats.Files >= resolverSampleFiles {
+			return errSampleComplete
+		}
+		return nil
+	}, filters...)
+	if err != nil && !errors.Is(err, errSampleComplete) {
+		return SampleStats{}, err
+	}
+	return stats, nil
+}
+
+// compressionLevel returns the gzip compression level to write the archive with.
+// This is the level returned by the CompressionResolver if one is set, otherwise
+// the level configured for backups is used.
+func (a *Archive) compressionLevel(filters ...func(path string, relative string) error) (int, error) {
+	if a.CompressionResolver == nil {
+		return gzipCompressionLevel(), nil
+	}
+	stats, err := a.sample(filters...)
+	if err != nil {
+		return 0, err
+	}
+	level := a.CompressionResolver(stats)
+	if level != pgzip.DefaultCompression && (level < pgzip.NoCompression || level > pgzip.BestCompression) {
+		level = clampCompressionLevel(level)
+	}
+	a.log().WithField("files", stats.Files).WithField("level", level).Debug("resolved compression level for archive")
+	return level, nil
+}
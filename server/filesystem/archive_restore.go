@@ -0,0 +1,76 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"sort"
+
+	"emperror.dev/errors"
+)
+
+// RestoreManifestName is the name of the restore manifest written into archives
+// created with WriteRestoreManifest enabled.
+const RestoreManifestName = ".wings-restore.json"
+
+// RestoreManifest lists the original metadata of every entry in an archive, so
+// that a restore can faithfully reconstruct the files even on platforms where
+// the tar metadata is lossy. Given the same files the manifest is always
+// identical.
+type RestoreManifest struct {
+	Entries []RestoreEntry `json:"entries"`
+}
+
+// RestoreEntry is the metadata of a single entry in a RestoreManifest.
+type RestoreEntry struct {
+	Path string `json:"path"`
+	// Type is one of "file", "directory", "symlink" or "hardlink".
+	Type string `json:"type"`
+	// Mode contains the permission bits of the entry, including the setuid,
+	// setgid and sticky bits.
+	Mode   int64  `json:"mode"`
+	Uid    int    `json:"uid"`
+	Gid    int    `json:"gid"`
+	Target string `json:"target,omitempty"`
+}
+
+// recordRestoreEntry adds the entry written with the given header to the
+// restore manifest being generated.
+func (a *Archive) recordRestoreEntry(header *tar.Header) {
+	e := RestoreEntry{
+		Path: header.Name,
+		Mode: header.Mode & 0o7777,
+		Uid:  header.Uid,
+		Gid:  header.Gid,
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		e.Type = "directory"
+	case tar.TypeSymlink:
+		e.Type = "symlink"
+		e.Target = header.Linkname
+	case tar.TypeLink:
+		e.Type = "hardlink"
+		e.Target = header.Linkname
+	default:
+		e.Type = "file"
+	}
+	a.mu.Lock()
+	a.restore = append(a.restore, e)
+	a.mu.Unlock()
+}
+
+// writeRestoreManifest writes the generated restore manifest into the archive.
+func (a *Archive) writeRestoreManifest(w *tar.Writer) error {
+	a.mu.Lock()
+	m := RestoreManifest{Entries: append([]RestoreEntry{}, a.restore...)}
+	a.mu.Unlock()
+
+	sort.Slice(m.Entries, func(i, j int) bool {
+		return m.Entries[i].Path < m.Entries[j].Path
+	})
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return a.writeVirtualFile(w, virtualFile{name: RestoreManifestName, content: b, mode: 0o644})
+}
@@ -0,0 +1,85 @@
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"emperror.dev/errors"
+	. "github.com/franela/goblin"
+)
+
+func TestOpenWithRetry(t *testing.T) {
+	g := Goblin(t)
+	fs, rfs := NewFs()
+
+	g.Describe("openWithRetry", func() {
+		var calls int
+
+		// failOpen replaces openFile with one that fails the first "failures" times
+		// a file is opened with the given error.
+		failOpen := func(failures int, err error) {
+			calls = 0
+			openFile = func(p string) (*os.File, error) {
+				calls++
+				if calls <= failures {
+					return nil, &os.PathError{Op: "open", Path: p, Err: err}
+				}
+				return os.Open(p)
+			}
+		}
+
+		g.BeforeEach(func() {
+			openRetryBackoff = time.Millisecond
+		})
+
+		g.AfterEach(func() {
+			openFile = os.Open
+			openRetryBackoff = 100 * time.Millisecond
+			rfs.reset()
+		})
+
+		g.It("retries a transient error within the configured attempts", func() {
+			g.Assert(rfs.CreateServerFileFromString("retry.txt", "hello")).IsNil()
+
+			failOpen(2, syscall.ESTALE)
+			f, err := openWithRetry(filepath.Join(fs.Path(), "retry.txt"), 3)
+			g.Assert(err).IsNil()
+			f.Close()
+			g.Assert(calls).Equal(3)
+
+			failOpen(5, syscall.EAGAIN)
+			_, err = openWithRetry(filepath.Join(fs.Path(), "retry.txt"), 3)
+			g.Assert(errors.Is(err, syscall.EAGAIN)).IsTrue()
+			g.Assert(calls).Equal(4)
+		})
+
+		g.It("does not retry a missing file and skips it when archiving", func() {
+			g.Assert(rfs.CreateServerFileFromString("missing.txt", "hello")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("present.txt", "hello")).IsNil()
+
+			calls = 0
+			openFile = func(p string) (*os.File, error) {
+				if filepath.Base(p) == "missing.txt" {
+					calls++
+					return nil, &os.PathError{Op: "open", Path: p, Err: syscall.ENOENT}
+				}
+				return os.Open(p)
+			}
+			_, err := openWithRetry(filepath.Join(fs.Path(), "missing.txt"), 3)
+			g.Assert(os.IsNotExist(err)).IsTrue()
+			g.Assert(calls).Equal(1)
+
+			dst := filepath.Join(rfs.root, "missing.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path()}).Create(dst)).IsNil()
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			_, ok := headers["missing.txt"]
+			g.Assert(ok).IsFalse()
+			_, ok = headers["present.txt"]
+			g.Assert(ok).IsTrue()
+		})
+	})
+}
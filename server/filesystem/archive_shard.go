@@ -0,0 +1,32 @@
+package filesystem
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// shardDepth is the number of directories a sharded path is nested in.
+	shardDepth = 2
+	// shardWidth is the number of characters of the identifier used to name each
+	// of the directories of a sharded path.
+	shardWidth = 2
+)
+
+// ShardedPath returns the path of the file named after the given identifier and
+// extension within dir, nested in directories named after the first characters
+// of the identifier. For the identifier "abcd1234-..." the path is
+// "dir/ab/cd/abcd1234-....ext". Identifiers too short to be sharded are stored
+// directly in dir.
+func ShardedPath(dir string, id string, ext string) string {
+	id = filepath.Base(id)
+	key := strings.ToLower(strings.ReplaceAll(id, "-", ""))
+	if len(key) < shardDepth*shardWidth {
+		return filepath.Join(dir, id+ext)
+	}
+	parts := []string{dir}
+	for i := 0; i < shardDepth; i++ {
+		parts = append(parts, key[i*shardWidth:(i+1)*shardWidth])
+	}
+	return filepath.Join(append(parts, id+ext)...)
+}
@@ -0,0 +1,36 @@
+package filesystem
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// watchSlowFile calls the OnSlowFile hook of the archive every SlowFileThreshold
+// until the returned function is called, passing the name of the file and the
+// number of bytes of it written so far. This runs on a timer so that the hook
+// still fires if reading the file blocks entirely.
+func (a *Archive) watchSlowFile(name string, written *int64) func() {
+	var mu sync.Mutex
+	var stopped bool
+	var t *time.Timer
+
+	mu.Lock()
+	t = time.AfterFunc(a.SlowFileThreshold, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return
+		}
+		a.OnSlowFile(name, atomic.LoadInt64(written))
+		t.Reset(a.SlowFileThreshold)
+	})
+	mu.Unlock()
+
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		t.Stop()
+	}
+}
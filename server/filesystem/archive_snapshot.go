@@ -0,0 +1,175 @@
+package filesystem
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"emperror.dev/errors"
+)
+
+// errReflinkUnsupported is returned when reflinks are not supported on the
+// current platform.
+var errReflinkUnsupported = errors.Sentinel("filesystem: reflinks are not supported on this platform")
+
+// SnapshotMode controls if, and how, files are copied to a temporary location
+// before being written to an archive.
+type SnapshotMode int
+
+const (
+	// SnapshotNone reads every file in place. If a file is modified while it is
+	// being read the entry in the archive may be inconsistent.
+	SnapshotNone SnapshotMode = iota
+	// SnapshotCloneOrCopy clones each file using a reflink before it is archived,
+	// falling back to a full copy of the file if reflinks are not supported.
+	SnapshotCloneOrCopy
+	// SnapshotCloneOnly clones each file using a reflink before it is archived,
+	// falling back to reading the file in place if reflinks are not supported.
+	SnapshotCloneOnly
+)
+
+// snapshot creates a consistent copy of the open file in the SnapshotDir of the
+// archive and returns it, the copy is removed from the disk immediately so it
+// only exists until the returned file is closed. If the file could not be
+// cloned and the archive is not configured to fall back to a copy, nil is
+// returned.
+func (a *Archive) snapshot(f *os.File) (*os.File, error) {
+	dir := a.SnapshotDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	tmp, err := os.CreateTemp(dir, ".wings-snapshot-*")
+	if err != nil {
+		return nil, errors.WrapIf(err, "archive: failed to create snapshot file")
+	}
+	// The file descriptor keeps the contents available until it is closed.
+	_ = os.Remove(tmp.Name())
+
+	if err := reflink(tmp, f); err != nil {
+		if a.Snapshot != SnapshotCloneOrCopy {
+			_ = tmp.Close()
+			return nil, nil
+		}
+		buf := pool.Get().([]byte)
+		defer pool.Put(buf)
+		if _, err := io.CopyBuffer(tmp, f, buf); err != nil {
+			_ = tmp.Close()
+			return nil, errors.WrapIf(err, "archive: failed to copy file to snapshot")
+		}
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		_ = tmp.Close()
+		return nil, errors.WithStack(err)
+	}
+	return tmp, nil
+}
+
+// isReflinkUnsupported reports whether the error returned by reflink indicates
+// that the files cannot be cloned, rather than the clone itself failing.
+func isReflinkUnsupported(err error) bool {
+	for _, e := range []error{errReflinkUnsupported, syscall.EOPNOTSUPP, syscall.EXDEV, syscall.EINVAL, syscall.ENOTTY, syscall.ENOSYS} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// SnapshotMethod describes the mechanism used to create a snapshot.
+type SnapshotMethod string
+
+const (
+	// SnapshotMethodReflink is used for snapshots which are a directory containing
+	// a copy-on-write clone of every file.
+	SnapshotMethodReflink SnapshotMethod = "reflink"
+	// SnapshotMethodArchive is used for snapshots which are a regular archive.
+	SnapshotMethodArchive SnapshotMethod = "archive"
+)
+
+// CreateSnapshot creates a snapshot of the files matched by the archive at the
+// given destination. If the filesystem supports reflinks the destination will be
+// a directory containing a copy-on-write clone of every file, which is nearly
+// instant and takes up no additional space until the files are changed. If
+// reflinks are not supported this falls back to creating a regular archive at
+// the destination. The mechanism that was used to create the snapshot is
+// returned.
+func (a *Archive) CreateSnapshot(dst string) (SnapshotMethod, error) {
+	abs, err := filepath.Abs(dst)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	base := strings.TrimSuffix(filepath.Clean(a.BasePath), "/")
+	if abs == base || strings.HasPrefix(abs, base+"/") {
+		return "", errors.New("archive: snapshot destination cannot be inside of the directory being archived")
+	}
+
+	if err := os.Mkdir(dst, 0o700); err != nil {
+		return "", errors.WithStack(err)
+	}
+	err = a.walk(func(p string, rp string) error {
+		return cloneEntry(p, filepath.Join(dst, rp))
+	})
+	if err == nil {
+		return SnapshotMethodReflink, nil
+	}
+	if rerr := os.RemoveAll(dst); rerr != nil {
+		return "", errors.WithStack(rerr)
+	}
+	if !isReflinkUnsupported(err) {
+		return "", err
+	}
+
+	a.log().WithField("path", dst).WithField("error", err).Debug("reflinks are not supported; falling back to creating an archive for snapshot")
+	if err := a.Create(dst); err != nil {
+		return "", err
+	}
+	return SnapshotMethodArchive, nil
+}
+
+// cloneEntry clones the file at src to dst using a reflink, creating any of the
+// parent directories that are missing. Symlinks are recreated pointing to the
+// same target, and any other type of file is skipped.
+func cloneEntry(src string, dst string) error {
+	st, err := os.Lstat(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	if !st.Mode().IsRegular() && st.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if st.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(os.Symlink(target, dst))
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, st.Mode().Perm())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := reflink(out, f); err != nil {
+		_ = out.Close()
+		return errors.WithStack(err)
+	}
+	if err := out.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Chtimes(dst, st.ModTime(), st.ModTime()))
+}
@@ -0,0 +1,135 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"emperror.dev/errors"
+)
+
+// SourceRecord is the PAX record that stores the id of the source an entry was
+// archived from, such as the server a directory belongs to, when a SourceID is
+// set for the BasePath or one of the ExtraPaths of an archive. See SplitBySource.
+const SourceRecord = "WINGS.source"
+
+// UntaggedSource is the directory that SplitBySource writes the entries without
+// a SourceRecord to.
+const UntaggedSource = "untagged"
+
+// validateSourceID checks that a source id can be used as the name of the
+// directory its entries are split into. Ids may only contain letters, numbers,
+// "-", "_" and ".".
+func validateSourceID(id string) error {
+	if id == "." || id == ".." || id == UntaggedSource {
+		return errors.Errorf("archive: invalid source id '%s'", id)
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.", r)) {
+			return errors.Errorf("archive: source id '%s' contains invalid characters", id)
+		}
+	}
+	return nil
+}
+
+// validateSources checks the source ids of the BasePath and ExtraPaths of the
+// archive.
+func (a *Archive) validateSources() error {
+	ids := []string{a.SourceID}
+	for _, e := range a.ExtraPaths {
+		ids = append(ids, e.SourceID)
+	}
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if err := validateSourceID(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourceOf returns the id of the source that the file at p is archived from, or
+// an empty string if the source is not tagged.
+func (a *Archive) sourceOf(p string) string {
+	for _, e := range a.ExtraPaths {
+		if isWithin(filepath.Clean(e.Source), p) {
+			return e.SourceID
+		}
+	}
+	return a.SourceID
+}
+
+// SplitBySource expands an archive that combines files from several sources into
+// a directory for each of them within dstDir, named after the source id stored
+// in the SourceRecord of each entry. Entries keep their path within the archive,
+// and entries without a source are written to the UntaggedSource directory. Only
+// regular files and the hardlinks between them are written, along with the
+// directories containing them, and the same protections against entries escaping
+// their directory as ExtractToDir apply.
+func SplitBySource(src string, dstDir string) (err error) {
+	defer func() {
+		err = classifyArchiveError(err)
+	}()
+
+	roots := make(map[string]string)
+	// The path each file was written to, by its name within the archive, since a
+	// hardlink may point at a file that was split into a different directory.
+	written := make(map[string]string)
+	return walkArchive(src, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeGNUSparse && header.Typeflag != tar.TypeLink {
+			return nil
+		}
+		source := header.PAXRecords[SourceRecord]
+		if source == "" {
+			source = UntaggedSource
+		} else if err := validateSourceID(source); err != nil {
+			return err
+		}
+		root, ok := roots[source]
+		if !ok {
+			dir := filepath.Join(dstDir, source)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return errors.WithStack(err)
+			}
+			if root, err = filepath.EvalSymlinks(dir); err != nil {
+				return errors.WithStack(err)
+			}
+			if root, err = filepath.Abs(root); err != nil {
+				return errors.WithStack(err)
+			}
+			roots[source] = root
+		}
+
+		p, err := safeJoin(root, header.Name)
+		if err != nil {
+			return err
+		}
+		if err := confineWithin(root, header.Name, p); err != nil {
+			return err
+		}
+		// Replace a symlink rather than writing to wherever it points.
+		if st, err := os.Lstat(p); err == nil && st.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(p); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if header.Typeflag == tar.TypeLink {
+			target, ok := written[entryName(header.Linkname)]
+			if !ok {
+				return errors.Errorf("archive: hardlink '%s' points at a file that was not extracted", header.Name)
+			}
+			err = linkFile(target, p)
+		} else {
+			err = extractFile(p, header, r, nil, OwnershipNone)
+		}
+		if err != nil {
+			return errors.WrapIff(err, "archive: failed to extract '%s'", header.Name)
+		}
+		written[entryName(header.Name)] = p
+		return nil
+	})
+}
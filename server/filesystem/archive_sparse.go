@@ -0,0 +1,81 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"strings"
+
+	"emperror.dev/errors"
+)
+
+// sparseBlockSize is the size of the blocks checked for holes when writing a
+// sparse file, matching the block size of most filesystems.
+const sparseBlockSize = 4096
+
+// SparseRecords reports whether the PAX records of an entry describe a file stored
+// in one of the GNU sparse formats, in which case the file should be restored with
+// WriteRestoredSparseFile so that its holes are recreated.
+func SparseRecords(records map[string]string) bool {
+	for k := range records {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// isSparseHeader reports whether the entry is a sparse file, either in the old GNU
+// format or one of the GNU sparse formats using PAX records. The tar reader fills
+// the holes of these entries with zeros when they are read.
+func isSparseHeader(header *tar.Header) bool {
+	return header.Typeflag == tar.TypeGNUSparse || SparseRecords(header.PAXRecords)
+}
+
+// sparseWriter writes to a file while seeking over every block that contains only
+// zeros, rather than writing them, so that the filesystem leaves a hole in their
+// place. finish must be called once everything has been written to set the final
+// size of the file, since a trailing hole does not extend the file on its own.
+type sparseWriter struct {
+	f   *os.File
+	off int64
+}
+
+func newSparseWriter(f *os.File) *sparseWriter {
+	return &sparseWriter{f: f}
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		b := p[n:]
+		if len(b) > sparseBlockSize {
+			b = b[:sparseBlockSize]
+		}
+		if isZeros(b) {
+			if _, err := w.f.Seek(int64(len(b)), io.SeekCurrent); err != nil {
+				return n, err
+			}
+		} else if _, err := w.f.Write(b); err != nil {
+			return n, err
+		}
+		n += len(b)
+		w.off += int64(len(b))
+	}
+	return n, nil
+}
+
+// finish truncates the file to the number of bytes written to it.
+func (w *sparseWriter) finish() error {
+	return errors.WithStack(w.f.Truncate(w.off))
+}
+
+// isZeros returns true if every byte of b is zero.
+func isZeros(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
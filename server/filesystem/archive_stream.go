@@ -0,0 +1,41 @@
+package filesystem
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"emperror.dev/errors"
+)
+
+// StreamFiles writes an uncompressed tarball of the files within root matching
+// the given patterns to w, such as the logs and configuration of a running server
+// when diagnosing an issue with it. Patterns are relative to root and may contain
+// the wildcards supported by filepath.Match, a pattern matching a directory
+// includes everything within it. Entries are named relative to root.
+//
+// If a progress is provided it tracks the bytes written to w. An error matching
+// os.ErrNotExist is returned if none of the patterns match any file, rather than
+// streaming the entire tree.
+func StreamFiles(root string, patterns []string, w io.Writer, progress *Progress) error {
+	root = filepath.Clean(root)
+	var files []string
+	for _, pattern := range patterns {
+		p, err := safeJoin(root, pattern)
+		if err != nil {
+			return err
+		}
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return errors.WrapIf(err, "archive: invalid file pattern")
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return errors.Wrap(os.ErrNotExist, "archive: no files matched the given patterns")
+	}
+
+	a := &Archive{BasePath: root, Files: files, Progress: progress}
+	return a.write(context.Background(), w, false)
+}
@@ -0,0 +1,100 @@
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/karrick/godirwalk"
+)
+
+// SymlinkPolicy controls how an Archive handles symlinks.
+type SymlinkPolicy int
+
+const (
+	// SymlinkStore writes every symlink to the archive as a link, without reading
+	// its target. This is the default.
+	SymlinkStore SymlinkPolicy = iota
+	// SymlinkSkip leaves symlinks out of the archive entirely and records them as
+	// skipped, which is useful when the archive is restored on platforms that do
+	// not handle symlinks well.
+	SymlinkSkip
+	// SymlinkFollow writes the target of every symlink to the archive in place of
+	// the link, a symlink to a file is archived as a copy of the file and a symlink
+	// to a directory has the contents of the directory archived under the path of
+	// the link.
+	//
+	// Only targets within the root being archived are followed. The target of a
+	// symlink is fully resolved, including any symlinks along the way, and the link
+	// is skipped with SkipReasonSymlinkEscape if the resolved path is outside of
+	// the BasePath, or the extra path the link is in, or cannot be resolved at all.
+	// Symlinks pointing to a directory that is already being walked, such as one of
+	// their own parents, are skipped with SkipReasonCircularSymlink so that every
+	// walk terminates. The target is checked immediately before it is read, this
+	// does not protect against a target that is replaced while the archive is
+	// being created, which requires write access to the files being archived.
+	SymlinkFollow
+)
+
+// resolveSymlink returns the fully resolved target of the symlink at p, or false
+// if the target cannot be resolved or is outside of the root being walked, in
+// which case the symlink is recorded as skipped.
+func (a *Archive) resolveSymlink(p string, rp string) (string, bool) {
+	root, err := filepath.EvalSymlinks(a.root())
+	if err == nil {
+		var target string
+		if target, err = filepath.EvalSymlinks(p); err == nil {
+			if isWithin(root, target) {
+				return target, true
+			}
+			a.log().WithField("path", rp).WithField("target", target).Warn("symlink points outside of the directory being archived; skipping...")
+			a.skip(rp, SkipReasonSymlinkEscape)
+			return "", false
+		}
+	}
+	if !os.IsNotExist(err) {
+		a.log().WithField("path", rp).WithField("error", err.Error()).Warn("failed to resolve symlink target; skipping...")
+	}
+	a.skip(rp, SkipReasonSymlinkEscape)
+	return "", false
+}
+
+// followDir walks the directory that the symlink at p points to, calling cb for
+// everything within it as though it was at the path of the link.
+func (a *Archive) followDir(p string, rp string, cb func(path string, de *godirwalk.Dirent) error) error {
+	target, ok := a.resolveSymlink(p, rp)
+	if !ok {
+		return nil
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(p))
+	circular := err != nil || isWithin(target, parent)
+	for _, dir := range a.following {
+		circular = circular || isWithin(target, dir)
+	}
+	if circular {
+		a.log().WithField("path", rp).Warn("symlink points to a directory that is already being archived; skipping...")
+		a.skip(rp, SkipReasonCircularSymlink)
+		return nil
+	}
+
+	a.following = append(a.following, target)
+	defer func() {
+		a.following = a.following[:len(a.following)-1]
+	}()
+	return godirwalk.Walk(target, &godirwalk.Options{
+		FollowSymbolicLinks: false,
+		Unsorted:            true,
+		ErrorCallback:       a.walkError,
+		Callback: func(path string, de *godirwalk.Dirent) error {
+			if path == target {
+				return nil
+			}
+			return cb(p+strings.TrimPrefix(path, target), de)
+		},
+	})
+}
+
+// isWithin returns true if p is the directory dir or is contained within it.
+func isWithin(dir string, p string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
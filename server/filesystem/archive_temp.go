@@ -0,0 +1,69 @@
+package filesystem
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"emperror.dev/errors"
+)
+
+// createDestination opens the file that Create writes the archive to. This is dst
+// itself, unless a TempDir is set in which case a temporary file within it is
+// created, which is moved to dst by finishDestination.
+func (a *Archive) createDestination(dst string) (*os.File, error) {
+	if a.TempDir == "" {
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		return f, errors.WithStack(err)
+	}
+	st, err := os.Stat(a.TempDir)
+	if err != nil {
+		return nil, errors.WrapIf(err, "archive: failed to stat temporary directory")
+	}
+	if !st.IsDir() {
+		return nil, errors.Errorf("archive: temporary directory '%s' is not a directory", a.TempDir)
+	}
+	// Creating the file is the only reliable way to know that the directory is on a
+	// writable filesystem, and that there is permission to write to it.
+	f, err := os.CreateTemp(a.TempDir, filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return nil, errors.WrapIff(err, "archive: temporary directory '%s' is not writable", a.TempDir)
+	}
+	return f, nil
+}
+
+// finishDestination moves the completely written archive from its temporary file
+// to dst, if it was not written to dst directly. The file is copied if TempDir is
+// on a different filesystem than dst.
+func (a *Archive) finishDestination(f *os.File, dst string) error {
+	if f.Name() == dst {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	err := os.Rename(f.Name(), dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return errors.WithStack(err)
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer out.Close()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := io.Copy(out, f); err != nil {
+		return errors.WrapIf(err, "archive: failed to copy archive from temporary directory")
+	}
+	if err := out.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := out.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Remove(f.Name()))
+}
@@ -0,0 +1,2398 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/apex/log"
+	logmemory "github.com/apex/log/handlers/memory"
+	. "github.com/franela/goblin"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/ulikunitz/xz"
+
+	"github.com/pterodactyl/wings/config"
+)
+
+// readArchiveHeaders opens the gzipped tarball at the given path and returns
+// every header contained within it keyed by the entry name.
+func readArchiveHeaders(p string) (map[string]*tar.Header, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gr, err := pgzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+
+	headers := make(map[string]*tar.Header)
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		headers[h.Name] = h
+	}
+	return headers, nil
+}
+
+// writerFunc is an io.Writer backed by a function.
+type writerFunc func(b []byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+// recordingEmitter is an EventEmitter that records every event published to it.
+type recordingEmitter struct {
+	mu     sync.Mutex
+	topics []string
+	events []interface{}
+}
+
+func (e *recordingEmitter) Publish(topic string, data interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.topics = append(e.topics, topic)
+	e.events = append(e.events, data)
+}
+
+func TestArchive_Create(t *testing.T) {
+	g := Goblin(t)
+	fs, rfs := NewFs()
+
+	g.Describe("Archive", func() {
+		g.BeforeEach(func() {
+			rfs.reset()
+		})
+
+		g.It("records the absolute path of each entry when requested", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path(), RecordAbsolutePath: true}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["test.txt"]).IsNotNil()
+			g.Assert(headers["test.txt"].PAXRecords[AbsolutePathRecord]).Equal(filepath.Join(fs.Path(), "test.txt"))
+		})
+
+		g.It("does not record the absolute path by default", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path()}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			_, ok := headers["test.txt"].PAXRecords[AbsolutePathRecord]
+			g.Assert(ok).IsFalse()
+		})
+
+		g.It("writes a metadata file describing the archive", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+			err = rfs.CreateServerFileFromString("other.txt", "world")
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path(), WriteMeta: true}
+			g.Assert(a.Create(dst)).IsNil()
+
+			meta, err := ReadArchiveMeta(dst)
+			g.Assert(err).IsNil()
+
+			b, err := os.ReadFile(dst)
+			g.Assert(err).IsNil()
+			sum := sha1.Sum(b)
+
+			g.Assert(meta.Format).Equal(FormatTarGzip)
+			g.Assert(meta.CompressionLevel).Equal("best_speed")
+			g.Assert(meta.Checksum).Equal(hex.EncodeToString(sum[:]))
+			g.Assert(meta.ChecksumType).Equal("sha1")
+			g.Assert(meta.Files).Equal(2)
+			g.Assert(meta.Size).Equal(int64(len(b)))
+		})
+
+		g.It("generates a digest tree respecting ignored files", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+			err = rfs.CreateServerFileFromString("ignored.log", "world")
+			g.Assert(err).IsNil()
+
+			a := &Archive{BasePath: fs.Path(), Ignore: "*.log"}
+			digests, err := a.DigestTree()
+			g.Assert(err).IsNil()
+
+			sum := sha256.Sum256([]byte("hello"))
+			g.Assert(digests).Equal(map[string]string{"test.txt": hex.EncodeToString(sum[:])})
+
+			digests, err = DigestTree(fs.Path())
+			g.Assert(err).IsNil()
+			g.Assert(len(digests)).Equal(2)
+			g.Assert(digests["test.txt"]).Equal(hex.EncodeToString(sum[:]))
+		})
+
+		g.It("sanitizes file names that are not valid UTF-8", func() {
+			err := rfs.CreateServerFileFromString("bad\xff.txt", "hello")
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path(), InvalidNames: InvalidNameSanitize}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["bad_.txt"]).IsNotNil()
+			g.Assert(headers["bad_.txt"].PAXRecords[RawNameRecord]).Equal(base64.StdEncoding.EncodeToString([]byte("bad\xff.txt")))
+		})
+
+		g.It("skips file names that are not valid UTF-8", func() {
+			err := rfs.CreateServerFileFromString("bad\xff.txt", "hello")
+			g.Assert(err).IsNil()
+			err = rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path(), InvalidNames: InvalidNameSkip}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(1)
+			g.Assert(headers["test.txt"]).IsNotNil()
+			g.Assert(a.Stats().Skipped).Equal([]SkippedEntry{{Path: "bad\xff.txt", Reason: SkipReasonInvalidName}})
+		})
+
+		g.It("converts an archive to a zip and back", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+			g.Assert(os.Chmod(filepath.Join(fs.Path(), "test.txt"), 0o640)).IsNil()
+
+			src := filepath.Join(rfs.root, "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path()}
+			g.Assert(a.Create(src)).IsNil()
+
+			zp := filepath.Join(rfs.root, "archive.zip")
+			g.Assert(ConvertArchive(src, zp, FormatZip)).IsNil()
+
+			zr, err := zip.OpenReader(zp)
+			g.Assert(err).IsNil()
+			defer zr.Close()
+			g.Assert(len(zr.File)).Equal(1)
+			g.Assert(zr.File[0].Name).Equal("test.txt")
+			g.Assert(zr.File[0].Mode().Perm()).Equal(os.FileMode(0o640))
+
+			dst := filepath.Join(rfs.root, "converted.tar.gz")
+			g.Assert(ConvertArchive(zp, dst, FormatTarGzip)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["test.txt"]).IsNotNil()
+			g.Assert(headers["test.txt"].Size).Equal(int64(5))
+			g.Assert(headers["test.txt"].FileInfo().Mode().Perm()).Equal(os.FileMode(0o640))
+		})
+
+		g.It("does not write anything when a conversion fails", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+			dir := filepath.Join(rfs.root, "convert")
+			g.Assert(os.MkdirAll(dir, 0o755)).IsNil()
+
+			src := filepath.Join(dir, "archive.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path()}).Create(src)).IsNil()
+			before, err := os.ReadFile(src)
+			g.Assert(err).IsNil()
+
+			g.Assert(ConvertArchive(src, filepath.Join(dir, "archive.rar"), Format("rar")) != nil).IsTrue()
+			g.Assert(ConvertArchive(src, src, FormatTar) != nil).IsTrue()
+			g.Assert(ConvertArchive(src, filepath.Join(dir, ".", "archive.tar.gz"), FormatTar) != nil).IsTrue()
+			after, err := os.ReadFile(src)
+			g.Assert(err).IsNil()
+			g.Assert(bytes.Equal(before, after)).IsTrue()
+
+			// A corrupt source leaves an existing destination untouched.
+			corrupt := filepath.Join(dir, "corrupt.tar.gz")
+			g.Assert(os.WriteFile(corrupt, before[:len(before)/2], 0o644)).IsNil()
+			dst := filepath.Join(dir, "existing.tar")
+			g.Assert(os.WriteFile(dst, []byte("existing"), 0o644)).IsNil()
+			g.Assert(ConvertArchive(corrupt, dst, FormatTar) != nil).IsTrue()
+			b, err := os.ReadFile(dst)
+			g.Assert(err).IsNil()
+			g.Assert(string(b)).Equal("existing")
+
+			entries, err := os.ReadDir(dir)
+			g.Assert(err).IsNil()
+			g.Assert(len(entries)).Equal(3)
+		})
+
+		g.It("does not include the archive being written in itself", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(fs.Path(), "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path()}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(1)
+			g.Assert(headers["test.txt"]).IsNotNil()
+		})
+
+		g.It("streams an archive as an HTTP response", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+
+			a := &Archive{BasePath: fs.Path()}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = a.StreamHTTP(w, r, "backup.tar.gz")
+			}))
+			defer srv.Close()
+
+			res, err := http.Get(srv.URL)
+			g.Assert(err).IsNil()
+			defer res.Body.Close()
+			b, err := io.ReadAll(res.Body)
+			g.Assert(err).IsNil()
+
+			sum := sha256.Sum256(b)
+			g.Assert(res.Header.Get("Content-Disposition")).Equal(`attachment; filename=backup.tar.gz`)
+			g.Assert(res.Trailer.Get("X-Checksum")).Equal(hex.EncodeToString(sum[:]))
+
+			gr, err := pgzip.NewReader(bytes.NewReader(b))
+			g.Assert(err).IsNil()
+			h, err := tar.NewReader(gr).Next()
+			g.Assert(err).IsNil()
+			g.Assert(h.Name).Equal("test.txt")
+
+			// Names that are not plain ASCII are encoded as described by RFC 6266.
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = a.StreamHTTP(w, r, "sauvegarde été \"1\".tar.gz")
+			}))
+			defer srv.Close()
+			res, err = http.Get(srv.URL)
+			g.Assert(err).IsNil()
+			defer res.Body.Close()
+			g.Assert(strings.HasPrefix(res.Header.Get("Content-Disposition"), "attachment; filename*=utf-8''")).IsTrue()
+			_, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition"))
+			g.Assert(err).IsNil()
+			g.Assert(params["filename"]).Equal("sauvegarde été \"1\".tar.gz")
+		})
+
+		g.It("flushes the compressed output at the configured interval", func() {
+			g.Assert(rfs.CreateServerFileFromString("test.txt", "hello")).IsNil()
+
+			var buf bytes.Buffer
+			a := &Archive{BasePath: fs.Path(), FlushInterval: time.Nanosecond}
+			g.Assert(a.Stream(context.Background(), &buf)).IsNil()
+
+			gr, err := pgzip.NewReader(&buf)
+			g.Assert(err).IsNil()
+			h, err := tar.NewReader(gr).Next()
+			g.Assert(err).IsNil()
+			g.Assert(h.Name).Equal("test.txt")
+		})
+
+		g.It("stops streaming when the context is canceled", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			a := &Archive{BasePath: fs.Path()}
+			err = a.Stream(ctx, io.Discard)
+			g.Assert(errors.Is(err, context.Canceled)).IsTrue()
+		})
+
+		g.It("streams the files matching the given patterns as a tarball", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "logs/old"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("logs/latest.log", "latest")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("logs/old/debug.log", "debug")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("server.properties", "motd=test")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("world.dat", "world")).IsNil()
+
+			var buf bytes.Buffer
+			progress := NewProgress(0)
+			g.Assert(StreamFiles(fs.Path(), []string{"logs", "*.properties"}, &buf, progress)).IsNil()
+			g.Assert(progress.Written()).Equal(int64(buf.Len()))
+
+			var names []string
+			tr := tar.NewReader(&buf)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				g.Assert(err).IsNil()
+				names = append(names, h.Name)
+			}
+			sort.Strings(names)
+			g.Assert(names).Equal([]string{"logs/latest.log", "logs/old/debug.log", "server.properties"})
+
+			err := StreamFiles(fs.Path(), []string{"missing/*"}, io.Discard, nil)
+			g.Assert(errors.Is(err, os.ErrNotExist)).IsTrue()
+			err = StreamFiles(fs.Path(), []string{"../etc"}, io.Discard, nil)
+			g.Assert(IsErrorCode(err, ErrCodePathResolution)).IsTrue()
+		})
+
+		g.It("prunes directories without descending into them", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "prune/cache/deep"), 0o755)).IsNil()
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "prune/world"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("prune/cache/deep/entry.bin", "cached")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("prune/world/level.dat", "world")).IsNil()
+
+			var visited []string
+			a := &Archive{BasePath: filepath.Join(fs.Path(), "prune"), PruneDir: func(rp string) bool {
+				visited = append(visited, rp)
+				return rp == "cache"
+			}}
+			dst := filepath.Join(rfs.root, "prune.tar.gz")
+			g.Assert(a.Create(dst)).IsNil()
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(1)
+			g.Assert(headers["world/level.dat"]).IsNotNil()
+
+			sort.Strings(visited)
+			g.Assert(visited).Equal([]string{"cache", "world"})
+		})
+
+		g.It("archives each file matched by overlapping files exactly once", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "overlap/nested"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("overlap/a.txt", "a")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("overlap/nested/b.txt", "b")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("overlap.txt", "sibling")).IsNil()
+
+			base := filepath.Join(fs.Path(), "overlap")
+			files := []string{
+				filepath.Join(base, "nested/b.txt"),
+				base + "/",
+				filepath.Join(base, "nested"),
+				base,
+				filepath.Join(base, "a.txt"),
+				base + "/./nested/../a.txt",
+			}
+			g.Assert(normalizeFiles(files)).Equal([]string{base})
+
+			var buf bytes.Buffer
+			g.Assert((&Archive{BasePath: fs.Path(), Files: files}).Stream(context.Background(), &buf)).IsNil()
+			gr, err := pgzip.NewReader(&buf)
+			g.Assert(err).IsNil()
+			var names []string
+			tr := tar.NewReader(gr)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				g.Assert(err).IsNil()
+				names = append(names, h.Name)
+			}
+			sort.Strings(names)
+			// A file sharing the name of a directory as a prefix is not within it.
+			g.Assert(names).Equal([]string{"overlap/a.txt", "overlap/nested/b.txt"})
+
+			g.Assert(normalizeFiles([]string{"/srv/b.txt", "/srv/b/c", "/srv/b", "/srv/b"})).Equal([]string{"/srv/b", "/srv/b.txt"})
+		})
+
+		g.It("archives extra paths nested under their prefix", func() {
+			g.Assert(rfs.CreateServerFileFromString("test.txt", "hello")).IsNil()
+			extra := filepath.Join(rfs.root, "volume")
+			g.Assert(os.MkdirAll(filepath.Join(extra, "nested"), 0o755)).IsNil()
+			g.Assert(os.WriteFile(filepath.Join(extra, "nested/world.dat"), []byte("world"), 0o644)).IsNil()
+			g.Assert(os.WriteFile(filepath.Join(extra, "debug.log"), []byte("debug"), 0o644)).IsNil()
+
+			dst := filepath.Join(rfs.root, "extra.tar.gz")
+			a := &Archive{BasePath: fs.Path(), Ignore: "*.log", ExtraPaths: []ExtraPath{{Source: extra, ArchivePrefix: "/volumes/data"}}}
+			g.Assert(a.Create(dst)).IsNil()
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(2)
+			g.Assert(headers["test.txt"]).IsNotNil()
+			g.Assert(headers["volumes/data/nested/world.dat"]).IsNotNil()
+
+			size, err := a.EstimateSize()
+			g.Assert(err).IsNil()
+			g.Assert(size).Equal(int64(10))
+
+			for _, e := range []ExtraPath{
+				{Source: filepath.Join(rfs.root, "missing"), ArchivePrefix: "missing"},
+				{Source: filepath.Join(extra, "debug.log"), ArchivePrefix: "file"},
+				{Source: extra, ArchivePrefix: "../escape"},
+				{Source: extra, ArchivePrefix: ""},
+			} {
+				a := &Archive{BasePath: fs.Path(), ExtraPaths: []ExtraPath{e}}
+				g.Assert(a.Create(dst)).IsNotNil()
+			}
+		})
+
+		g.It("classifies the cause of a failure", func() {
+			g.Assert(rfs.CreateServerFileFromString("test.txt", "hello")).IsNil()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := (&Archive{BasePath: fs.Path()}).Stream(ctx, io.Discard)
+			g.Assert(errors.Is(err, ErrCancelled)).IsTrue()
+			g.Assert(errors.Is(err, context.Canceled)).IsTrue()
+
+			err = (&Archive{BasePath: fs.Path(), QuotaBytes: 1}).Create(filepath.Join(rfs.root, "quota.tar.gz"))
+			g.Assert(errors.Is(err, ErrArchiveTooLarge)).IsTrue()
+			var qerr *QuotaExceededError
+			g.Assert(errors.As(err, &qerr)).IsTrue()
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			g.Assert(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "../escape.txt", Mode: 0o644})).IsNil()
+			g.Assert(tw.Close()).IsNil()
+			g.Assert(rfs.CreateServerFile("escape.tar", buf.Bytes())).IsNil()
+			err = fs.DecompressFile("/", "escape.tar")
+			g.Assert(errors.Is(err, ErrPathTraversal)).IsTrue()
+
+			err = classifyArchiveError(errors.WithStack(&os.PathError{Op: "write", Path: "test.txt", Err: syscall.ENOSPC}))
+			g.Assert(errors.Is(err, ErrNoSpace)).IsTrue()
+			err = classifyArchiveError(errors.WithStack(&os.PathError{Op: "open", Path: "test.txt", Err: syscall.EACCES}))
+			g.Assert(errors.Is(err, ErrPermission)).IsTrue()
+			g.Assert(err.Error()).Equal("open test.txt: permission denied")
+			g.Assert(classifyArchiveError(io.ErrUnexpectedEOF)).Equal(io.ErrUnexpectedEOF)
+		})
+
+		g.It("skips symlinks that point to a parent directory", func() {
+			err := os.MkdirAll(filepath.Join(fs.Path(), "a/b"), 0o755)
+			g.Assert(err).IsNil()
+			err = rfs.CreateServerFileFromString("a/b/test.txt", "hello")
+			g.Assert(err).IsNil()
+			err = os.Symlink("../..", filepath.Join(fs.Path(), "a/b/loop"))
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path()}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(1)
+			g.Assert(headers["a/b/test.txt"]).IsNotNil()
+			g.Assert(a.Stats().Skipped).Equal([]SkippedEntry{{Path: "a/b/loop", Reason: SkipReasonCircularSymlink}})
+		})
+
+		g.It("refuses to create an archive when the files exceed the quota", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello world")
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "quota.tar.gz")
+			a := &Archive{BasePath: fs.Path(), QuotaBytes: 5}
+			err = a.Create(dst)
+
+			var qerr *QuotaExceededError
+			g.Assert(errors.As(err, &qerr)).IsTrue()
+			g.Assert(qerr.Size).Equal(int64(11))
+			_, err = os.Stat(dst)
+			g.Assert(os.IsNotExist(err)).IsTrue()
+
+			a.QuotaBytes = 11
+			g.Assert(a.Create(dst)).IsNil()
+		})
+
+		g.It("stores hardlinked files as links when deduplicating", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+			err = os.Link(filepath.Join(fs.Path(), "test.txt"), filepath.Join(fs.Path(), "link.txt"))
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path(), DeduplicateHardlinks: true, SortBySimilarity: true}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["link.txt"].Typeflag).Equal(byte(tar.TypeReg))
+			g.Assert(headers["test.txt"].Typeflag).Equal(byte(tar.TypeLink))
+			g.Assert(headers["test.txt"].Linkname).Equal("link.txt")
+			g.Assert(a.Stats().DeduplicatedBytes).Equal(int64(5))
+			g.Assert(a.Stats().CompressedSize > 0).IsTrue()
+		})
+
+		g.It("restores deduplicated hardlinks as links", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+			err = os.Link(filepath.Join(fs.Path(), "test.txt"), filepath.Join(fs.Path(), "link.txt"))
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path(), DeduplicateHardlinks: true}
+			g.Assert(a.Create(dst)).IsNil()
+
+			sameFile := func(dir string) {
+				first, err := os.Stat(filepath.Join(dir, "test.txt"))
+				g.Assert(err).IsNil()
+				second, err := os.Stat(filepath.Join(dir, "link.txt"))
+				g.Assert(err).IsNil()
+				g.Assert(os.SameFile(first, second)).IsTrue()
+				b, err := os.ReadFile(filepath.Join(dir, "link.txt"))
+				g.Assert(err).IsNil()
+				g.Assert(string(b)).Equal("hello")
+			}
+
+			out := filepath.Join(rfs.root, "extracted")
+			counts, err := ExtractToDir(dst, out, nil, ExtractOptions{})
+			g.Assert(err).IsNil()
+			g.Assert(counts.Written).Equal(2)
+			sameFile(out)
+
+			g.Assert(os.Remove(filepath.Join(fs.Path(), "test.txt"))).IsNil()
+			g.Assert(os.Remove(filepath.Join(fs.Path(), "link.txt"))).IsNil()
+			g.Assert(os.Rename(dst, filepath.Join(fs.Path(), "archive.tar.gz"))).IsNil()
+			g.Assert(fs.DecompressFile("/", "archive.tar.gz")).IsNil()
+			sameFile(fs.Path())
+		})
+
+		g.It("archives a snapshot of each file when requested", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path(), Snapshot: SnapshotCloneOrCopy, SnapshotDir: rfs.root}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["test.txt"].Size).Equal(int64(5))
+
+			// Snapshots should never be left behind on the disk.
+			matches, err := filepath.Glob(filepath.Join(rfs.root, ".wings-snapshot-*"))
+			g.Assert(err).IsNil()
+			g.Assert(len(matches)).Equal(0)
+		})
+
+		g.It("writes virtual files into the archive", func() {
+			err := rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path()}
+			g.Assert(a.AddVirtualFile("/meta/server.json", []byte("{}"), 0o644)).IsNil()
+			g.Assert(a.AppendVirtualFile("RESTORE.txt", []byte("instructions"), 0o600)).IsNil()
+			g.Assert(a.AddVirtualFile("../escape.txt", nil, 0o644) != nil).IsTrue()
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(3)
+			g.Assert(headers["meta/server.json"].Size).Equal(int64(2))
+			g.Assert(headers["RESTORE.txt"].Mode).Equal(int64(0o600))
+			g.Assert(a.Stats().Files).Equal(3)
+		})
+
+		g.It("returns the differences between two archives", func() {
+			g.Assert(rfs.CreateServerFileFromString("same.txt", "hello")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("changed.txt", "hello")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("removed.txt", "hello")).IsNil()
+
+			before := filepath.Join(rfs.root, "before.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path()}).Create(before)).IsNil()
+
+			g.Assert(rfs.CreateServerFileFromString("changed.txt", "world")).IsNil()
+			g.Assert(os.Remove(filepath.Join(fs.Path(), "removed.txt"))).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("added.txt", "hello")).IsNil()
+
+			after := filepath.Join(rfs.root, "after.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path()}).Create(after)).IsNil()
+
+			diff, err := DiffArchives(before, after)
+			g.Assert(err).IsNil()
+			g.Assert(len(diff.Added)).Equal(1)
+			g.Assert(diff.Added[0].Name).Equal("added.txt")
+			g.Assert(len(diff.Removed)).Equal(1)
+			g.Assert(diff.Removed[0].Name).Equal("removed.txt")
+			g.Assert(len(diff.Modified)).Equal(1)
+			g.Assert(diff.Modified[0].After.Name).Equal("changed.txt")
+		})
+
+		g.It("only archives changed files when creating an incremental archive", func() {
+			g.Assert(rfs.CreateServerFileFromString("same.txt", "hello")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("changed.txt", "hello")).IsNil()
+
+			base := &Archive{BasePath: fs.Path(), BuildManifest: true}
+			g.Assert(base.Create(filepath.Join(rfs.root, "base.tar.gz"))).IsNil()
+			manifest := base.Manifest()
+			g.Assert(len(manifest.Entries)).Equal(2)
+
+			g.Assert(rfs.CreateServerFileFromString("changed.txt", "hello world")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("added.txt", "hello")).IsNil()
+
+			dst := filepath.Join(rfs.root, "incremental.tar.gz")
+			a := &Archive{BasePath: fs.Path(), Baseline: manifest}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(2)
+			g.Assert(headers["changed.txt"]).IsNotNil()
+			g.Assert(headers["added.txt"]).IsNotNil()
+			g.Assert(a.Stats().Unchanged).Equal(1)
+			g.Assert(len(a.Manifest().Entries)).Equal(3)
+		})
+
+		g.It("skips files that have not been accessed recently", func() {
+			// Access times cannot be relied upon on noatime mounts.
+			if !atimeReliable(rfs.root) {
+				return
+			}
+			g.Assert(rfs.CreateServerFileFromString("stale.txt", "hello")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("fresh.txt", "hello")).IsNil()
+			old := time.Now().Add(-48 * time.Hour)
+			g.Assert(os.Chtimes(filepath.Join(rfs.root, "/server/stale.txt"), old, old)).IsNil()
+
+			dst := filepath.Join(rfs.root, "inactive.tar.gz")
+			a := &Archive{BasePath: fs.Path(), MaxInactivity: 24 * time.Hour}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(1)
+			g.Assert(headers["fresh.txt"]).IsNotNil()
+			g.Assert(a.Stats().Skipped).Equal([]SkippedEntry{{Path: "stale.txt", Reason: SkipReasonInactive}})
+		})
+
+		g.It("writes headers in the selected tar format", func() {
+			long := strings.Repeat("a", 120) + ".txt"
+			g.Assert(rfs.CreateServerFileFromString("short.txt", "hello")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString(long, "hello")).IsNil()
+
+			dst := filepath.Join(rfs.root, "ustar.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path(), TarFormat: tar.FormatUSTAR}).Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["short.txt"].Format).Equal(tar.FormatUSTAR)
+			// Names longer than USTAR allows are upgraded to PAX.
+			g.Assert(headers[long].Format).Equal(tar.FormatPAX)
+		})
+
+		g.It("records the last successful backup of a server", func() {
+			config.Update(func(c *config.Configuration) {
+				c.System.RootDirectory = rfs.root
+			})
+			defer config.Update(func(c *config.Configuration) {
+				c.System.RootDirectory = "/server"
+			})
+			g.Assert(rfs.CreateServerFileFromString("test.txt", "hello")).IsNil()
+
+			rec, err := LastBackup("server-1")
+			g.Assert(err).IsNil()
+			g.Assert(rec == nil).IsTrue()
+
+			dst := filepath.Join(rfs.root, "recorded.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path(), Server: "server-1"}).Create(dst)).IsNil()
+
+			b, err := os.ReadFile(dst)
+			g.Assert(err).IsNil()
+			sum := sha1.Sum(b)
+
+			rec, err = LastBackup("server-1")
+			g.Assert(err).IsNil()
+			g.Assert(rec.Path).Equal(dst)
+			g.Assert(rec.Checksum).Equal(hex.EncodeToString(sum[:]))
+			g.Assert(rec.Size).Equal(int64(len(b)))
+
+			rec, err = LastBackup("server-2")
+			g.Assert(err).IsNil()
+			g.Assert(rec == nil).IsTrue()
+		})
+
+		g.It("embeds a restore manifest in the archive", func() {
+			g.Assert(os.Mkdir(filepath.Join(rfs.root, "/server/restore"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("restore/script.sh", "#!/bin/sh")).IsNil()
+			g.Assert(os.Chmod(filepath.Join(rfs.root, "/server/restore/script.sh"), 0o755)).IsNil()
+
+			dst := filepath.Join(rfs.root, "restore.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path(), Files: []string{filepath.Join(fs.Path(), "restore")}, WriteRestoreManifest: true}).Create(dst)).IsNil()
+
+			var m RestoreManifest
+			err := walkArchive(dst, func(h *tar.Header, r io.Reader) error {
+				if h.Name != RestoreManifestName {
+					return nil
+				}
+				return json.NewDecoder(r).Decode(&m)
+			})
+			g.Assert(err).IsNil()
+			g.Assert(m.Entries).Equal([]RestoreEntry{{
+				Path: "restore/script.sh",
+				Type: "file",
+				Mode: 0o755,
+				Uid:  os.Getuid(),
+				Gid:  os.Getgid(),
+			}})
+		})
+
+		g.It("logs each archived entry at the debug level", func() {
+			g.Assert(rfs.CreateServerFileFromString("logged.txt", "hello")).IsNil()
+
+			h := logmemory.New()
+			dst := filepath.Join(rfs.root, "logged.tar.gz")
+			a := &Archive{BasePath: fs.Path(), Logger: &log.Logger{Handler: h, Level: log.DebugLevel}}
+			g.Assert(a.Create(dst)).IsNil()
+
+			var found bool
+			for _, e := range h.Entries {
+				if e.Message == "processed archive entry" && e.Fields.Get("path") == "logged.txt" {
+					found = true
+					g.Assert(e.Fields.Get("action")).Equal("compressed")
+					g.Assert(e.Fields.Get("size")).Equal(int64(5))
+				}
+			}
+			g.Assert(found).IsTrue()
+
+			h = logmemory.New()
+			a.Logger = &log.Logger{Handler: h, Level: log.InfoLevel}
+			g.Assert(a.Create(dst)).IsNil()
+			g.Assert(len(h.Entries)).Equal(0)
+		})
+
+		g.It("continues at the default i/o priority where it cannot be lowered", func() {
+			g.Assert(rfs.CreateServerFileFromString("ioprio.txt", "hello")).IsNil()
+			config.Update(func(c *config.Configuration) {
+				c.System.Backups.LowPriorityIO = true
+			})
+			defer config.Update(func(c *config.Configuration) {
+				c.System.Backups.LowPriorityIO = false
+			})
+
+			h := logmemory.New()
+			a := &Archive{BasePath: fs.Path(), Logger: &log.Logger{Handler: h, Level: log.InfoLevel}}
+			g.Assert(a.Create(filepath.Join(rfs.root, "ioprio.tar.gz"))).IsNil()
+
+			// Only Linux supports i/o priorities, everywhere else a warning is logged
+			// and the archive is created as normal.
+			restore, err := lowerIOPriority()
+			if runtime.GOOS == "linux" {
+				g.Assert(err).IsNil()
+				restore()
+				return
+			}
+			g.Assert(err == nil).IsFalse()
+			g.Assert(restore == nil).IsTrue()
+			var warned bool
+			for _, e := range h.Entries {
+				warned = warned || e.Level == log.WarnLevel && strings.HasPrefix(e.Message, "failed to lower i/o priority")
+			}
+			g.Assert(warned).IsTrue()
+		})
+
+		g.It("logs the exclusion of a destination inside the archive to its logger", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "selfdst"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("selfdst/test.txt", "hello")).IsNil()
+
+			h := logmemory.New()
+			dst := filepath.Join(fs.Path(), "selfdst", "archive.tar.gz")
+			a := &Archive{BasePath: filepath.Join(fs.Path(), "selfdst"), Logger: &log.Logger{Handler: h, Level: log.InfoLevel}}
+			g.Assert(a.Create(dst)).IsNil()
+
+			var found bool
+			for _, e := range h.Entries {
+				if e.Level == log.WarnLevel && strings.HasPrefix(e.Message, "archive destination is inside") {
+					found = true
+				}
+			}
+			g.Assert(found).IsTrue()
+		})
+
+		g.It("registers the progress of an archive while it is being created", func() {
+			g.Assert(rfs.CreateServerFileFromString("active.txt", "hello")).IsNil()
+
+			var active bool
+			a := &Archive{BasePath: fs.Path(), Server: "active-server"}
+			g.Assert(a.Stream(context.Background(), writerFunc(func(b []byte) (int, error) {
+				p, ok := ActiveBackup("active-server")
+				active = ok && p == a.Progress
+				return len(b), nil
+			}))).IsNil()
+			g.Assert(active).IsTrue()
+
+			_, ok := ActiveBackup("active-server")
+			g.Assert(ok).IsFalse()
+		})
+
+		g.It("weights the progress by the size of each file", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "weighted"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("weighted/small.txt", "hello")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("weighted/large.txt", strings.Repeat("a", 64*1024))).IsNil()
+			g.Assert(os.Symlink("small.txt", filepath.Join(fs.Path(), "weighted/link"))).IsNil()
+
+			a := &Archive{BasePath: filepath.Join(fs.Path(), "weighted"), Progress: NewProgress(0)}
+			g.Assert(a.Stream(context.Background(), io.Discard)).IsNil()
+			// The headers and padding of every entry are counted otherwise.
+			g.Assert(a.Progress.Written() > a.Progress.Total()).IsTrue()
+
+			a = &Archive{BasePath: filepath.Join(fs.Path(), "weighted"), Progress: NewProgress(1), WeightedProgress: true}
+			exceeded := false
+			g.Assert(a.Stream(context.Background(), writerFunc(func(b []byte) (int, error) {
+				exceeded = exceeded || a.Progress.Written() > a.Progress.Total()
+				return len(b), nil
+			}))).IsNil()
+			g.Assert(exceeded).IsFalse()
+			g.Assert(a.Progress.Total()).Equal(int64(64*1024 + 5))
+			g.Assert(a.Progress.Written()).Equal(a.Progress.Total())
+		})
+
+		g.It("tracks the progress of each phase of a backup", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "phases"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("phases/file.txt", strings.Repeat("a", 1024))).IsNil()
+
+			p := NewProgress(0)
+			p.SetPhases(ProgressPhase{Name: PhaseEstimating}, ProgressPhase{Name: PhaseArchiving, Weight: 8}, ProgressPhase{Name: PhaseVerifying})
+			g.Assert(p.Phase()).Equal(PhaseEstimating)
+			g.Assert(p.Progress(10)).Equal("[          ] 0% Estimating...")
+
+			var phases []string
+			a := &Archive{BasePath: filepath.Join(fs.Path(), "phases"), Progress: p, WeightedProgress: true}
+			g.Assert(a.Stream(context.Background(), writerFunc(func(b []byte) (int, error) {
+				phases = append(phases, p.Phase())
+				return len(b), nil
+			}))).IsNil()
+			g.Assert(phases[0]).Equal(PhaseArchiving)
+			g.Assert(p.Total()).Equal(int64(1024))
+			g.Assert(p.Overall()).Equal(0.9)
+
+			p.StartPhase(PhaseVerifying, 2048)
+			_, _ = p.Write(make([]byte, 1024))
+			g.Assert(p.Overall()).Equal(0.95)
+			g.Assert(p.Progress(10)).Equal("[========= ] 95% Verifying 1.0 KiB / 2.0 KiB")
+
+			p.StartPhase("Unknown", 1)
+			g.Assert(p.Phase()).Equal(PhaseVerifying)
+			g.Assert(p.Total()).Equal(int64(2048))
+		})
+
+		g.It("removes the active backup if creating the archive panics", func() {
+			func() {
+				defer func() { _ = recover() }()
+				defer registerActiveBackup("panic-server", NewProgress(0))()
+				panic("archive failed")
+			}()
+
+			_, ok := ActiveBackup("panic-server")
+			g.Assert(ok).IsFalse()
+		})
+
+		g.It("creates a snapshot using reflinks or an archive", func() {
+			g.Assert(rfs.CreateServerFileFromString("snapshot.txt", "hello")).IsNil()
+
+			dst := filepath.Join(rfs.root, "snapshot")
+			method, err := (&Archive{BasePath: fs.Path()}).CreateSnapshot(dst)
+			g.Assert(err).IsNil()
+
+			switch method {
+			case SnapshotMethodReflink:
+				b, err := os.ReadFile(filepath.Join(dst, "snapshot.txt"))
+				g.Assert(err).IsNil()
+				g.Assert(string(b)).Equal("hello")
+			case SnapshotMethodArchive:
+				headers, err := readArchiveHeaders(dst)
+				g.Assert(err).IsNil()
+				g.Assert(headers["snapshot.txt"]).IsNotNil()
+			default:
+				g.Fail("unexpected snapshot method " + string(method))
+			}
+		})
+
+		g.It("does not create a snapshot inside of the directory being archived", func() {
+			_, err := (&Archive{BasePath: fs.Path()}).CreateSnapshot(filepath.Join(fs.Path(), "snapshot"))
+			g.Assert(err).IsNotNil()
+		})
+
+		g.It("stores tags in the archive metadata", func() {
+			g.Assert(rfs.CreateServerFileFromString("tagged.txt", "hello")).IsNil()
+
+			dst := filepath.Join(rfs.root, "tagged.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path(), Tags: map[string]string{"reason": "pre-update"}}).Create(dst)).IsNil()
+
+			meta, err := ReadArchiveMeta(dst)
+			g.Assert(err).IsNil()
+			g.Assert(meta.Tags).Equal(map[string]string{"reason": "pre-update"})
+		})
+
+		g.It("does not create an archive with invalid tags", func() {
+			for _, tags := range []map[string]string{
+				{"": "empty"},
+				{"has space": "value"},
+				{strings.Repeat("a", MaxTagKeyLength+1): "value"},
+				{"reason": strings.Repeat("a", MaxTagValueLength+1)},
+				{"reason": "new\nline"},
+			} {
+				err := (&Archive{BasePath: fs.Path(), Tags: tags}).Create(filepath.Join(rfs.root, "invalid-tags.tar.gz"))
+				g.Assert(err).IsNotNil()
+			}
+			_, err := os.Stat(filepath.Join(rfs.root, "invalid-tags.tar.gz"))
+			g.Assert(os.IsNotExist(err)).IsTrue()
+		})
+
+		g.It("does not read ahead of a slow writer when streaming", func() {
+			b := make([]byte, 8*StreamBufferSize)
+			_, _ = rand.New(rand.NewSource(1)).Read(b)
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/stream"), 0o755)).IsNil()
+			g.Assert(os.WriteFile(filepath.Join(rfs.root, "/server/stream/large.bin"), b, 0o644)).IsNil()
+
+			release := make(chan struct{})
+			done := make(chan error)
+			a := &Archive{BasePath: fs.Path(), Files: []string{filepath.Join(fs.Path(), "stream")}}
+			go func() {
+				var written int
+				done <- a.Stream(context.Background(), writerFunc(func(b []byte) (int, error) {
+					// Accept the first block of the archive and then stall the writer.
+					if written > 0 {
+						<-release
+					}
+					written += len(b)
+					return len(b), nil
+				}))
+			}()
+
+			time.Sleep(250 * time.Millisecond)
+			// Allow for the block that was accepted before the writer stalled.
+			g.Assert(a.Stats().Size <= StreamBufferSize+gzipBlockSize).IsTrue()
+			close(release)
+			g.Assert(<-done).IsNil()
+			g.Assert(a.Stats().Size > int64(len(b))).IsTrue()
+		})
+
+		g.It("creates an incremental OCI layer with whiteouts for deleted files", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/oci/nested"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("oci/nested/keep.txt", "keep")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("oci/removed.txt", "removed")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("oci/changed.txt", "before")).IsNil()
+			files := []string{filepath.Join(fs.Path(), "oci")}
+
+			base := &Archive{BasePath: fs.Path(), Files: files, BuildManifest: true, OCILayer: true}
+			g.Assert(base.Create(filepath.Join(rfs.root, "oci-base.tar.gz"))).IsNil()
+			headers, err := readArchiveHeaders(filepath.Join(rfs.root, "oci-base.tar.gz"))
+			g.Assert(err).IsNil()
+			g.Assert(headers["oci/"].Typeflag).Equal(byte(tar.TypeDir))
+			g.Assert(headers["oci/nested/"].Typeflag).Equal(byte(tar.TypeDir))
+			g.Assert(headers["oci/nested/keep.txt"].Uname).Equal("")
+
+			g.Assert(os.Remove(filepath.Join(fs.Path(), "oci/removed.txt"))).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("oci/changed.txt", "after!")).IsNil()
+
+			dst := filepath.Join(rfs.root, "oci-layer.tar.gz")
+			a := &Archive{BasePath: fs.Path(), Files: files, Baseline: base.Manifest(), OCILayer: true}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err = readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(3)
+			g.Assert(headers["oci/"]).IsNotNil()
+			g.Assert(headers["oci/changed.txt"].Size).Equal(int64(6))
+			g.Assert(headers["oci/.wh.removed.txt"].Size).Equal(int64(0))
+		})
+
+		g.It("verifies an archive against the files on the disk", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/verify"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("verify/same.txt", "same")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("verify/resized.txt", "before")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("verify/rewritten.txt", "before")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("verify/removed.txt", "removed")).IsNil()
+			mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+			g.Assert(os.Chtimes(filepath.Join(fs.Path(), "verify/rewritten.txt"), mtime, mtime)).IsNil()
+
+			dst := filepath.Join(rfs.root, "verify.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path(), Files: []string{filepath.Join(fs.Path(), "verify")}}).Create(dst)).IsNil()
+
+			g.Assert(rfs.CreateServerFileFromString("verify/resized.txt", "resized")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("verify/rewritten.txt", "after!")).IsNil()
+			g.Assert(os.Chtimes(filepath.Join(fs.Path(), "verify/rewritten.txt"), mtime, mtime)).IsNil()
+			g.Assert(os.Remove(filepath.Join(fs.Path(), "verify/removed.txt"))).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("verify/added.txt", "added")).IsNil()
+
+			diff, err := VerifyAgainst(dst, fs.Path(), false)
+			g.Assert(err).IsNil()
+			g.Assert(len(diff.Added)).Equal(1)
+			g.Assert(diff.Added[0].Name).Equal("verify/added.txt")
+			g.Assert(len(diff.Removed)).Equal(1)
+			g.Assert(diff.Removed[0].Name).Equal("verify/removed.txt")
+			g.Assert(len(diff.Modified)).Equal(1)
+			g.Assert(diff.Modified[0].After.Name).Equal("verify/resized.txt")
+
+			diff, err = VerifyAgainst(dst, fs.Path(), true)
+			g.Assert(err).IsNil()
+			g.Assert(len(diff.Modified)).Equal(2)
+			g.Assert(diff.Modified[1].After.Name).Equal("verify/rewritten.txt")
+		})
+
+		g.It("pauses and resumes an archive at file boundaries", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/pause"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("pause/first.txt", "first")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("pause/second.txt", "second")).IsNil()
+			files := []string{filepath.Join(fs.Path(), "pause")}
+
+			control := &ArchiveControl{}
+			control.Pause()
+			a := &Archive{BasePath: fs.Path(), Files: files, Control: control}
+			done := make(chan error)
+			go func() {
+				done <- a.Stream(context.Background(), io.Discard)
+			}()
+
+			select {
+			case <-done:
+				g.Fail("archive completed while paused")
+			case <-time.After(100 * time.Millisecond):
+			}
+			g.Assert(control.Paused()).IsTrue()
+			g.Assert(a.Stats().Files).Equal(0)
+			control.Resume()
+			g.Assert(<-done).IsNil()
+			g.Assert(a.Stats().Files).Equal(2)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			control.Pause()
+			go func() {
+				done <- a.Stream(ctx, io.Discard)
+			}()
+			cancel()
+			g.Assert(errors.Is(<-done, context.Canceled)).IsTrue()
+		})
+
+		g.It("streams an archive to multiple destinations", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/multi"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("multi/test.txt", "hello")).IsNil()
+			files := []string{filepath.Join(fs.Path(), "multi")}
+
+			var fast, slow bytes.Buffer
+			a := &Archive{BasePath: fs.Path(), Files: files}
+			g.Assert(a.StreamMulti(context.Background(), &fast, writerFunc(func(b []byte) (int, error) {
+				time.Sleep(10 * time.Millisecond)
+				return slow.Write(b)
+			}))).IsNil()
+			g.Assert(fast.Len() > 0).IsTrue()
+			g.Assert(slow.Bytes()).Equal(fast.Bytes())
+
+			gr, err := pgzip.NewReader(&slow)
+			g.Assert(err).IsNil()
+			header, err := tar.NewReader(gr).Next()
+			g.Assert(err).IsNil()
+			g.Assert(header.Name).Equal("multi/test.txt")
+
+			err = a.StreamMulti(context.Background(), io.Discard, writerFunc(func(b []byte) (int, error) {
+				return 0, errors.New("destination failed")
+			}))
+			g.Assert(err).IsNotNil()
+		})
+
+		g.It("does not compress archives smaller than the minimum size", func() {
+			g.Assert(rfs.CreateServerFileFromString("tiny.txt", "hello")).IsNil()
+
+			dst := filepath.Join(rfs.root, "tiny.tar")
+			g.Assert((&Archive{BasePath: fs.Path(), MinCompressSize: 1 << 30, WriteMeta: true}).Create(dst)).IsNil()
+
+			f, err := os.Open(dst)
+			g.Assert(err).IsNil()
+			defer f.Close()
+			r, format, err := NewDecompressingReader(f)
+			g.Assert(err).IsNil()
+			defer r.Close()
+			g.Assert(format).Equal(FormatTar)
+
+			meta, err := ReadArchiveMeta(dst)
+			g.Assert(err).IsNil()
+			g.Assert(meta.Format).Equal(FormatTar)
+			g.Assert(meta.CompressionLevel).Equal("none")
+		})
+
+		g.It("finds entries matching a pattern without extracting them", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/find/config"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("find/server.yml", "a: b")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("find/config/plugin.yml", "c: d")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("find/server.jar", "jar")).IsNil()
+
+			dst := filepath.Join(rfs.root, "find.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path(), Files: []string{filepath.Join(fs.Path(), "find")}}).Create(dst)).IsNil()
+
+			entries, err := FindInArchive(dst, "*.yml")
+			g.Assert(err).IsNil()
+			g.Assert(len(entries)).Equal(2)
+
+			entries, err = FindInArchive(dst, "find/config/*")
+			g.Assert(err).IsNil()
+			g.Assert(len(entries)).Equal(1)
+			g.Assert(entries[0].Name).Equal("find/config/plugin.yml")
+			g.Assert(entries[0].Size).Equal(int64(4))
+
+			_, err = FindInArchive(dst, "[")
+			g.Assert(err).IsNotNil()
+		})
+
+		g.It("writes an index for reading single entries", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/index"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("index/first.txt", strings.Repeat("first", 1024))).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("index/second.txt", "second")).IsNil()
+			files := []string{filepath.Join(fs.Path(), "index")}
+
+			for _, dst := range []string{filepath.Join(rfs.root, "index.tar.gz"), filepath.Join(rfs.root, "index.tar")} {
+				a := &Archive{BasePath: fs.Path(), Files: files, WriteIndex: true}
+				if filepath.Ext(dst) == ".tar" {
+					a.MinCompressSize = 1 << 30
+				}
+				g.Assert(a.Create(dst)).IsNil()
+
+				idx, err := ReadArchiveIndex(dst)
+				g.Assert(err).IsNil()
+				g.Assert(len(idx.Entries)).Equal(2)
+
+				e, ok := idx.Lookup("/index/second.txt")
+				g.Assert(ok).IsTrue()
+				sum := sha256.Sum256([]byte("second"))
+				g.Assert(e.Checksum).Equal(hex.EncodeToString(sum[:]))
+
+				var buf bytes.Buffer
+				g.Assert(idx.ReadEntry(dst, e, &buf)).IsNil()
+				g.Assert(buf.String()).Equal("second")
+
+				e.Checksum = hex.EncodeToString(make([]byte, sha256.Size))
+				err = idx.ReadEntry(dst, e, io.Discard)
+				g.Assert(errors.Is(err, ErrChecksumMismatch)).IsTrue()
+			}
+		})
+
+		g.It("creates the parent directories of the destination", func() {
+			dst := ShardedPath(filepath.Join(rfs.root, "shards"), "abcd1234", ".tar.gz")
+			a := &Archive{BasePath: fs.Path()}
+			g.Assert(a.Create(dst)).IsNil()
+			_, err := os.Stat(filepath.Join(rfs.root, "shards/ab/cd/abcd1234.tar.gz"))
+			g.Assert(err).IsNil()
+		})
+
+		g.It("names the tarball in the gzip header", func() {
+			dst := filepath.Join(rfs.root, "named.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path()}).Create(dst)).IsNil()
+			f, err := os.Open(dst)
+			g.Assert(err).IsNil()
+			defer f.Close()
+			zr, err := gzip.NewReader(f)
+			g.Assert(err).IsNil()
+			g.Assert(zr.Name).Equal("named.tar")
+			g.Assert(strings.HasPrefix(zr.Comment, "created by wings at ")).IsTrue()
+
+			now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+			header := gzipHeaderFor("/backups/abc.tgz", "uuid", now)
+			g.Assert(header.Name).Equal("abc.tar")
+			g.Assert(header.Comment).Equal("server uuid created by wings at 2022-01-02T03:04:05Z")
+			g.Assert(gzipHeaderFor("/backups/\u00e9t\u00e9.tar.gz", "", now).Name).Equal("")
+		})
+
+		g.It("counts entries using the index when it matches the archive", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/count"), 0o755)).IsNil()
+			for _, f := range []string{"count/a.txt", "count/b.txt", "count/c.txt"} {
+				g.Assert(rfs.CreateServerFileFromString(f, f)).IsNil()
+			}
+			dst := filepath.Join(rfs.root, "count.tar.gz")
+			a := &Archive{BasePath: fs.Path(), Files: []string{filepath.Join(fs.Path(), "count")}, WriteIndex: true}
+			g.Assert(a.Create(dst)).IsNil()
+
+			n, err := CountEntries(dst)
+			g.Assert(err).IsNil()
+			g.Assert(n).Equal(3)
+
+			// The count is read from the index rather than the archive.
+			idx, err := ReadArchiveIndex(dst)
+			g.Assert(err).IsNil()
+			g.Assert(idx.Count).Equal(3)
+			idx.Count = 42
+			g.Assert(writeArchiveIndex(dst, idx)).IsNil()
+			n, err = CountEntries(dst)
+			g.Assert(err).IsNil()
+			g.Assert(n).Equal(42)
+
+			// An index that does not match the archive is ignored.
+			b, err := os.ReadFile(IndexPath(dst))
+			g.Assert(err).IsNil()
+			for _, modify := range []func(idx *ArchiveIndex){
+				func(idx *ArchiveIndex) { idx.Format = FormatTar },
+				func(idx *ArchiveIndex) { idx.Count = 1 },
+				func(idx *ArchiveIndex) { idx.Entries[0].Offset = idx.Entries[2].Offset + 1 },
+				func(idx *ArchiveIndex) { idx.Entries[2].Offset++ },
+				func(idx *ArchiveIndex) { idx.Entries[2].Name = "count/d.txt" },
+			} {
+				var idx ArchiveIndex
+				g.Assert(json.Unmarshal(b, &idx)).IsNil()
+				modify(&idx)
+				g.Assert(writeArchiveIndex(dst, &idx)).IsNil()
+				n, err = CountEntries(dst)
+				g.Assert(err).IsNil()
+				g.Assert(n).Equal(3)
+			}
+
+			g.Assert(os.Remove(IndexPath(dst))).IsNil()
+			n, err = CountEntries(dst)
+			g.Assert(err).IsNil()
+			g.Assert(n).Equal(3)
+		})
+
+		g.It("merges archives into a single archive", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/concat"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("concat/base.txt", "base")).IsNil()
+			files := []string{filepath.Join(fs.Path(), "concat")}
+			base := filepath.Join(rfs.root, "concat-base.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path(), Files: files}).Create(base)).IsNil()
+
+			g.Assert(rfs.CreateServerFileFromString("concat/base.txt", "changed")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("concat/added.txt", "added")).IsNil()
+			incremental := filepath.Join(rfs.root, "concat-incremental.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path(), Files: files}).Create(incremental)).IsNil()
+
+			// An archive created by something other than Wings.
+			var buf bytes.Buffer
+			gw := pgzip.NewWriter(&buf)
+			tw := tar.NewWriter(gw)
+			g.Assert(tw.WriteHeader(&tar.Header{Name: "other.txt", Mode: 0o644, Size: 5, Typeflag: tar.TypeReg})).IsNil()
+			_, err := tw.Write([]byte("other"))
+			g.Assert(err).IsNil()
+			g.Assert(tw.Close()).IsNil()
+			g.Assert(gw.Close()).IsNil()
+			other := filepath.Join(rfs.root, "concat-other.tar.gz")
+			g.Assert(os.WriteFile(other, buf.Bytes(), 0o644)).IsNil()
+
+			dst := filepath.Join(rfs.root, "concat.tar.gz")
+			g.Assert(ConcatArchives(dst, base, incremental, other)).IsNil()
+
+			contents := make(map[string]string)
+			var count int
+			err = walkArchive(dst, func(h *tar.Header, r io.Reader) error {
+				b, err := io.ReadAll(r)
+				contents[h.Name] = string(b)
+				count++
+				return err
+			})
+			g.Assert(err).IsNil()
+			g.Assert(count).Equal(4)
+			g.Assert(contents).Equal(map[string]string{
+				"concat/base.txt":  "changed",
+				"concat/added.txt": "added",
+				"other.txt":        "other",
+			})
+		})
+
+		g.It("recompresses an archive at a different level", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/recompress"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("recompress/text.txt", strings.Repeat("recompress ", 4096))).IsNil()
+			g.Assert(os.Symlink("text.txt", filepath.Join(fs.Path(), "recompress/link"))).IsNil()
+
+			src := filepath.Join(rfs.root, "recompress.tar.gz")
+			a := &Archive{BasePath: fs.Path(), Files: []string{filepath.Join(fs.Path(), "recompress")}, WriteIndex: true, Tags: map[string]string{"reason": "test"}}
+			g.Assert(a.Create(src)).IsNil()
+			before, err := readArchiveHeaders(src)
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "recompress-stored.tar.gz")
+			g.Assert(Recompress(src, dst, LevelNone)).IsNil()
+			stored, err := os.Stat(dst)
+			g.Assert(err).IsNil()
+			orig, err := os.Stat(src)
+			g.Assert(err).IsNil()
+			g.Assert(stored.Size() > orig.Size()).IsTrue()
+
+			// Recompressing in place replaces the archive, its metadata and index.
+			g.Assert(Recompress(dst, dst, LevelBestCompression)).IsNil()
+			after, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(after)).Equal(len(before))
+			for name, h := range before {
+				g.Assert(after[name].Typeflag).Equal(h.Typeflag)
+				g.Assert(after[name].Size).Equal(h.Size)
+				g.Assert(after[name].Linkname).Equal(h.Linkname)
+				g.Assert(after[name].ModTime.Equal(h.ModTime)).IsTrue()
+			}
+
+			meta, err := ReadArchiveMeta(dst)
+			g.Assert(err).IsNil()
+			b, err := os.ReadFile(dst)
+			g.Assert(err).IsNil()
+			sum := sha1.Sum(b)
+			g.Assert(meta.CompressionLevel).Equal("best_compression")
+			g.Assert(meta.CompressionMode).Equal(CompressionGzip)
+			g.Assert(meta.Checksum).Equal(hex.EncodeToString(sum[:]))
+			g.Assert(meta.Size).Equal(int64(len(b)))
+			g.Assert(meta.Tags).Equal(map[string]string{"reason": "test"})
+			_, err = os.Stat(IndexPath(dst))
+			g.Assert(os.IsNotExist(err)).IsTrue()
+
+			g.Assert(Recompress(src, dst, Level("fastest"))).IsNotNil()
+		})
+
+		g.It("skips files with a denied content type", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/content"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("content/movie.txt", "\x1A\x45\xDF\xA3 webm")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("content/notes.txt", "hello")).IsNil()
+
+			dst := filepath.Join(rfs.root, "content.tar.gz")
+			a := &Archive{BasePath: fs.Path(), Files: []string{filepath.Join(fs.Path(), "content")}, DenyContentTypes: []string{"video/*"}}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(1)
+			g.Assert(headers["content/notes.txt"]).IsNotNil()
+			g.Assert(a.Stats().Skipped).Equal([]SkippedEntry{{Path: "content/movie.txt", Reason: SkipReasonContentType}})
+		})
+
+		g.It("reports files that are slow to copy", func() {
+			b := make([]byte, 4*StreamBufferSize)
+			_, _ = rand.New(rand.NewSource(1)).Read(b)
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/slow"), 0o755)).IsNil()
+			g.Assert(os.WriteFile(filepath.Join(rfs.root, "/server/slow/world.mca"), b, 0o644)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("slow/fast.txt", "hello")).IsNil()
+
+			var mu sync.Mutex
+			reported := make(map[string]int64)
+			a := &Archive{
+				BasePath:          fs.Path(),
+				Files:             []string{filepath.Join(fs.Path(), "slow")},
+				SlowFileThreshold: 20 * time.Millisecond,
+				OnSlowFile: func(name string, written int64) {
+					mu.Lock()
+					defer mu.Unlock()
+					reported[name] = written
+				},
+			}
+			err := a.Stream(context.Background(), writerFunc(func(b []byte) (int, error) {
+				time.Sleep(10 * time.Millisecond)
+				return len(b), nil
+			}))
+			g.Assert(err).IsNil()
+
+			mu.Lock()
+			defer mu.Unlock()
+			g.Assert(len(reported)).Equal(1)
+			g.Assert(reported["slow/world.mca"] > 0).IsTrue()
+		})
+
+		g.It("lists the files that would be archived without creating an archive", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/inventory/logs"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("inventory/server.properties", "motd=hello")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("inventory/logs/latest.log", "log")).IsNil()
+
+			a := &Archive{BasePath: fs.Path(), Ignore: "*.log"}
+			entries, stats, err := a.Inventory()
+			g.Assert(err).IsNil()
+			names := make(map[string]FileEntry)
+			var size int64
+			for _, e := range entries {
+				names[e.Name] = e
+				size += e.Size
+			}
+			g.Assert(names["inventory/server.properties"].Size).Equal(int64(10))
+			_, ok := names["inventory/logs/latest.log"]
+			g.Assert(ok).IsFalse()
+			g.Assert(stats.Files).Equal(len(entries))
+			g.Assert(stats.Size).Equal(size)
+		})
+
+		g.It("re-includes files using negated ignore patterns", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/logs"), 0o755)).IsNil()
+			for _, f := range []string{"important.log", "other.log", "logs/important.log", "logs/keep.log", "logs/other.log"} {
+				g.Assert(rfs.CreateServerFileFromString(f, "log")).IsNil()
+			}
+
+			for ignore, expected := range map[string][]string{
+				// The last matching pattern wins, so the order of the patterns matters.
+				"*.log\n!important.log":                {"important.log", "logs/important.log"},
+				"!important.log\n*.log":                {},
+				"*.log\n!important.log\nimportant.log": {},
+				"*.log\r\n!important.log\r\n":          {"important.log", "logs/important.log"},
+				"*.log\n!/important.log":               {"important.log"},
+				"*.log\n!logs/keep.log":                {"logs/keep.log"},
+				"logs/*\n!logs/keep.log":               {"important.log", "other.log", "logs/keep.log"},
+				"*\n!*.log\nother.log":                 {"important.log", "logs/important.log", "logs/keep.log"},
+			} {
+				entries, _, err := (&Archive{BasePath: fs.Path(), Ignore: ignore}).Inventory()
+				g.Assert(err).IsNil()
+				names := []string{}
+				for _, e := range entries {
+					names = append(names, e.Name)
+				}
+				sort.Strings(names)
+				sort.Strings(expected)
+				g.Assert(names).Equal(expected, fmt.Sprintf("ignore %q", ignore))
+			}
+		})
+
+		g.It("picks the compression level using the resolver", func() {
+			g.Assert(os.MkdirAll(filepath.Join(rfs.root, "/server/resolver/world"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("resolver/world/r.0.0.mca", strings.Repeat("a", 4096))).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("resolver/server.properties", strings.Repeat("b", 1024))).IsNil()
+
+			var sampled SampleStats
+			a := &Archive{
+				BasePath: fs.Path(),
+				Files:    []string{filepath.Join(fs.Path(), "resolver")},
+				CompressionResolver: func(stats SampleStats) int {
+					sampled = stats
+					return DefaultCompressionResolver(stats)
+				},
+			}
+			var buf bytes.Buffer
+			g.Assert(a.Stream(context.Background(), &buf)).IsNil()
+			g.Assert(sampled.Files).Equal(2)
+			g.Assert(sampled.Size).Equal(int64(5120))
+			g.Assert(sampled.Compressed).Equal(int64(4096))
+			g.Assert(sampled.Extensions[".properties"]).Equal(int64(1024))
+			g.Assert(a.level).Equal(pgzip.BestSpeed)
+
+			g.Assert(DefaultCompressionResolver(SampleStats{Size: 100, Compressed: 10})).Equal(pgzip.DefaultCompression)
+			g.Assert(DefaultCompressionResolver(SampleStats{})).Equal(pgzip.BestSpeed)
+		})
+
+		g.It("caches the files matched by the ignore rules", func() {
+			root := filepath.Join(fs.Path(), "walkcache")
+			g.Assert(os.MkdirAll(filepath.Join(root, "logs"), 0o755)).IsNil()
+			for _, f := range []string{"walkcache/a.txt", "walkcache/b.log", "walkcache/logs/c.txt"} {
+				g.Assert(rfs.CreateServerFileFromString(f, "test")).IsNil()
+			}
+			old := time.Now().Add(-time.Hour)
+			age := func() {
+				for _, d := range []string{root, filepath.Join(root, "logs")} {
+					g.Assert(os.Chtimes(d, old, old)).IsNil()
+				}
+			}
+			names := func(a *Archive) []string {
+				entries, _, err := a.Inventory()
+				g.Assert(err).IsNil()
+				names := []string{}
+				for _, e := range entries {
+					names = append(names, e.Name)
+				}
+				sort.Strings(names)
+				return names
+			}
+			cache := filepath.Join(rfs.root, "walk.cache")
+			a := &Archive{BasePath: root, Ignore: "*.log", WalkCache: cache}
+
+			// A tree that was modified moments ago is not cached.
+			g.Assert(names(a)).Equal([]string{"a.txt", "logs/c.txt"})
+			_, err := os.Stat(cache)
+			g.Assert(os.IsNotExist(err)).IsTrue()
+
+			age()
+			g.Assert(names(a)).Equal([]string{"a.txt", "logs/c.txt"})
+			_, err = os.Stat(cache)
+			g.Assert(err).IsNil()
+
+			// Adding a file without changing the modification time of its directory
+			// is not detected, which shows the cached entries are being used.
+			g.Assert(rfs.CreateServerFileFromString("walkcache/logs/d.txt", "test")).IsNil()
+			age()
+			g.Assert(names(a)).Equal([]string{"a.txt", "logs/c.txt"})
+
+			// Changing the ignore rules or the tree invalidates the cache.
+			a.Ignore = "*.txt"
+			g.Assert(names(a)).Equal([]string{"b.log"})
+			a.Ignore = "*.log"
+			g.Assert(names(a)).Equal([]string{"a.txt", "logs/c.txt", "logs/d.txt"})
+			g.Assert(rfs.CreateServerFileFromString("walkcache/logs/e.txt", "test")).IsNil()
+			g.Assert(names(a)).Equal([]string{"a.txt", "logs/c.txt", "logs/d.txt", "logs/e.txt"})
+		})
+
+		g.It("abandons an archive that exceeds the maximum duration", func() {
+			g.Assert(rfs.CreateServerFileFromString("budget.txt", "budget")).IsNil()
+			control := &ArchiveControl{}
+			control.Pause()
+			dst := filepath.Join(rfs.root, "budget.tar.gz")
+			a := &Archive{BasePath: fs.Path(), Control: control, MaxDuration: 50 * time.Millisecond}
+
+			err := a.Create(dst)
+			g.Assert(errors.Is(err, ErrTimeBudgetExceeded)).IsTrue()
+			_, err = os.Stat(dst)
+			g.Assert(os.IsNotExist(err)).IsTrue()
+
+			// Canceling the context before the budget is used up is not reported as
+			// exceeding the budget.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			a.MaxDuration = time.Minute
+			err = a.Stream(ctx, io.Discard)
+			g.Assert(errors.Is(err, context.Canceled)).IsTrue()
+			g.Assert(errors.Is(err, ErrTimeBudgetExceeded)).IsFalse()
+		})
+
+		g.It("records the effective compression mode", func() {
+			defer config.Update(func(c *config.Configuration) {
+				c.System.Backups.CompressionLevel = ""
+			})
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "mode"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("mode/test.txt", "hello")).IsNil()
+
+			create := func(name string, a *Archive) (ArchiveStats, *ArchiveMeta) {
+				a.BasePath = filepath.Join(fs.Path(), "mode")
+				a.WriteMeta = true
+				dst := filepath.Join(rfs.root, name)
+				g.Assert(a.Create(dst)).IsNil()
+				meta, err := ReadArchiveMeta(dst)
+				g.Assert(err).IsNil()
+				return a.Stats(), meta
+			}
+
+			stats, meta := create("mode_store.tar", &Archive{MinCompressSize: 1 << 30})
+			g.Assert(stats.CompressionMode).Equal(CompressionStore)
+			g.Assert(stats.GzipLevel).Equal(0)
+			g.Assert(meta.CompressionMode).Equal(CompressionStore)
+
+			stats, meta = create("mode_gzip.tar.gz", &Archive{})
+			g.Assert(stats.CompressionMode).Equal(CompressionGzip)
+			g.Assert(stats.GzipLevel).Equal(pgzip.BestSpeed)
+			g.Assert(meta.CompressionMode).Equal(CompressionGzip)
+
+			config.Update(func(c *config.Configuration) {
+				c.System.Backups.CompressionLevel = "none"
+			})
+			stats, meta = create("mode_stored.tar.gz", &Archive{})
+			g.Assert(stats.CompressionMode).Equal(CompressionGzipStored)
+			g.Assert(stats.GzipLevel).Equal(0)
+			g.Assert(meta.CompressionMode).Equal(CompressionGzipStored)
+
+			// Metadata written before the mode was recorded has it inferred.
+			dst := filepath.Join(rfs.root, "mode_legacy.tar.gz")
+			g.Assert(os.WriteFile(MetaPath(dst), []byte(`{"format":"tar.gz","compression_level":"none"}`), 0o600)).IsNil()
+			meta, err := ReadArchiveMeta(dst)
+			g.Assert(err).IsNil()
+			g.Assert(meta.CompressionMode).Equal(CompressionGzipStored)
+		})
+
+		g.It("pads a file that is truncated after its header is written", func() {
+			base := filepath.Join(fs.Path(), "truncated")
+			g.Assert(os.MkdirAll(base, 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("truncated/file.txt", strings.Repeat("a", 8*1024))).IsNil()
+
+			// Truncate the file as soon as its header reaches the destination, which
+			// happens before its contents are read when the archive is not compressed.
+			var buf bytes.Buffer
+			truncated := false
+			a := &Archive{BasePath: base, Progress: NewProgress(8 * 1024)}
+			g.Assert(a.write(context.Background(), writerFunc(func(b []byte) (int, error) {
+				if !truncated {
+					truncated = true
+					g.Assert(os.Truncate(filepath.Join(base, "file.txt"), 100)).IsNil()
+				}
+				return buf.Write(b)
+			}), false)).IsNil()
+			g.Assert(a.Progress.Total()).Equal(int64(100))
+
+			tr := tar.NewReader(&buf)
+			header, err := tr.Next()
+			g.Assert(err).IsNil()
+			g.Assert(header.Size).Equal(int64(8 * 1024))
+			b, err := io.ReadAll(tr)
+			g.Assert(err).IsNil()
+			g.Assert(string(b)).Equal(strings.Repeat("a", 100) + strings.Repeat("\x00", 8*1024-100))
+			_, err = tr.Next()
+			g.Assert(err).Equal(io.EOF)
+		})
+
+		g.It("builds an archive from in-memory files", func() {
+			mtime := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+			var buf bytes.Buffer
+			g.Assert(BuildArchive(&buf, map[string]FileSpec{
+				"config.yml":     {Content: []byte("key: value"), Mode: 0o600, ModTime: mtime},
+				"/nested/a.txt":  {Content: []byte("a")},
+				"data":           {Mode: os.ModeDir},
+				"nested/current": {SymlinkTarget: "a.txt"},
+			})).IsNil()
+			dst := filepath.Join(rfs.root, "built.tar.gz")
+			g.Assert(os.WriteFile(dst, buf.Bytes(), 0o644)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(4)
+			g.Assert(headers["config.yml"].Typeflag).Equal(byte(tar.TypeReg))
+			g.Assert(headers["config.yml"].Mode).Equal(int64(0o600))
+			g.Assert(headers["config.yml"].Size).Equal(int64(len("key: value")))
+			g.Assert(headers["config.yml"].ModTime.Equal(mtime)).IsTrue()
+			g.Assert(headers["nested/a.txt"].Mode).Equal(int64(0o644))
+			g.Assert(headers["data"].Typeflag).Equal(byte(tar.TypeDir))
+			g.Assert(headers["data"].Mode).Equal(int64(0o755))
+			g.Assert(headers["nested/current"].Typeflag).Equal(byte(tar.TypeSymlink))
+			g.Assert(headers["nested/current"].Linkname).Equal("a.txt")
+
+			out := filepath.Join(rfs.root, "built")
+			counts, err := ExtractToDir(dst, out, nil, ExtractOptions{})
+			g.Assert(err).IsNil()
+			g.Assert(counts.Written).Equal(2)
+			c, err := os.ReadFile(filepath.Join(out, "nested/a.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(string(c)).Equal("a")
+
+			g.Assert(BuildArchive(&buf, map[string]FileSpec{"../escape": {}}) == nil).IsFalse()
+		})
+
+		g.It("splits an archive by the source of its entries", func() {
+			extra := filepath.Join(rfs.root, "source_extra")
+			g.Assert(os.MkdirAll(extra, 0o755)).IsNil()
+			g.Assert(os.WriteFile(filepath.Join(extra, "data.txt"), []byte("data"), 0o644)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("server.txt", "server")).IsNil()
+			dst := filepath.Join(rfs.root, "sources.tar.gz")
+
+			a := &Archive{
+				BasePath:   fs.Path(),
+				SourceID:   "server",
+				ExtraPaths: []ExtraPath{{Source: extra, ArchivePrefix: "volumes/data", SourceID: "volume"}},
+			}
+			g.Assert(a.Create(dst)).IsNil()
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["server.txt"].PAXRecords[SourceRecord]).Equal("server")
+			g.Assert(headers["volumes/data/data.txt"].PAXRecords[SourceRecord]).Equal("volume")
+
+			out := filepath.Join(rfs.root, "split")
+			g.Assert(SplitBySource(dst, out)).IsNil()
+			b, err := os.ReadFile(filepath.Join(out, "server", "server.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(string(b)).Equal("server")
+			b, err = os.ReadFile(filepath.Join(out, "volume", "volumes/data/data.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(string(b)).Equal("data")
+			_, err = os.Stat(filepath.Join(out, "server", "volumes"))
+			g.Assert(os.IsNotExist(err)).IsTrue()
+
+			g.Assert((&Archive{BasePath: fs.Path()}).Create(dst)).IsNil()
+			g.Assert(SplitBySource(dst, out)).IsNil()
+			_, err = os.Stat(filepath.Join(out, UntaggedSource, "server.txt"))
+			g.Assert(err).IsNil()
+
+			g.Assert((&Archive{BasePath: fs.Path(), SourceID: "../escape"}).Create(dst) == nil).IsFalse()
+		})
+
+		g.It("walks every entry of an archive", func() {
+			var buf bytes.Buffer
+			g.Assert(BuildArchive(&buf, map[string]FileSpec{
+				"first.txt":       {Content: []byte("first")},
+				"nested/second":   {Content: []byte("second")},
+				"nested/link.txt": {SymlinkTarget: "second"},
+			})).IsNil()
+			src := filepath.Join(rfs.root, "walk.tar.gz")
+			g.Assert(os.WriteFile(src, buf.Bytes(), 0o644)).IsNil()
+
+			contents := make(map[string]string)
+			g.Assert(WalkArchive(src, func(hdr *tar.Header, r io.Reader) error {
+				_, ok := r.(*tar.Reader)
+				g.Assert(ok).IsFalse()
+				b, err := io.ReadAll(r)
+				contents[hdr.Name] = string(b)
+				return err
+			})).IsNil()
+			g.Assert(contents).Equal(map[string]string{"first.txt": "first", "nested/link.txt": "", "nested/second": "second"})
+
+			stop := errors.New("stop")
+			var walked int
+			err := WalkArchive(src, func(hdr *tar.Header, r io.Reader) error {
+				walked++
+				return stop
+			})
+			g.Assert(errors.Is(err, stop)).IsTrue()
+			g.Assert(walked).Equal(1)
+
+			g.Assert(WalkArchive(filepath.Join(rfs.root, "missing.tar.gz"), func(*tar.Header, io.Reader) error {
+				return nil
+			}) == nil).IsFalse()
+		})
+
+		g.It("limits the number of symlinks and special files", func() {
+			base := filepath.Join(fs.Path(), "special")
+			g.Assert(os.MkdirAll(base, 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("special/file.txt", "file")).IsNil()
+			for _, name := range []string{"a", "b", "c"} {
+				g.Assert(os.Symlink("file.txt", filepath.Join(base, name))).IsNil()
+			}
+			dst := filepath.Join(rfs.root, "special.tar.gz")
+
+			err := (&Archive{BasePath: base, MaxSpecialEntries: 2}).Create(dst)
+			var serr *SpecialEntriesExceededError
+			g.Assert(errors.As(err, &serr)).IsTrue()
+			g.Assert(serr.Count).Equal(3)
+			g.Assert(serr.Limit).Equal(2)
+
+			g.Assert((&Archive{BasePath: base, MaxSpecialEntries: 3}).Create(dst)).IsNil()
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(4)
+		})
+
+		g.It("archives symlinks according to the symlink policy", func() {
+			base := filepath.Join(fs.Path(), "links")
+			g.Assert(os.MkdirAll(filepath.Join(base, "dir"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("links/file.txt", "file")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("links/dir/inner.txt", "inner")).IsNil()
+			g.Assert(os.WriteFile(filepath.Join(rfs.root, "links_outside.txt"), []byte("outside"), 0o644)).IsNil()
+			g.Assert(os.Symlink("file.txt", filepath.Join(base, "link-file"))).IsNil()
+			g.Assert(os.Symlink("dir", filepath.Join(base, "link-dir"))).IsNil()
+			g.Assert(os.Symlink(filepath.Join(rfs.root, "links_outside.txt"), filepath.Join(base, "escape"))).IsNil()
+			g.Assert(os.Symlink("..", filepath.Join(base, "dir/loop"))).IsNil()
+			dst := filepath.Join(rfs.root, "links.tar.gz")
+
+			a := &Archive{BasePath: base}
+			g.Assert(a.Create(dst)).IsNil()
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["link-file"].Typeflag).Equal(byte(tar.TypeSymlink))
+			g.Assert(headers["escape"].Typeflag).Equal(byte(tar.TypeSymlink))
+
+			a = &Archive{BasePath: base, SymlinkPolicy: SymlinkSkip}
+			g.Assert(a.Create(dst)).IsNil()
+			headers, err = readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(2)
+			g.Assert(headers["link-file"] == nil).IsTrue()
+			g.Assert(len(a.Stats().Skipped)).Equal(4)
+
+			a = &Archive{BasePath: base, SymlinkPolicy: SymlinkFollow, Ignore: "link-dir/ignored.txt"}
+			g.Assert(rfs.CreateServerFileFromString("links/dir/ignored.txt", "ignored")).IsNil()
+			g.Assert(a.Create(dst)).IsNil()
+			headers, err = readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["link-file"].Typeflag).Equal(byte(tar.TypeReg))
+			g.Assert(headers["link-file"].Size).Equal(int64(len("file")))
+			g.Assert(headers["link-dir/inner.txt"].Typeflag).Equal(byte(tar.TypeReg))
+			g.Assert(headers["link-dir/ignored.txt"] == nil).IsTrue()
+			g.Assert(headers["dir/ignored.txt"] == nil).IsFalse()
+			g.Assert(headers["escape"] == nil).IsTrue()
+			g.Assert(headers["dir/loop"] == nil).IsTrue()
+			g.Assert(headers["link-dir/loop"] == nil).IsTrue()
+			skipped := map[string]SkipReason{}
+			for _, e := range a.Stats().Skipped {
+				skipped[e.Path] = e.Reason
+			}
+			g.Assert(skipped["escape"]).Equal(SkipReasonSymlinkEscape)
+			g.Assert(skipped["dir/loop"]).Equal(SkipReasonCircularSymlink)
+		})
+
+		g.It("publishes progress events while the archive is written", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "events"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("events/test.txt", strings.Repeat("a", 4096))).IsNil()
+
+			emitter := &recordingEmitter{}
+			a := &Archive{
+				BasePath:       filepath.Join(fs.Path(), "events"),
+				ProgressEvents: &ProgressEvents{Emitter: emitter, Topic: "backup progress:abc", ID: "abc", Total: 4096},
+			}
+			g.Assert(a.Create(filepath.Join(rfs.root, "events.tar.gz"))).IsNil()
+			g.Assert(len(emitter.events) > 0).IsTrue()
+			g.Assert(emitter.topics[len(emitter.topics)-1]).Equal("backup progress:abc")
+			last := emitter.events[len(emitter.events)-1].(ProgressEvent)
+			g.Assert(last.ID).Equal("abc")
+			g.Assert(last.Total).Equal(int64(4096))
+			g.Assert(last.Written).Equal(a.Progress.Written())
+			g.Assert(last.Percentage).Equal(float64(100))
+		})
+
+		g.It("does not estimate the size of the files for progress events", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "unsized"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("unsized/test.txt", strings.Repeat("a", 4096))).IsNil()
+
+			emitter := &recordingEmitter{}
+			a := &Archive{
+				BasePath:       filepath.Join(fs.Path(), "unsized"),
+				ProgressEvents: &ProgressEvents{Emitter: emitter, Topic: "backup progress:abc", ID: "abc"},
+			}
+			g.Assert(a.Create(filepath.Join(rfs.root, "unsized.tar.gz"))).IsNil()
+			last := emitter.events[len(emitter.events)-1].(ProgressEvent)
+			g.Assert(last.Total).Equal(int64(0))
+			g.Assert(last.Written > 0).IsTrue()
+			g.Assert(last.Percentage).Equal(float64(0))
+		})
+
+		g.It("writes the archive to the temporary directory while it is created", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "scratch"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("scratch/test.txt", "hello")).IsNil()
+			tmp := filepath.Join(rfs.root, "scratch_tmp")
+			g.Assert(os.MkdirAll(tmp, 0o755)).IsNil()
+
+			var during []os.DirEntry
+			dst := filepath.Join(rfs.root, "scratch.tar.gz")
+			a := &Archive{
+				BasePath: filepath.Join(fs.Path(), "scratch"),
+				TempDir:  tmp,
+				PruneDir: func(string) bool {
+					during, _ = os.ReadDir(tmp)
+					return false
+				},
+			}
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "scratch/nested"), 0o755)).IsNil()
+			g.Assert(a.Create(dst)).IsNil()
+			g.Assert(len(during)).Equal(1)
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["test.txt"] == nil).IsFalse()
+			entries, err := os.ReadDir(tmp)
+			g.Assert(err).IsNil()
+			g.Assert(len(entries)).Equal(0)
+
+			a.TempDir = filepath.Join(rfs.root, "scratch_missing")
+			g.Assert(a.Create(dst) == nil).IsFalse()
+			a.TempDir = dst
+			g.Assert(a.Create(dst) == nil).IsFalse()
+		})
+
+		g.It("syncs a durable archive to the disk", func() {
+			g.Assert(rfs.CreateServerFileFromString("durable.txt", "hello")).IsNil()
+			tmp := filepath.Join(rfs.root, "durable_tmp")
+			g.Assert(os.MkdirAll(tmp, 0o755)).IsNil()
+			dst := filepath.Join(rfs.root, "durable.tar.gz")
+
+			for _, a := range []*Archive{
+				{BasePath: fs.Path(), Durable: true, WriteMeta: true},
+				{BasePath: fs.Path(), Durable: true, TempDir: tmp},
+			} {
+				g.Assert(a.Create(dst)).IsNil()
+				headers, err := readArchiveHeaders(dst)
+				g.Assert(err).IsNil()
+				g.Assert(headers["durable.txt"] == nil).IsFalse()
+			}
+			g.Assert(syncDir(filepath.Join(rfs.root, "durable_missing")) == nil).IsFalse()
+		})
+
+		g.It("repairs the tail of a truncated archive", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "repair"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("repair/a.txt", "hello")).IsNil()
+			b := make([]byte, 256*1024)
+			_, _ = rand.Read(b)
+			g.Assert(os.WriteFile(filepath.Join(fs.Path(), "repair/b.txt"), b, 0o644)).IsNil()
+
+			dst := filepath.Join(rfs.root, "repair.tar.gz")
+			a := &Archive{BasePath: filepath.Join(fs.Path(), "repair"), Files: []string{filepath.Join(fs.Path(), "repair/a.txt"), filepath.Join(fs.Path(), "repair/b.txt")}, SortBySimilarity: true, WriteMeta: true}
+			g.Assert(a.Create(dst)).IsNil()
+			st, err := os.Stat(dst)
+			g.Assert(err).IsNil()
+			g.Assert(os.Truncate(dst, st.Size()/2)).IsNil()
+			_, err = readArchiveHeaders(dst)
+			g.Assert(err == nil).IsFalse()
+
+			g.Assert(RepairTarTail(dst)).IsNil()
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(1)
+			g.Assert(headers["b.txt"] == nil).IsTrue()
+			var c []byte
+			g.Assert(walkArchive(dst, func(_ *tar.Header, r io.Reader) (err error) {
+				c, err = io.ReadAll(r)
+				return err
+			})).IsNil()
+			g.Assert(string(c)).Equal("hello")
+
+			meta, err := ReadArchiveMeta(dst)
+			g.Assert(err).IsNil()
+			g.Assert(meta.Files).Equal(1)
+			st, err = os.Stat(dst)
+			g.Assert(err).IsNil()
+			g.Assert(meta.Size).Equal(st.Size())
+
+			// Nothing can be salvaged from an archive cut off within its first entry.
+			g.Assert(os.Truncate(dst, 16)).IsNil()
+			g.Assert(errors.Is(RepairTarTail(dst), ErrUnrepairableArchive)).IsTrue()
+			st, err = os.Stat(dst)
+			g.Assert(err).IsNil()
+			g.Assert(st.Size()).Equal(int64(16))
+		})
+
+		g.It("leaves the default ignored files out of the archive", func() {
+			for _, name := range []string{"defaults/keep.txt", "defaults/.DS_Store", "defaults/Thumbs.db", "defaults/nested/.config.yml.swp", "defaults/nested/keep.yml"} {
+				g.Assert(os.MkdirAll(filepath.Dir(filepath.Join(fs.Path(), name)), 0o755)).IsNil()
+				g.Assert(rfs.CreateServerFileFromString(name, "hello")).IsNil()
+			}
+			dst := filepath.Join(rfs.root, "defaults.tar.gz")
+
+			a := &Archive{BasePath: filepath.Join(fs.Path(), "defaults")}
+			g.Assert(a.Create(dst)).IsNil()
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["Thumbs.db"] == nil).IsFalse()
+
+			a = &Archive{BasePath: filepath.Join(fs.Path(), "defaults"), IgnoreDefaults: true, Ignore: "!Thumbs.db"}
+			g.Assert(a.Create(dst)).IsNil()
+			headers, err = readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["keep.txt"] == nil).IsFalse()
+			g.Assert(headers["nested/keep.yml"] == nil).IsFalse()
+			g.Assert(headers[".DS_Store"] == nil).IsTrue()
+			g.Assert(headers["nested/.config.yml.swp"] == nil).IsTrue()
+			// The per-archive rules are evaluated after the defaults.
+			g.Assert(headers["Thumbs.db"] == nil).IsFalse()
+		})
+
+		g.It("records the uncompressed size in the metadata", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "usize"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("usize/test.txt", strings.Repeat("a", 4096))).IsNil()
+
+			dst := filepath.Join(rfs.root, "usize.tar.gz")
+			a := &Archive{BasePath: filepath.Join(fs.Path(), "usize"), WriteMeta: true}
+			g.Assert(a.Create(dst)).IsNil()
+			meta, err := ReadArchiveMeta(dst)
+			g.Assert(err).IsNil()
+			g.Assert(meta.UncompressedSize).Equal(a.Stats().Size)
+			g.Assert(meta.UncompressedSize > 4096).IsTrue()
+			g.Assert(meta.UncompressedSize > meta.Size).IsTrue()
+
+			defer fs.SetDiskLimit(0)
+			fs.SetDiskLimit(meta.UncompressedSize)
+			g.Assert(fs.HasSpaceForRestore(dst)).IsNil()
+			fs.SetDiskLimit(4096)
+			g.Assert(IsErrorCode(fs.HasSpaceForRestore(dst), ErrCodeDiskSpace)).IsTrue()
+			// Archives without metadata are not checked.
+			g.Assert(fs.HasSpaceForRestore(filepath.Join(rfs.root, "missing.tar.gz"))).IsNil()
+		})
+
+		g.It("refuses to archive an unsafe base path", func() {
+			defer config.Update(func(c *config.Configuration) {
+				c.System.Data = ""
+			})
+			config.Update(func(c *config.Configuration) {
+				c.System.Data = fs.Path()
+			})
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "guard"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("guard/test.txt", "hello")).IsNil()
+			dst := filepath.Join(rfs.root, "guard.tar.gz")
+
+			for _, p := range []string{"/", "/etc", "/home/someone", fs.Path(), rfs.root} {
+				err := (&Archive{BasePath: p}).Create(dst)
+				var uerr *UnsafeBasePathError
+				g.Assert(errors.As(err, &uerr)).IsTrue()
+			}
+
+			g.Assert((&Archive{BasePath: filepath.Join(fs.Path(), "guard")}).Create(dst)).IsNil()
+			// An explicit override archives the path regardless.
+			g.Assert((&Archive{BasePath: rfs.root, Files: []string{filepath.Join(fs.Path(), "guard")}, AllowUnsafeBasePath: true}).Create(dst)).IsNil()
+		})
+
+		g.It("compresses the archive with a zstd dictionary", func() {
+			dict, err := os.ReadFile("./testdata/test.dict")
+			g.Assert(err).IsNil()
+			id, err := ZstdDictionaryID(dict)
+			g.Assert(err).IsNil()
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "dict"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("dict/test.txt", "hello")).IsNil()
+
+			dst := filepath.Join(rfs.root, "dict.tar.zst")
+			a := &Archive{BasePath: filepath.Join(fs.Path(), "dict"), Dictionary: dict, WriteMeta: true}
+			g.Assert(a.Create(dst)).IsNil()
+			g.Assert(a.Stats().CompressionMode).Equal(CompressionZstd)
+
+			meta, err := ReadArchiveMeta(dst)
+			g.Assert(err).IsNil()
+			g.Assert(meta.Format).Equal(FormatTarZstd)
+			g.Assert(meta.CompressionMode).Equal(CompressionZstd)
+			g.Assert(meta.ZstdDictID).Equal(id)
+			stored, err := ReadArchiveDictionary(dst)
+			g.Assert(err).IsNil()
+			g.Assert(stored).Equal(dict)
+
+			// The archive cannot be read without the dictionary.
+			f, err := os.Open(dst)
+			g.Assert(err).IsNil()
+			defer f.Close()
+			r, format, err := NewDecompressingReader(f)
+			if err == nil {
+				_, err = io.ReadAll(r)
+				r.Close()
+			}
+			g.Assert(format).Equal(FormatTarZstd)
+			g.Assert(err == nil).IsFalse()
+
+			out := filepath.Join(rfs.root, "dict_out")
+			_, err = ExtractToDir(dst, out, nil, ExtractOptions{})
+			g.Assert(err).IsNil()
+			b, err := os.ReadFile(filepath.Join(out, "test.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(string(b)).Equal("hello")
+
+			_, err = ZstdDictionaryID([]byte("not a dictionary"))
+			g.Assert(err == nil).IsFalse()
+			g.Assert((&Archive{BasePath: a.BasePath, Dictionary: dict, WriteIndex: true}).Create(dst) == nil).IsFalse()
+		})
+
+		g.It("skips directories that cannot be read", func() {
+			// Permission checks do not apply to the root user.
+			if os.Geteuid() == 0 {
+				return
+			}
+
+			err := os.Mkdir(filepath.Join(fs.Path(), "locked"), 0o755)
+			g.Assert(err).IsNil()
+			err = rfs.CreateServerFileFromString("locked/secret.txt", "hello")
+			g.Assert(err).IsNil()
+			err = rfs.CreateServerFileFromString("test.txt", "hello")
+			g.Assert(err).IsNil()
+			g.Assert(os.Chmod(filepath.Join(fs.Path(), "locked"), 0o000)).IsNil()
+			defer os.Chmod(filepath.Join(fs.Path(), "locked"), 0o755)
+
+			dst := filepath.Join(rfs.root, "archive.tar.gz")
+			a := &Archive{BasePath: fs.Path()}
+			g.Assert(a.Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(headers["test.txt"]).IsNotNil()
+			g.Assert(a.Stats().Skipped).Equal([]SkippedEntry{{Path: "locked", Reason: SkipReasonPermission}})
+		})
+	})
+}
+
+// BenchmarkArchive_SortBySimilarity compares the size of archives generated for
+// a tree of many small files of mixed types with and without grouping similar
+// files together. The "ratio" metric is the sorted size divided by the unsorted
+// size, lower is better.
+func BenchmarkArchive_SortBySimilarity(b *testing.B) {
+	// Only called to populate the global configuration used by Create.
+	NewFs()
+
+	root := b.TempDir()
+	r := rand.New(rand.NewSource(1))
+	templates := map[string]func(i int) string{
+		".yml": func(i int) string {
+			return fmt.Sprintf("name: plugin-%d\nversion: 1.%d.0\nmain: com.example.plugin%d.Main\nauthor: example\ndepend: [Vault, LuckPerms]\n", i, i%10, i)
+		},
+		".json": func(i int) string {
+			return fmt.Sprintf(`{"uuid":"%08x-0000-4000-8000-000000000000","name":"player%d","level":%d,"inventory":[]}`, r.Uint32(), i, r.Intn(100))
+		},
+		".properties": func(i int) string {
+			return fmt.Sprintf("server-port=%d\nmotd=A Minecraft Server\nmax-players=%d\nonline-mode=true\n", 25565+i, 20+i%5)
+		},
+		".log": func(i int) string {
+			return strings.Repeat(fmt.Sprintf("[%02d:%02d:%02d INFO]: Player%d joined the game\n", i%24, i%60, r.Intn(60), r.Intn(1000)), 4)
+		},
+	}
+	for i := 0; i < 250; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%d", i))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			b.Fatal(err)
+		}
+		for ext, tmpl := range templates {
+			// Pad each file with random bytes so neighbouring files of a different
+			// type push similar content out of the compression window.
+			pad := make([]byte, 2048)
+			r.Read(pad)
+			content := tmpl(i) + fmt.Sprintf("%x", pad)
+			if err := os.WriteFile(filepath.Join(dir, "file"+ext), []byte(content), 0o644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	size := func(sorted bool) int64 {
+		dst := filepath.Join(b.TempDir(), "archive.tar.gz")
+		a := &Archive{BasePath: root, SortBySimilarity: sorted}
+		if err := a.Create(dst); err != nil {
+			b.Fatal(err)
+		}
+		st, err := os.Stat(dst)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return st.Size()
+	}
+
+	var unsorted, sorted int64
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		unsorted = size(false)
+		sorted = size(true)
+	}
+	b.ReportMetric(float64(sorted)/float64(unsorted), "ratio")
+}
+
+func TestNewDecompressingReader(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("NewDecompressingReader", func() {
+		var raw bytes.Buffer
+		tw := tar.NewWriter(&raw)
+		_ = tw.WriteHeader(&tar.Header{Name: "test.txt", Mode: 0o644, Size: 5, Typeflag: tar.TypeReg})
+		_, _ = tw.Write([]byte("hello"))
+		_ = tw.Close()
+
+		compressors := map[Format]func(w io.Writer) io.WriteCloser{
+			FormatTar: func(w io.Writer) io.WriteCloser {
+				return nopWriteCloser{w}
+			},
+			FormatTarGzip: func(w io.Writer) io.WriteCloser {
+				return pgzip.NewWriter(w)
+			},
+			FormatTarZstd: func(w io.Writer) io.WriteCloser {
+				zw, _ := zstd.NewWriter(w)
+				return zw
+			},
+			FormatTarXz: func(w io.Writer) io.WriteCloser {
+				xw, _ := xz.NewWriter(w)
+				return xw
+			},
+		}
+
+		for format, fn := range compressors {
+			format, fn := format, fn
+			g.It("detects and decompresses "+string(format), func() {
+				var buf bytes.Buffer
+				w := fn(&buf)
+				_, err := w.Write(raw.Bytes())
+				g.Assert(err).IsNil()
+				g.Assert(w.Close()).IsNil()
+
+				r, detected, err := NewDecompressingReader(&buf)
+				g.Assert(err).IsNil()
+				defer r.Close()
+				g.Assert(detected).Equal(format)
+
+				h, err := tar.NewReader(r).Next()
+				g.Assert(err).IsNil()
+				g.Assert(h.Name).Equal("test.txt")
+			})
+
+			g.It("detects the format of a "+string(format)+" file", func() {
+				var buf bytes.Buffer
+				w := fn(&buf)
+				_, err := w.Write(raw.Bytes())
+				g.Assert(err).IsNil()
+				g.Assert(w.Close()).IsNil()
+
+				// The extension of the file is not used to detect the format.
+				p := filepath.Join(t.TempDir(), "archive.zip")
+				g.Assert(os.WriteFile(p, buf.Bytes(), 0o644)).IsNil()
+				detected, compressed, err := DetectFormat(p)
+				g.Assert(err).IsNil()
+				g.Assert(detected).Equal(format)
+				g.Assert(compressed).Equal(format != FormatTar)
+			})
+		}
+
+		g.It("returns an error for an unknown format", func() {
+			_, _, err := NewDecompressingReader(strings.NewReader("definitely not an archive"))
+			g.Assert(IsErrorCode(err, ErrCodeUnknownArchive)).IsTrue()
+
+			p := filepath.Join(t.TempDir(), "archive.tar.gz")
+			g.Assert(os.WriteFile(p, []byte("definitely not an archive"), 0o644)).IsNil()
+			_, _, err = DetectFormat(p)
+			g.Assert(IsErrorCode(err, ErrCodeUnknownArchive)).IsTrue()
+		})
+	})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestProgress_Adjust(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("Progress", func() {
+		g.It("continues from an initial offset", func() {
+			p := NewProgressFrom(40, 100)
+			g.Assert(p.Written()).Equal(int64(40))
+			_, _ = p.Write(make([]byte, 10))
+			g.Assert(p.Written()).Equal(int64(50))
+			g.Assert(p.Total()).Equal(int64(100))
+		})
+
+		g.It("tracks bytes read through a reader", func() {
+			p := NewProgress(10)
+			b, err := io.ReadAll(p.Reader(strings.NewReader("hello")))
+			g.Assert(err).IsNil()
+			g.Assert(string(b)).Equal("hello")
+			g.Assert(p.Written()).Equal(int64(5))
+		})
+
+		g.It("tracks bytes written through a writer anywhere in a chain", func() {
+			raw, compressed := NewProgress(0), NewProgress(0)
+			var buf bytes.Buffer
+			gw := pgzip.NewWriter(compressed.Writer(&buf))
+			_, err := io.Copy(raw.Writer(gw), strings.NewReader(strings.Repeat("hello", 1024)))
+			g.Assert(err).IsNil()
+			g.Assert(gw.Close()).IsNil()
+			g.Assert(raw.Written()).Equal(int64(5 * 1024))
+			g.Assert(compressed.Written()).Equal(int64(buf.Len()))
+
+			// Only the bytes accepted by the underlying writer are counted.
+			p := NewProgress(0)
+			_, err = p.Writer(writerFunc(func(b []byte) (int, error) {
+				return 2, io.ErrShortWrite
+			})).Write([]byte("hello"))
+			g.Assert(err).Equal(io.ErrShortWrite)
+			g.Assert(p.Written()).Equal(int64(2))
+		})
+
+		g.It("adjusts the total size", func() {
+			p := NewProgress(100)
+			p.Adjust(-40)
+			g.Assert(p.Total()).Equal(int64(60))
+		})
+
+		g.It("never adjusts the total below zero", func() {
+			p := NewProgress(100)
+			p.Adjust(-200)
+			g.Assert(p.Total()).Equal(int64(0))
+		})
+
+		g.It("does not render more ticks than the width", func() {
+			p := NewProgress(10)
+			_, _ = p.Write(make([]byte, 20))
+			g.Assert(strings.HasPrefix(p.Progress(5), "[=====]")).IsTrue()
+		})
+	})
+}
+
+func TestCopyWithTimeout(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("copyWithTimeout", func() {
+		g.It("copies the contents of the reader", func() {
+			var buf bytes.Buffer
+			n, err := copyWithTimeout(&buf, strings.NewReader("hello"), make([]byte, 2), time.Second)
+			g.Assert(err).IsNil()
+			g.Assert(n).Equal(int64(5))
+			g.Assert(buf.String()).Equal("hello")
+		})
+
+		g.It("abandons a copy that does not complete in time", func() {
+			block := make(chan struct{})
+			defer close(block)
+			r := io.MultiReader(strings.NewReader("hello"), readerFunc(func(b []byte) (int, error) {
+				<-block
+				return 0, io.EOF
+			}))
+
+			var buf bytes.Buffer
+			n, err := copyWithTimeout(&buf, r, make([]byte, 8), 50*time.Millisecond)
+			g.Assert(errors.Is(err, errFileTimeout)).IsTrue()
+			g.Assert(n).Equal(int64(5))
+		})
+	})
+}
+
+// readerFunc is an io.Reader backed by a function.
+type readerFunc func(b []byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
+
+func TestAdaptiveGzipWriter(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("adaptiveGzipWriter", func() {
+		g.It("lowers the compression level as the load increases", func() {
+			cpus := float64(runtime.NumCPU())
+			z := newAdaptiveGzipWriter(io.Discard, 1, 9)
+			for load, level := range map[float64]int{0: 9, 0.5: 9, 0.75: 5, 1: 1, 2: 1} {
+				z.load = func() (float64, bool) { return load * cpus, true }
+				g.Assert(z.levelFor()).Equal(level)
+			}
+			z.load = func() (float64, bool) { return 0, false }
+			g.Assert(z.levelFor()).Equal(9)
+		})
+
+		g.It("produces a single stream when the level changes", func() {
+			var buf bytes.Buffer
+			z := newAdaptiveGzipWriter(&buf, 1, 9)
+			z.interval = 0
+			for i, load := range []float64{0, 2, 0} {
+				z.load = func() (float64, bool) { return load * float64(runtime.NumCPU()), true }
+				g.Assert(z.retune()).IsNil()
+				_, err := fmt.Fprintf(z, "part %d;", i)
+				g.Assert(err).IsNil()
+			}
+			g.Assert(z.Close()).IsNil()
+
+			r, err := pgzip.NewReader(&buf)
+			g.Assert(err).IsNil()
+			b, err := io.ReadAll(r)
+			g.Assert(err).IsNil()
+			g.Assert(string(b)).Equal("part 0;part 1;part 2;")
+		})
+	})
+}
+
+func TestGzipConcurrency(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("gzipConcurrency", func() {
+		g.AfterEach(func() {
+			config.Update(func(c *config.Configuration) {
+				c.System.Backups.MemoryBudget = 0
+			})
+		})
+
+		g.It("stays within the memory budget", func() {
+			for _, budget := range []int{1, 4, 9, 16, 64} {
+				config.Update(func(c *config.Configuration) {
+					c.System.Backups.MemoryBudget = budget
+				})
+				size, blocks := gzipConcurrency()
+				g.Assert(blocks >= 1).IsTrue()
+				g.Assert(size >= gzipMinBlockSize).IsTrue()
+				g.Assert(gzipMemory(size, blocks) <= budget*1024*1024).IsTrue()
+			}
+		})
+
+		g.It("uses the defaults without a memory budget", func() {
+			size, blocks := gzipConcurrency()
+			g.Assert(size).Equal(gzipBlockSize)
+			g.Assert(blocks).Equal(gzipBlocks)
+		})
+	})
+}
+
+func TestShardedPath(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("ShardedPath", func() {
+		g.It("nests the file in directories named after the identifier", func() {
+			g.Assert(ShardedPath("/backups", "AbCd1234-5678", ".tar.gz")).Equal("/backups/ab/cd/AbCd1234-5678.tar.gz")
+			g.Assert(ShardedPath("/backups", "ab-cd", ".tar.gz")).Equal("/backups/ab/cd/ab-cd.tar.gz")
+		})
+
+		g.It("stores short identifiers directly in the directory", func() {
+			g.Assert(ShardedPath("/backups", "abc", ".tar.gz")).Equal("/backups/abc.tar.gz")
+		})
+
+		g.It("does not allow the identifier to escape the directory", func() {
+			g.Assert(ShardedPath("/backups", "../../etc/abcdef", "")).Equal("/backups/ab/cd/abcdef")
+		})
+	})
+}
@@ -0,0 +1,67 @@
+package filesystem
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+// ErrTimeBudgetExceeded is returned when creating an archive takes longer than
+// the MaxDuration of the archive.
+var ErrTimeBudgetExceeded = errors.Sentinel("archive: exceeded the maximum duration")
+
+// withTimeBudget returns a context that is canceled once the budget has elapsed.
+// If the error pointed to by err is set once the returned cancel function is
+// called and the budget was the reason the context was canceled, the error is
+// replaced with ErrTimeBudgetExceeded.
+func withTimeBudget(ctx context.Context, budget time.Duration, err *error) (context.Context, context.CancelFunc) {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	return ctx, func() {
+		if *err != nil && parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			*err = errors.WithStack(ErrTimeBudgetExceeded)
+		}
+		cancel()
+	}
+}
+
+// errFileTimeout is returned when copying a file exceeds the file timeout.
+var errFileTimeout = errors.Sentinel("archive: timed out copying file")
+
+// copyWithTimeout copies from src to dst using the buffer, abandoning the copy if
+// it has not completed within the timeout. The reads from src are performed in
+// a separate goroutine so that a read which blocks indefinitely, such as one on
+// a hung network mount, cannot stall the caller. If the copy is abandoned that
+// goroutine is left to finish once the read eventually returns.
+func copyWithTimeout(dst io.Writer, src io.Reader, buf []byte, timeout time.Duration) (int64, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		// The buffer of the caller cannot be used here since this goroutine may
+		// outlive the call if the copy is abandoned.
+		_, err := io.CopyBuffer(pw, src, make([]byte, len(buf)))
+		pw.CloseWithError(err)
+	}()
+
+	t := time.AfterFunc(timeout, func() {
+		_ = pr.Close()
+	})
+	n, err := io.CopyBuffer(dst, pr, buf)
+	// If the timer already fired the reader was closed, causing the copy to fail.
+	if !t.Stop() && err != nil {
+		return n, errors.WithStack(errFileTimeout)
+	}
+	_ = pr.Close()
+	return n, err
+}
+
+// zeroReader is a reader that returns an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
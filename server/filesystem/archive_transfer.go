@@ -0,0 +1,137 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+
+	"emperror.dev/errors"
+)
+
+// ErrTransferInterrupted is matched by the error returned from ExtractStream when
+// the stream ends or fails before the archive has been completely received, most
+// commonly because the connection to the other node was dropped.
+var ErrTransferInterrupted = errors.Sentinel("archive: transfer interrupted")
+
+// TransferInterruptedError is returned by ExtractStream when the stream being
+// extracted is cut short. The files extracted before the interruption are left on
+// the disk, retrying the transfer overwrites them.
+type TransferInterruptedError struct {
+	// Received is the number of bytes of the stream that were received before it
+	// was interrupted.
+	Received int64
+	err      error
+}
+
+func (e *TransferInterruptedError) Error() string {
+	return fmt.Sprintf("%s after receiving %d bytes: %s", ErrTransferInterrupted.Error(), e.Received, e.err.Error())
+}
+
+func (e *TransferInterruptedError) Unwrap() error {
+	return e.err
+}
+
+func (e *TransferInterruptedError) Is(target error) bool {
+	return target == ErrTransferInterrupted
+}
+
+// ExtractStream extracts the archive read from r into the given directory as it
+// is received, pairing with Archive.Stream on the other end of a connection so
+// that a server can be moved between nodes without staging the archive on the
+// disk of either one. Any of the tar based formats supported by
+// NewDecompressingReader can be extracted, zip archives cannot be read as a
+// stream. Only regular files are written, the same as DecompressFile.
+//
+// If a progress is provided it tracks the bytes of the stream that have been
+// received. If reading from r fails, or the stream ends part way through the
+// archive, a TransferInterruptedError is returned. If the context is canceled the
+// extraction stops and the error from the context is returned.
+func (fs *Filesystem) ExtractStream(ctx context.Context, dir string, r io.Reader, progress *Progress) (err error) {
+	defer func() {
+		err = classifyArchiveError(err)
+	}()
+	sr := &streamReader{ctx: ctx, r: r}
+	var src io.Reader = sr
+	if progress != nil {
+		src = progress.Reader(sr)
+	}
+
+	err = fs.extractStream(dir, src)
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if sr.err != nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.WithStack(&TransferInterruptedError{Received: sr.n, err: err})
+	}
+	return err
+}
+
+// extractStream writes every regular file of the archive read from r into the
+// given directory, along with the hardlinks between them.
+func (fs *Filesystem) extractStream(dir string, r io.Reader) error {
+	dr, format, err := NewDecompressingReader(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	if format == FormatZip {
+		return errors.New("archive: zip archives cannot be extracted from a stream")
+	}
+
+	root, err := fs.SafePath(dir)
+	if err != nil {
+		return err
+	}
+	return walkTar(dr, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag == tar.TypeLink {
+			return wrapError(fs.restoreLink(dir, header.Name, header.Linkname), root)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		p, err := safeJoin(dir, header.Name)
+		if err != nil {
+			return wrapError(err, root)
+		}
+		// If it is ignored, just don't do anything with the file and skip over it.
+		if err := fs.IsIgnored(p); err != nil {
+			return nil
+		}
+		if err := fs.WriteRestoredFile(p, r); err != nil {
+			return err
+		}
+		if err := fs.ChmodRestored(p, header.FileInfo().Mode()); err != nil {
+			return err
+		}
+		if err := fs.RestoreACL(p, header.PAXRecords); err != nil {
+			return err
+		}
+		return fs.Chtimes(p, header.ModTime, header.ModTime)
+	})
+}
+
+// streamReader reads from the stream being extracted, counting the bytes that
+// have been received and keeping the error that reading it failed with, if any.
+// Reads fail once the context is canceled.
+type streamReader struct {
+	ctx context.Context
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	if err := sr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := sr.r.Read(p)
+	sr.n += int64(n)
+	if err != nil && err != io.EOF {
+		sr.err = err
+	}
+	return n, err
+}
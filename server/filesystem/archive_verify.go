@@ -0,0 +1,137 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/karrick/godirwalk"
+)
+
+// VerifyAgainst compares the archive at src against the files currently stored
+// under root, without creating a second archive. The Before side of a modified
+// entry is the entry in the archive and the After side is the file on the disk,
+// added entries exist only on the disk and removed entries only in the archive.
+//
+// The archive is read as a stream and every entry is compared against the file at
+// the same relative path by its type, size, link target and modification time,
+// to the second. If checksums is true the contents of regular files are hashed
+// on both sides and compared as well, which is much slower but detects changes
+// that preserved the size and modification time. Directories are not compared.
+func VerifyAgainst(src string, root string, checksums bool) (*ArchiveDiff, error) {
+	diff := &ArchiveDiff{
+		Added:    []FileEntry{},
+		Removed:  []FileEntry{},
+		Modified: []ModifiedEntry{},
+	}
+	seen := make(map[string]bool)
+	err := walkArchive(src, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag == tar.TypeDir {
+			return nil
+		}
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		seen[name] = true
+
+		p, err := safeJoin(root, name)
+		if err != nil {
+			return err
+		}
+		before := newFileEntry(header)
+		after, err := liveFileEntry(p, name, checksums && header.Typeflag == tar.TypeReg)
+		if err != nil {
+			if os.IsNotExist(err) {
+				diff.Removed = append(diff.Removed, before)
+				return nil
+			}
+			return err
+		}
+		// A hardlink entry only refers to another entry of the archive, there is
+		// nothing to compare besides the file still existing.
+		if header.Typeflag == tar.TypeLink {
+			return nil
+		}
+		if after.Checksum != "" {
+			h := sha256.New()
+			if _, err := io.Copy(h, r); err != nil {
+				return errors.WrapIff(err, "failed to read '%s' from archive", header.Name)
+			}
+			before.Checksum = hex.EncodeToString(h.Sum(nil))
+		}
+		if entryModified(before, after) || (after.Mode.IsRegular() && !sameModTime(before.ModTime, after.ModTime)) {
+			diff.Modified = append(diff.Modified, ModifiedEntry{Before: before, After: after})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.WrapIff(err, "archive: failed to read '%s'", src)
+	}
+
+	err = godirwalk.Walk(root, &godirwalk.Options{
+		Unsorted: true,
+		Callback: func(p string, de *godirwalk.Dirent) error {
+			if de.IsDir() {
+				return nil
+			}
+			name := filepath.ToSlash(strings.TrimPrefix(p, filepath.Clean(root)+string(filepath.Separator)))
+			if seen[name] {
+				return nil
+			}
+			e, err := liveFileEntry(p, name, false)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			diff.Added = append(diff.Added, e)
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, errors.WrapIff(err, "archive: failed to walk '%s'", root)
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].Name < diff.Added[j].Name })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Name < diff.Removed[j].Name })
+	sort.Slice(diff.Modified, func(i, j int) bool { return diff.Modified[i].After.Name < diff.Modified[j].After.Name })
+	return diff, nil
+}
+
+// liveFileEntry returns the FileEntry for the file at the given path on the disk,
+// hashing its contents if checksum is true. Symlinks are not followed.
+func liveFileEntry(p string, name string, checksum bool) (FileEntry, error) {
+	st, err := os.Lstat(p)
+	if err != nil {
+		return FileEntry{}, err
+	}
+	e := FileEntry{Name: name, Size: st.Size(), Mode: st.Mode(), ModTime: st.ModTime()}
+	if st.Mode()&os.ModeSymlink != 0 {
+		e.Size = 0
+		if e.Linkname, err = os.Readlink(p); err != nil {
+			return FileEntry{}, err
+		}
+	} else if !st.Mode().IsRegular() {
+		e.Size = 0
+	}
+	if checksum && st.Mode().IsRegular() {
+		if e.Checksum, err = digestFile(p); err != nil {
+			return FileEntry{}, err
+		}
+	}
+	return e, nil
+}
+
+// sameModTime returns true if the two modification times are within a second of
+// each other, since some tar formats only store the time to the second.
+func sameModTime(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d > -time.Second && d < time.Second
+}
@@ -0,0 +1,87 @@
+package filesystem
+
+import (
+	"archive/tar"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"emperror.dev/errors"
+)
+
+// virtualFile is an in-memory file that is written into an archive without
+// existing on the disk.
+type virtualFile struct {
+	name    string
+	content []byte
+	mode    fs.FileMode
+	// after is true if the file should be written once the walk has completed,
+	// rather than before it has started.
+	after bool
+}
+
+// AddVirtualFile queues an in-memory file to be written into the archive before
+// any of the files from the disk. This allows additional data, such as metadata
+// about the server or instructions for restoring the archive, to be embedded in
+// the archive without needing to stage it on the disk first. The name must be a
+// relative path within the archive.
+func (a *Archive) AddVirtualFile(name string, content []byte, mode fs.FileMode) error {
+	return a.queueVirtualFile(name, content, mode, false)
+}
+
+// AppendVirtualFile queues an in-memory file to be written into the archive once
+// all of the files from the disk have been written. See AddVirtualFile.
+func (a *Archive) AppendVirtualFile(name string, content []byte, mode fs.FileMode) error {
+	return a.queueVirtualFile(name, content, mode, true)
+}
+
+func (a *Archive) queueVirtualFile(name string, content []byte, mode fs.FileMode, after bool) error {
+	cleaned := path.Clean(strings.TrimPrefix(name, "/"))
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return errors.Errorf("archive: invalid virtual file name '%s'", name)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.virtual = append(a.virtual, virtualFile{name: cleaned, content: content, mode: mode, after: after})
+	return nil
+}
+
+// writeVirtualFiles writes all of the queued virtual files matching the given
+// position into the archive.
+func (a *Archive) writeVirtualFiles(w *tar.Writer, after bool) error {
+	a.mu.Lock()
+	files := append([]virtualFile(nil), a.virtual...)
+	a.mu.Unlock()
+
+	for _, vf := range files {
+		if vf.after != after {
+			continue
+		}
+		if err := a.writeVirtualFile(w, vf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeVirtualFile writes a single virtual file into the archive.
+func (a *Archive) writeVirtualFile(w *tar.Writer, vf virtualFile) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     vf.name,
+		Mode:     int64(vf.mode.Perm()),
+		Size:     int64(len(vf.content)),
+		ModTime:  time.Now(),
+	}
+	if err := a.writeHeader(w, header); err != nil {
+		return errors.WrapIff(err, "failed to write tar#FileInfoHeader for '%s'", vf.name)
+	}
+	if _, err := w.Write(vf.content); err != nil {
+		return errors.WrapIff(err, "failed to copy '%s' to archive", vf.name)
+	}
+	a.mu.Lock()
+	a.stats.Files++
+	a.mu.Unlock()
+	return nil
+}
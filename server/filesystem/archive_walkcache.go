@@ -0,0 +1,174 @@
+package filesystem
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+
+	"emperror.dev/errors"
+	"github.com/goccy/go-json"
+	"github.com/karrick/godirwalk"
+)
+
+// walkCacheVersion is changed whenever the format of the walk cache or the way
+// files are matched by the Files and Ignore options changes, so that caches
+// written by an older version are not used.
+const walkCacheVersion = 1
+
+// walkCacheRacyWindow is how recently a directory can have been modified before a
+// walk for the walk to not be cached. Filesystems with a coarse timestamp
+// granularity may not change the modification time of a directory that is
+// modified again within the same interval, which would go unnoticed.
+const walkCacheRacyWindow = 2 * time.Second
+
+// walkCache is the result of walking the tree of an archive, stored in the file
+// set as the WalkCache of the archive.
+type walkCache struct {
+	// Key identifies the options the files were matched with, see walkCacheKey.
+	Key string `json:"key"`
+	// Dirs is the modification time in nanoseconds of every directory that was
+	// walked, by its path relative to the BasePath.
+	Dirs map[string]int64 `json:"dirs"`
+	// Entries are the relative paths of every file matched by the options.
+	Entries []string `json:"entries"`
+}
+
+// cachedWalk walks the tree of the archive the same as walk, using the entries
+// stored in the WalkCache of the archive when they are still valid and updating
+// the cache otherwise. Any additional filters are called for every entry after
+// the Files and Ignore options have been evaluated, rather than before.
+//
+// The cache is only used when it was created with the same BasePath, Files and
+// Ignore options, and every directory that was walked to create it still exists
+// with the same modification time. Adding, removing or renaming anything within
+// a directory changes its modification time, so any change to which files exist
+// invalidates the entire cache. Changes to the contents of a file do not, but the
+// contents are read from the disk regardless. To avoid a stale cache ever leaving
+// files out of an archive a walk is not cached if any directory was modified
+// shortly before or during the walk, or if anything was skipped by the walk itself,
+// such as a directory that could not be read due to its permissions.
+func (a *Archive) cachedWalk(add func(path string, relative string) error, filters ...func(path string, relative string) error) error {
+	key := a.walkCacheKey()
+	if c, err := readWalkCache(a.WalkCache); err == nil && c.Key == key && c.valid(a.BasePath) {
+		for _, rp := range c.Entries {
+			if err := a.addFiltered(filepath.Join(a.BasePath, filepath.FromSlash(rp)), rp, add, filters); err != nil {
+				return err
+			}
+		}
+		return nil
+	} else if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		a.log().WithField("path", a.WalkCache).WithField("error", err).Warn("failed to read archive walk cache; walking the tree...")
+	}
+
+	start := time.Now()
+	c := &walkCache{Key: key, Dirs: make(map[string]int64)}
+	racy := false
+	a.onDir = func(p string, st os.FileInfo) {
+		rp := "."
+		if p != a.BasePath {
+			rp = a.relative(p)
+		}
+		c.Dirs[rp] = st.ModTime().UnixNano()
+		if st.ModTime().After(start.Add(-walkCacheRacyWindow)) {
+			racy = true
+		}
+	}
+	defer func() { a.onDir = nil }()
+
+	a.mu.Lock()
+	skipped := len(a.stats.Skipped)
+	a.mu.Unlock()
+	err := a.walkTree(func(p string, rp string) error {
+		c.Entries = append(c.Entries, rp)
+		return a.addFiltered(p, rp, add, filters)
+	})
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	for _, s := range a.stats.Skipped[skipped:] {
+		if s.Reason == SkipReasonPermission || s.Reason == SkipReasonCircularSymlink {
+			racy = true
+		}
+	}
+	a.mu.Unlock()
+	if racy {
+		// Remove any previous cache so that it is not used once the tree settles back
+		// into the state it was created for.
+		_ = os.Remove(a.WalkCache)
+		return nil
+	}
+	if err := writeWalkCache(a.WalkCache, c); err != nil {
+		a.log().WithField("path", a.WalkCache).WithField("error", err).Warn("failed to write archive walk cache")
+	}
+	return nil
+}
+
+// addFiltered calls the filters for the given file, and then add unless one of
+// them skips the file.
+func (a *Archive) addFiltered(p string, rp string, add func(path string, relative string) error, filters []func(path string, relative string) error) error {
+	for _, f := range filters {
+		if err := f(p, rp); err != nil {
+			if errors.Is(err, godirwalk.SkipThis) {
+				return nil
+			}
+			return err
+		}
+	}
+	return add(p, rp)
+}
+
+// walkCacheKey returns the key identifying the options that the files of the
+// archive are matched with.
+func (a *Archive) walkCacheKey() string {
+	h := sha256.New()
+	h.Write([]byte{walkCacheVersion})
+	for _, v := range append([]string{a.BasePath, a.ignorePatterns()}, a.Files...) {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// valid returns true if every directory of the cache still exists under root
+// with the same modification time.
+func (c *walkCache) valid(root string) bool {
+	if len(c.Dirs) == 0 {
+		return false
+	}
+	for rp, mtime := range c.Dirs {
+		st, err := os.Stat(filepath.Join(root, filepath.FromSlash(rp)))
+		if err != nil || !st.IsDir() || st.ModTime().UnixNano() != mtime {
+			return false
+		}
+	}
+	return true
+}
+
+// readWalkCache reads the walk cache stored at the given path.
+func readWalkCache(p string) (*walkCache, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var c walkCache
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, errors.WrapIf(err, "archive: failed to parse walk cache")
+	}
+	return &c, nil
+}
+
+// writeWalkCache writes the walk cache to the given path.
+func writeWalkCache(p string, c *walkCache) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.WriteFile(p, b, 0o600); err != nil {
+		return errors.WrapIf(err, "archive: failed to write walk cache")
+	}
+	return nil
+}
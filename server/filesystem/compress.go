@@ -5,6 +5,7 @@ import (
 	"archive/zip"
 	"compress/gzip"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -17,6 +18,7 @@ import (
 	zip2 "github.com/klauspost/compress/zip"
 
 	"emperror.dev/errors"
+	"github.com/apex/log"
 	"github.com/mholt/archiver/v3"
 )
 
@@ -91,27 +93,51 @@ func (fs *Filesystem) SpaceAvailableForDecompression(dir string, file string) er
 
 	var size int64
 	// Walk over the archive and figure out just how large the final output would be from unarchiving it.
-	err = archiver.Walk(source, func(f archiver.File) error {
-		if atomic.AddInt64(&size, f.Size())+dirSize > fs.MaxDisk() {
+	return walkDecompressible(source, func(header *tar.Header, _ io.Reader) error {
+		if atomic.AddInt64(&size, header.Size)+dirSize > fs.MaxDisk() {
 			return newFilesystemError(ErrCodeDiskSpace, nil)
 		}
 		return nil
 	})
-	if err != nil {
-		if IsUnknownArchiveFormatError(err) {
-			return newFilesystemError(ErrCodeUnknownArchive, err)
-		}
+}
+
+// walkDecompressible calls fn for every entry of the archive at source. The format
+// of any archive supported by NewDecompressingReader is detected from its contents
+// rather than its extension, so a renamed archive can still be read. Any other
+// format supported by the archiver library, such as rar, is walked using it with
+// the entries converted into tar headers.
+func walkDecompressible(source string, fn func(header *tar.Header, r io.Reader) error) error {
+	if _, _, err := DetectFormat(source); err == nil {
+		return walkArchive(source, fn)
+	} else if !IsErrorCode(err, ErrCodeUnknownArchive) {
 		return err
 	}
+	err := archiver.Walk(source, func(f archiver.File) error {
+		header, ok := f.Sys().(*tar.Header)
+		if !ok {
+			var err error
+			if header, err = tar.FileInfoHeader(f, ""); err != nil {
+				return errors.WithStack(err)
+			}
+			header.Name = ExtractNameFromArchive(f)
+		}
+		return fn(header, f)
+	})
+	if err != nil && IsUnknownArchiveFormatError(err) {
+		return newFilesystemError(ErrCodeUnknownArchive, err)
+	}
 	return err
 }
 
-// DecompressFile will decompress a file in a given directory by using the
-// archiver tool to infer the file type and go from there. This will walk over
+// DecompressFile will decompress a file in a given directory, detecting the
+// format of the archive from its contents, see walkDecompressible. This will walk over
 // all of the files within the given archive and ensure that there is not a
 // zip-slip attack being attempted by validating that the final path is within
 // the server data directory.
-func (fs *Filesystem) DecompressFile(dir string, file string) error {
+func (fs *Filesystem) DecompressFile(dir string, file string) (err error) {
+	defer func() {
+		err = classifyArchiveError(err)
+	}()
 	source, err := fs.SafePath(filepath.Join(dir, file))
 	if err != nil {
 		return err
@@ -121,38 +147,127 @@ func (fs *Filesystem) DecompressFile(dir string, file string) error {
 		return errors.WithStack(err)
 	}
 
-	// Walk all of the files in the archiver file and write them to the disk. If any
-	// directory is encountered it will be skipped since we handle creating any missing
-	// directories automatically when writing files.
-	err = archiver.Walk(source, func(f archiver.File) error {
-		if f.IsDir() {
+	// Walk all of the files in the archive and write them to the disk. Only regular
+	// files and the hardlinks between them are written, any directory is skipped since
+	// we handle creating any missing directories automatically when writing files.
+	return walkDecompressible(source, func(header *tar.Header, r io.Reader) error {
+		switch header.Typeflag {
+		case tar.TypeLink:
+			return wrapError(fs.restoreLink(dir, header.Name, header.Linkname), source)
+		case tar.TypeReg, tar.TypeGNUSparse:
+		default:
 			return nil
 		}
-		p := filepath.Join(dir, ExtractNameFromArchive(f))
+		p, err := safeJoin(dir, header.Name)
+		if err != nil {
+			return wrapError(err, source)
+		}
 		// If it is ignored, just don't do anything with the file and skip over it.
 		if err := fs.IsIgnored(p); err != nil {
 			return nil
 		}
-		if err := fs.Writefile(p, f); err != nil {
+		write := fs.WriteRestoredFile
+		if isSparseHeader(header) {
+			write = fs.WriteRestoredSparseFile
+		}
+		if err := write(p, r); err != nil {
 			return wrapError(err, source)
 		}
 		// Update the file permissions to the one set in the archive.
-		if err := fs.Chmod(p, f.Mode()); err != nil {
+		if err := fs.ChmodRestored(p, header.FileInfo().Mode()); err != nil {
+			return wrapError(err, source)
+		}
+		if err := fs.RestoreACL(p, header.PAXRecords); err != nil {
 			return wrapError(err, source)
 		}
 		// Update the file modification time to the one set in the archive.
-		if err := fs.Chtimes(p, f.ModTime(), f.ModTime()); err != nil {
+		if err := fs.Chtimes(p, header.ModTime, header.ModTime); err != nil {
 			return wrapError(err, source)
 		}
 		return nil
 	})
+}
+
+// DecompressFileLenient decompresses a file in the given directory the same as
+// DecompressFile, except that entries which cannot be read because the archive is
+// corrupt are skipped rather than aborting the extraction, so that as much as
+// possible is recovered from a damaged archive. The entries that could not be
+// recovered are logged and returned, any partially written file is removed.
+//
+// Only tar based archives can be read leniently, see walkArchiveLenient. Only
+// regular files, and the hardlinks between them, are extracted.
+func (fs *Filesystem) DecompressFileLenient(dir string, file string) (_ []CorruptEntry, err error) {
+	defer func() {
+		err = classifyArchiveError(err)
+	}()
+	source, err := fs.SafePath(filepath.Join(dir, file))
 	if err != nil {
-		if IsUnknownArchiveFormatError(err) {
-			return newFilesystemError(ErrCodeUnknownArchive, err)
+		return nil, err
+	}
+	// Ensure that the source archive actually exists on the system.
+	if _, err := os.Stat(source); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	corrupt, err := walkArchiveLenient(source, func(header *tar.Header, r io.Reader) error {
+		// A link to a file that could not be recovered cannot be restored either.
+		if header.Typeflag == tar.TypeLink {
+			if err := fs.restoreLink(dir, header.Name, header.Linkname); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return wrapError(err, source)
+			}
+			return nil
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
 		}
+		p, err := safeJoin(dir, header.Name)
+		if err != nil {
+			return wrapError(err, source)
+		}
+		// If it is ignored, just don't do anything with the file and skip over it.
+		if err := fs.IsIgnored(p); err != nil {
+			return nil
+		}
+		if err := fs.WriteRestoredFile(p, r); err != nil {
+			if isCorruptRead(err) {
+				_ = fs.Delete(p)
+				return err
+			}
+			return wrapError(err, source)
+		}
+		if err := fs.ChmodRestored(p, header.FileInfo().Mode()); err != nil {
+			return wrapError(err, source)
+		}
+		if err := fs.RestoreACL(p, header.PAXRecords); err != nil {
+			return wrapError(err, source)
+		}
+		return fs.Chtimes(p, header.ModTime, header.ModTime)
+	})
+	if err != nil {
+		return nil, wrapError(err, source)
+	}
+	for _, e := range corrupt {
+		log.WithField("archive", source).WithField("entry", e.Name).WithField("offset", e.Offset).WithField("error", e.Error).Warn("failed to recover entry from corrupt archive; skipping...")
+	}
+	return corrupt, nil
+}
+
+// restoreLink restores an entry that is stored as a hardlink to an earlier entry
+// of the archive being extracted into dir. Nothing is done if either of them is
+// ignored.
+func (fs *Filesystem) restoreLink(dir string, name string, linkname string) error {
+	p, err := safeJoin(dir, name)
+	if err != nil {
+		return err
+	}
+	target, err := safeJoin(dir, linkname)
+	if err != nil {
 		return err
 	}
-	return nil
+	if fs.IsIgnored(p) != nil || fs.IsIgnored(target) != nil {
+		return nil
+	}
+	return fs.LinkRestoredFile(target, p)
 }
 
 // ExtractNameFromArchive looks at an archive file to try and determine the name
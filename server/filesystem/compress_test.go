@@ -1,11 +1,24 @@
 package filesystem
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 
+	"emperror.dev/errors"
 	. "github.com/franela/goblin"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+
+	"github.com/pterodactyl/wings/config"
 )
 
 // Given an archive named test.{ext}, with the following file structure:
@@ -45,6 +58,366 @@ func TestFilesystem_DecompressFile(t *testing.T) {
 			})
 		}
 
+		g.It("detects the format of an archive regardless of its extension", func() {
+			var gz bytes.Buffer
+			g.Assert(BuildArchive(&gz, map[string]FileSpec{"renamed/test.txt": {Content: []byte("hello")}})).IsNil()
+			gr, err := pgzip.NewReader(&gz)
+			g.Assert(err).IsNil()
+			var zst bytes.Buffer
+			zw, err := zstd.NewWriter(&zst)
+			g.Assert(err).IsNil()
+			_, err = io.Copy(zw, gr)
+			g.Assert(err).IsNil()
+			g.Assert(zw.Close()).IsNil()
+
+			g.Assert(rfs.CreateServerFile("renamed.tar.gz", zst.Bytes())).IsNil()
+			atomic.StoreInt64(&fs.diskLimit, 1024*1024)
+			defer atomic.StoreInt64(&fs.diskLimit, 0)
+			g.Assert(fs.SpaceAvailableForDecompression("/", "renamed.tar.gz")).IsNil()
+			g.Assert(fs.DecompressFile("/", "renamed.tar.gz")).IsNil()
+
+			b, err := os.ReadFile(filepath.Join(fs.Path(), "renamed/test.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(string(b)).Equal("hello")
+		})
+
+		g.It("preserves empty files and symlinks to them", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "empty/nested"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("empty/empty.txt", "")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("empty/nested/empty.txt", "")).IsNil()
+			g.Assert(os.Symlink("../empty.txt", filepath.Join(fs.Path(), "empty/nested/link"))).IsNil()
+
+			dst := filepath.Join(rfs.root, "empty.tar.gz")
+			g.Assert((&Archive{BasePath: fs.Path(), Files: []string{filepath.Join(fs.Path(), "empty")}}).Create(dst)).IsNil()
+
+			headers, err := readArchiveHeaders(dst)
+			g.Assert(err).IsNil()
+			g.Assert(len(headers)).Equal(3)
+			for _, name := range []string{"empty/empty.txt", "empty/nested/empty.txt"} {
+				g.Assert(headers[name]).IsNotNil()
+				g.Assert(headers[name].Typeflag).Equal(byte(tar.TypeReg))
+				g.Assert(headers[name].Size).Equal(int64(0))
+			}
+			g.Assert(headers["empty/nested/link"]).IsNotNil()
+			g.Assert(headers["empty/nested/link"].Typeflag).Equal(byte(tar.TypeSymlink))
+			g.Assert(headers["empty/nested/link"].Linkname).Equal("../empty.txt")
+
+			rfs.reset()
+			c, err := os.ReadFile(dst)
+			g.Assert(err).IsNil()
+			g.Assert(rfs.CreateServerFile("empty.tar.gz", c)).IsNil()
+			g.Assert(fs.DecompressFile("/", "empty.tar.gz")).IsNil()
+
+			for _, name := range []string{"empty/empty.txt", "empty/nested/empty.txt"} {
+				st, err := rfs.StatServerFile(name)
+				g.Assert(err).IsNil()
+				g.Assert(st.Mode().IsRegular()).IsTrue()
+				g.Assert(st.Size()).Equal(int64(0))
+			}
+		})
+
+		g.It("recovers the readable files from a corrupt archive", func() {
+			contents := map[string]string{
+				"corrupt/first.txt":  strings.Repeat("first", 1024),
+				"corrupt/second.txt": strings.Repeat("second", 1024),
+				"corrupt/third.txt":  strings.Repeat("third", 1024),
+			}
+			for _, name := range []string{"corrupt.tar.gz", "corrupt.tar"} {
+				g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "corrupt"), 0o755)).IsNil()
+				for f, c := range contents {
+					g.Assert(rfs.CreateServerFileFromString(f, c)).IsNil()
+				}
+				dst := filepath.Join(rfs.root, name)
+				a := &Archive{BasePath: fs.Path(), Files: []string{filepath.Join(fs.Path(), "corrupt")}, WriteIndex: true}
+				if name == "corrupt.tar" {
+					a.MinCompressSize = 1 << 30
+				}
+				g.Assert(a.Create(dst)).IsNil()
+
+				// Damage the second entry, for the compressed archive this is the
+				// middle of its compressed data and for the tarball its headers.
+				idx, err := ReadArchiveIndex(dst)
+				g.Assert(err).IsNil()
+				e, ok := idx.Lookup("corrupt/second.txt")
+				g.Assert(ok).IsTrue()
+				b, err := os.ReadFile(dst)
+				g.Assert(err).IsNil()
+				at, n := e.Offset+20, int64(16)
+				if name == "corrupt.tar" {
+					at, n = e.Offset, 3*blockSize
+				}
+				for i := at; i < at+n; i++ {
+					b[i] ^= 0xff
+				}
+
+				g.Assert(rfs.CreateServerFile(name, b)).IsNil()
+				g.Assert(os.RemoveAll(filepath.Join(fs.Path(), "corrupt"))).IsNil()
+
+				corrupt, err := fs.DecompressFileLenient("/", name)
+				g.Assert(err).IsNil()
+				g.Assert(len(corrupt)).Equal(1)
+
+				for _, f := range []string{"corrupt/first.txt", "corrupt/third.txt"} {
+					c, err := os.ReadFile(filepath.Join(fs.Path(), f))
+					g.Assert(err).IsNil()
+					g.Assert(string(c)).Equal(contents[f])
+				}
+				_, err = rfs.StatServerFile("corrupt/second.txt")
+				g.Assert(os.IsNotExist(err)).IsTrue()
+
+				g.Assert(fs.DecompressFile("/", name)).IsNotNil()
+			}
+		})
+
+		g.It("extracts an archive as it is streamed", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "source/nested"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("source/first.txt", strings.Repeat("first", 1024))).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("source/nested/second.txt", "second")).IsNil()
+
+			a := &Archive{BasePath: filepath.Join(fs.Path(), "source"), Progress: NewProgress(0)}
+			pr, pw := io.Pipe()
+			var sent int64
+			go func() {
+				pw.CloseWithError(a.Stream(context.Background(), &countingWriter{n: &sent, w: pw}))
+			}()
+			received := NewProgress(0)
+			g.Assert(fs.ExtractStream(context.Background(), "/moved", pr, received)).IsNil()
+			g.Assert(a.Progress.Written() > 0).IsTrue()
+			g.Assert(received.Written()).Equal(atomic.LoadInt64(&sent))
+
+			c, err := os.ReadFile(filepath.Join(fs.Path(), "moved/first.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(string(c)).Equal(strings.Repeat("first", 1024))
+			c, err = os.ReadFile(filepath.Join(fs.Path(), "moved/nested/second.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(string(c)).Equal("second")
+		})
+
+		g.It("reports a stream that is cut short as interrupted", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "source"), 0o755)).IsNil()
+			b := make([]byte, 64*1024)
+			_, _ = rand.Read(b)
+			g.Assert(rfs.CreateServerFile("source/random.bin", b)).IsNil()
+
+			var buf bytes.Buffer
+			g.Assert((&Archive{BasePath: filepath.Join(fs.Path(), "source")}).Stream(context.Background(), &buf)).IsNil()
+			half := buf.Bytes()[:buf.Len()/2]
+
+			for _, r := range []io.Reader{
+				bytes.NewReader(half),
+				io.MultiReader(bytes.NewReader(half), iotest.ErrReader(errors.New("connection reset by peer"))),
+			} {
+				err := fs.ExtractStream(context.Background(), "/moved", r, nil)
+				g.Assert(errors.Is(err, ErrTransferInterrupted)).IsTrue()
+				var terr *TransferInterruptedError
+				g.Assert(errors.As(err, &terr)).IsTrue()
+				g.Assert(terr.Received).Equal(int64(len(half)))
+			}
+		})
+
+		g.It("expands an archive into a directory", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "expand/nested"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("expand/first.txt", "first")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("expand/nested/second.txt", "second")).IsNil()
+			g.Assert(os.Chmod(filepath.Join(fs.Path(), "expand/nested/second.txt"), 0o600)).IsNil()
+			src := filepath.Join(rfs.root, "expand.tar.gz")
+			g.Assert((&Archive{BasePath: filepath.Join(fs.Path(), "expand")}).Create(src)).IsNil()
+
+			dst := filepath.Join(rfs.root, "expanded/backup")
+			progress := NewProgress(0)
+			counts, err := ExtractToDir(src, dst, progress, ExtractOptions{})
+			g.Assert(err).IsNil()
+			g.Assert(counts).Equal(RestoreCounts{Written: 2})
+			g.Assert(progress.Written()).Equal(int64(len("first") + len("second")))
+			c, err := os.ReadFile(filepath.Join(dst, "nested/second.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(string(c)).Equal("second")
+			st, err := os.Stat(filepath.Join(dst, "nested/second.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(st.Mode().Perm()).Equal(os.FileMode(0o600))
+
+			g.Assert(os.WriteFile(filepath.Join(dst, "first.txt"), []byte("changed"), 0o644)).IsNil()
+			counts, err = ExtractToDir(src, dst, nil, ExtractOptions{Policy: ConflictSkip})
+			g.Assert(err).IsNil()
+			g.Assert(counts).Equal(RestoreCounts{Kept: 2})
+			c, err = os.ReadFile(filepath.Join(dst, "first.txt"))
+			g.Assert(err).IsNil()
+			g.Assert(string(c)).Equal("changed")
+
+			// A directory within the destination that points outside of it.
+			outside := filepath.Join(rfs.root, "outside")
+			g.Assert(os.MkdirAll(outside, 0o755)).IsNil()
+			g.Assert(os.RemoveAll(filepath.Join(dst, "nested"))).IsNil()
+			g.Assert(os.Symlink(outside, filepath.Join(dst, "nested"))).IsNil()
+			_, err = ExtractToDir(src, dst, nil, ExtractOptions{})
+			g.Assert(errors.Is(err, ErrPathTraversal)).IsTrue()
+			_, err = os.Stat(filepath.Join(outside, "second.txt"))
+			g.Assert(os.IsNotExist(err)).IsTrue()
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			g.Assert(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "../escape.txt", Mode: 0o644})).IsNil()
+			g.Assert(tw.Close()).IsNil()
+			escape := filepath.Join(rfs.root, "escape.tar")
+			g.Assert(os.WriteFile(escape, buf.Bytes(), 0o644)).IsNil()
+			_, err = ExtractToDir(escape, dst, nil, ExtractOptions{})
+			g.Assert(errors.Is(err, ErrPathTraversal)).IsTrue()
+		})
+
+		g.It("verifies the checksum of an archive before expanding it", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "verify"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("verify/test.txt", "hello")).IsNil()
+			src := filepath.Join(rfs.root, "verify.tar.gz")
+			g.Assert((&Archive{BasePath: filepath.Join(fs.Path(), "verify"), WriteMeta: true}).Create(src)).IsNil()
+			meta, err := ReadArchiveMeta(src)
+			g.Assert(err).IsNil()
+
+			dst := filepath.Join(rfs.root, "verified")
+			counts, err := ExtractToDir(src, dst, nil, ExtractOptions{ExpectedChecksum: meta.Checksum})
+			g.Assert(err).IsNil()
+			g.Assert(counts).Equal(RestoreCounts{Written: 1})
+
+			dst = filepath.Join(rfs.root, "unverified")
+			_, err = ExtractToDir(src, dst, nil, ExtractOptions{ExpectedChecksum: strings.Repeat("0", 40)})
+			g.Assert(errors.Is(err, ErrChecksumMismatch)).IsTrue()
+			var cerr *ArchiveChecksumError
+			g.Assert(errors.As(err, &cerr)).IsTrue()
+			g.Assert(cerr.Actual).Equal(meta.Checksum)
+			// Nothing is written when the checksum does not match.
+			_, err = os.Stat(dst)
+			g.Assert(os.IsNotExist(err)).IsTrue()
+
+			_, err = ExtractToDir(src, dst, nil, ExtractOptions{ExpectedChecksum: meta.Checksum, ChecksumType: "md5"})
+			g.Assert(err == nil).IsFalse()
+		})
+
+		g.It("expands only the metadata of an archive", func() {
+			var buf bytes.Buffer
+			g.Assert(BuildArchive(&buf, map[string]FileSpec{
+				"data":             {Mode: os.ModeDir | 0o750},
+				"data/config.yml":  {Content: []byte("key: value"), Mode: 0o600},
+				"data/empty":       {Mode: os.ModeDir},
+				"data/current.yml": {SymlinkTarget: "config.yml"},
+			})).IsNil()
+			src := filepath.Join(rfs.root, "metadata.tar.gz")
+			g.Assert(os.WriteFile(src, buf.Bytes(), 0o644)).IsNil()
+
+			dst := filepath.Join(rfs.root, "metadata")
+			counts, err := ExtractToDir(src, dst, nil, ExtractOptions{MetadataOnly: true})
+			g.Assert(err).IsNil()
+			g.Assert(counts).Equal(RestoreCounts{Created: 4})
+			st, err := os.Stat(filepath.Join(dst, "data"))
+			g.Assert(err).IsNil()
+			g.Assert(st.Mode().Perm()).Equal(os.FileMode(0o750))
+			st, err = os.Stat(filepath.Join(dst, "data/config.yml"))
+			g.Assert(err).IsNil()
+			g.Assert(st.Size()).Equal(int64(0))
+			g.Assert(st.Mode().Perm()).Equal(os.FileMode(0o600))
+			target, err := os.Readlink(filepath.Join(dst, "data/current.yml"))
+			g.Assert(err).IsNil()
+			g.Assert(target).Equal("config.yml")
+
+			// Existing files keep their contents but have their mode restored.
+			g.Assert(os.WriteFile(filepath.Join(dst, "data/config.yml"), []byte("changed"), 0o644)).IsNil()
+			g.Assert(os.Chmod(filepath.Join(dst, "data/config.yml"), 0o644)).IsNil()
+			counts, err = ExtractToDir(src, dst, nil, ExtractOptions{MetadataOnly: true})
+			g.Assert(err).IsNil()
+			g.Assert(counts).Equal(RestoreCounts{Created: 1})
+			c, err := os.ReadFile(filepath.Join(dst, "data/config.yml"))
+			g.Assert(err).IsNil()
+			g.Assert(string(c)).Equal("changed")
+			st, err = os.Stat(filepath.Join(dst, "data/config.yml"))
+			g.Assert(err).IsNil()
+			g.Assert(st.Mode().Perm()).Equal(os.FileMode(0o600))
+
+			_, err = ExtractToDir(src, dst, nil, ExtractOptions{MetadataOnly: true, Verify: true})
+			g.Assert(err == nil).IsFalse()
+		})
+
+		g.It("verifies the expanded files match the archive", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "match/nested"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("match/first.txt", "first")).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("match/nested/second.txt", "second")).IsNil()
+			base := filepath.Join(fs.Path(), "match")
+
+			for name, a := range map[string]*Archive{
+				"match_manifest.tar.gz": {BasePath: base, WriteRestoreManifest: true},
+				"match_index.tar.gz":    {BasePath: base, WriteIndex: true},
+				"match_plain.tar.gz":    {BasePath: base},
+			} {
+				src := filepath.Join(rfs.root, name)
+				g.Assert(a.Create(src)).IsNil()
+				dst := filepath.Join(rfs.root, "matched", name)
+				_, err := ExtractToDir(src, dst, nil, ExtractOptions{Verify: true})
+				g.Assert(err).IsNil()
+
+				// Files kept due to the conflict policy were not restored.
+				g.Assert(os.Remove(filepath.Join(dst, "first.txt"))).IsNil()
+				_, err = ExtractToDir(src, dst, nil, ExtractOptions{Verify: true, Policy: ConflictSkip})
+				g.Assert(errors.Is(err, ErrRestoreMismatch)).IsTrue()
+				var merr *RestoreMismatchError
+				g.Assert(errors.As(err, &merr)).IsTrue()
+				g.Assert(merr.Written).Equal(1)
+				if name != "match_plain.tar.gz" {
+					g.Assert(merr.Missing).Equal([]string{"nested/second.txt"})
+				}
+			}
+		})
+
+		g.It("verifies the hardlinks of a deduplicated archive", func() {
+			g.Assert(os.MkdirAll(filepath.Join(fs.Path(), "linked"), 0o755)).IsNil()
+			g.Assert(rfs.CreateServerFileFromString("linked/first.txt", "first")).IsNil()
+			g.Assert(os.Link(filepath.Join(fs.Path(), "linked/first.txt"), filepath.Join(fs.Path(), "linked/second.txt"))).IsNil()
+			base := filepath.Join(fs.Path(), "linked")
+
+			for name, a := range map[string]*Archive{
+				"linked_manifest.tar.gz": {BasePath: base, DeduplicateHardlinks: true, WriteRestoreManifest: true},
+				"linked_index.tar.gz":    {BasePath: base, DeduplicateHardlinks: true, WriteIndex: true},
+			} {
+				src := filepath.Join(rfs.root, name)
+				g.Assert(a.Create(src)).IsNil()
+				dst := filepath.Join(rfs.root, "linked", name)
+				_, err := ExtractToDir(src, dst, nil, ExtractOptions{Verify: true})
+				g.Assert(err).IsNil()
+				first, err := os.Stat(filepath.Join(dst, "first.txt"))
+				g.Assert(err).IsNil()
+				second, err := os.Stat(filepath.Join(dst, "second.txt"))
+				g.Assert(err).IsNil()
+				g.Assert(os.SameFile(first, second)).IsTrue()
+			}
+		})
+
+		g.It("rejects entries with excessively nested or long paths", func() {
+			defer config.Update(func(c *config.Configuration) {
+				c.System.Backups.RestoreMaxPathDepth = 0
+				c.System.Backups.RestoreMaxPathLength = 0
+			})
+			config.Update(func(c *config.Configuration) {
+				c.System.Backups.RestoreMaxPathDepth = 8
+				c.System.Backups.RestoreMaxPathLength = 64
+			})
+
+			for name, ok := range map[string]bool{
+				strings.Repeat("a/", 6) + "f":  true,
+				strings.Repeat("a/", 8) + "f":  false,
+				strings.Repeat("a", 64) + "/f": false,
+			} {
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				g.Assert(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: 4})).IsNil()
+				_, err := tw.Write([]byte("test"))
+				g.Assert(err).IsNil()
+				g.Assert(tw.Close()).IsNil()
+
+				err = fs.ExtractStream(context.Background(), "/nested", &buf, nil)
+				if ok {
+					g.Assert(err).IsNil()
+				} else {
+					g.Assert(IsErrorCode(err, ErrCodePathLimit)).IsTrue(name)
+				}
+			}
+		})
+
 		g.AfterEach(func() {
 			rfs.reset()
 			atomic.StoreInt64(&fs.diskUsed, 0)
@@ -1,6 +1,7 @@
 package filesystem
 
 import (
+	"os"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -211,6 +212,28 @@ func (fs *Filesystem) HasSpaceFor(size int64) error {
 	return nil
 }
 
+// HasSpaceForRestore returns an ErrNotEnoughSpace error if the contents of the
+// archive at the given path could not fit within the disk limit of the server,
+// even if every file currently on the disk were replaced by it. This relies on the
+// uncompressed size recorded in the metadata of the archive, if the archive has
+// no metadata or the size was not recorded no error is returned.
+func (fs *Filesystem) HasSpaceForRestore(p string) error {
+	if fs.MaxDisk() == 0 {
+		return nil
+	}
+	meta, err := ReadArchiveMeta(p)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil
+		}
+		return err
+	}
+	if meta.UncompressedSize > fs.MaxDisk() {
+		return newFilesystemError(ErrCodeDiskSpace, nil)
+	}
+	return nil
+}
+
 // Updates the disk usage for the Filesystem instance.
 func (fs *Filesystem) addDisk(i int64) int64 {
 	size := atomic.LoadInt64(&fs.diskUsed)
@@ -18,6 +18,7 @@ const (
 	ErrCodeUnknownArchive ErrorCode = "E_UNKNFMT"
 	ErrCodePathResolution ErrorCode = "E_BADPATH"
 	ErrCodeDenylistFile   ErrorCode = "E_DENYLIST"
+	ErrCodePathLimit      ErrorCode = "E_PATHLIMIT"
 	ErrCodeUnknownError   ErrorCode = "E_UNKNOWN"
 )
 
@@ -63,6 +64,8 @@ func (e *Error) Error() string {
 			r = "<empty>"
 		}
 		return fmt.Sprintf("filesystem: file access prohibited: [%s] is on the denylist", r)
+	case ErrCodePathLimit:
+		return fmt.Sprintf("filesystem: path [%s] exceeds the maximum depth or length allowed for restored files", e.path)
 	case ErrCodePathResolution:
 		r := e.resolved
 		if r == "" {
@@ -136,6 +139,12 @@ func NewBadPathResolution(path string, resolved string) error {
 	return errors.WithStackDepth(&Error{code: ErrCodePathResolution, path: path, resolved: resolved}, 1)
 }
 
+// NewPathLimitError returns a new error for a path that is too deeply nested or
+// too long to be restored.
+func NewPathLimitError(path string) error {
+	return errors.WithStackDepth(&Error{code: ErrCodePathLimit, path: path}, 1)
+}
+
 // wrapError wraps the provided error as a Filesystem error and attaches the
 // provided resolved source to it. If the error is already a Filesystem error
 // no action is taken.
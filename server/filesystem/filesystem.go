@@ -16,6 +16,7 @@ import (
 
 	"emperror.dev/errors"
 	"github.com/gabriel-vasile/mimetype"
+	"github.com/juju/ratelimit"
 	"github.com/karrick/godirwalk"
 	ignore "github.com/sabhiram/go-gitignore"
 
@@ -119,6 +120,157 @@ func (fs *Filesystem) Touch(p string, flag int) (*os.File, error) {
 // will be created. This will also properly recalculate the disk space used by
 // the server when writing new files or modifying existing ones.
 func (fs *Filesystem) Writefile(p string, r io.Reader) error {
+	return fs.writefile(p, r, 0, false)
+}
+
+// WriteRestoredFile writes a file that is being extracted from a backup or an
+// archive to the system. This behaves the same as Writefile, except that the
+// write speed is limited by the RestoreRateLimit configuration option and paths
+// exceeding the RestoreMaxPathDepth or RestoreMaxPathLength options are rejected
+// with an ErrCodePathLimit error.
+func (fs *Filesystem) WriteRestoredFile(p string, r io.Reader) error {
+	if err := checkRestoredPath(p); err != nil {
+		return err
+	}
+	return fs.writefile(p, r, int64(config.Get().System.Backups.RestoreRateLimit*1024*1024), false)
+}
+
+// WriteRestoredSparseFile writes a sparse file that is being extracted from a
+// backup or an archive the same as WriteRestoredFile, except that every block of
+// the file containing only zeros is left as a hole rather than being written, so
+// that the file takes up no more space on the disk than it did when archived. See
+// SparseRecords.
+func (fs *Filesystem) WriteRestoredSparseFile(p string, r io.Reader) error {
+	if err := checkRestoredPath(p); err != nil {
+		return err
+	}
+	return fs.writefile(p, r, int64(config.Get().System.Backups.RestoreRateLimit*1024*1024), true)
+}
+
+// LinkRestoredFile creates the file at p, which is being extracted from a backup
+// or an archive, as a hardlink to the already restored file at target. This is
+// used for the entries that an archive stores as links to an earlier entry since
+// the files were hardlinked when archived, see Archive.DeduplicateHardlinks. An
+// existing file at p is replaced.
+func (fs *Filesystem) LinkRestoredFile(target string, p string) error {
+	if err := checkRestoredPath(p); err != nil {
+		return err
+	}
+	cleaned, err := fs.SafePath(p)
+	if err != nil {
+		return err
+	}
+	source, err := fs.SafePath(target)
+	if err != nil {
+		return err
+	}
+	st, err := os.Lstat(cleaned)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "server/filesystem: link: failed to stat file")
+	} else if err == nil {
+		if st.IsDir() {
+			return errors.WithStack(&Error{code: ErrCodeIsDirectory, resolved: cleaned})
+		}
+		if err := os.Remove(cleaned); err != nil {
+			return errors.WithStack(err)
+		}
+		if st.Mode().IsRegular() {
+			fs.addDisk(-st.Size())
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(cleaned), 0o755); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Link(source, cleaned))
+}
+
+// ConflictPolicy determines what happens when a file being restored from a backup
+// already exists on the disk.
+type ConflictPolicy string
+
+const (
+	// ConflictOverwrite always replaces an existing file with the restored file.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// ConflictNewerWins keeps an existing file that was modified more recently than
+	// the file being restored, so that recent changes are not lost when merging a
+	// backup into the existing files.
+	ConflictNewerWins ConflictPolicy = "newer_wins"
+	// ConflictSkip always keeps an existing file, only files that do not exist yet
+	// are restored.
+	ConflictSkip ConflictPolicy = "skip"
+)
+
+// RestoreCounts is the number of files that were written and kept when restoring
+// files using a ConflictPolicy.
+type RestoreCounts struct {
+	Written int `json:"written"`
+	Kept    int `json:"kept"`
+	// Created is the number of directories, empty files and symlinks created when
+	// extracting only the metadata of an archive, see ExtractOptions.MetadataOnly.
+	Created int `json:"created,omitempty"`
+}
+
+// KeepExisting reports whether the existing file at the given path should be kept
+// rather than replaced by a restored file with the given modification time. This
+// is never true when using the ConflictOverwrite policy.
+func (fs *Filesystem) KeepExisting(p string, mtime time.Time, policy ConflictPolicy) (bool, error) {
+	if policy != ConflictNewerWins && policy != ConflictSkip {
+		return false, nil
+	}
+	cleaned, err := fs.SafePath(p)
+	if err != nil {
+		return false, err
+	}
+	st, err := os.Lstat(cleaned)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.WithStack(err)
+	}
+	return keepExisting(st, mtime, policy), nil
+}
+
+// keepExisting reports whether the existing file described by st should be kept
+// rather than replaced by a file with the given modification time.
+func keepExisting(st os.FileInfo, mtime time.Time, policy ConflictPolicy) bool {
+	if st.IsDir() {
+		return false
+	}
+	switch policy {
+	case ConflictSkip:
+		return true
+	case ConflictNewerWins:
+		return st.ModTime().After(mtime)
+	default:
+		return false
+	}
+}
+
+// checkRestoredPath returns an error if the path of a file being restored is more
+// deeply nested or longer than is allowed by the configuration.
+func checkRestoredPath(p string) error {
+	cfg := config.Get().System.Backups
+	if cfg.RestoreMaxPathLength > 0 && len(p) > cfg.RestoreMaxPathLength {
+		return NewPathLimitError(p)
+	}
+	if cfg.RestoreMaxPathDepth > 0 {
+		var depth int
+		for _, c := range strings.Split(filepath.ToSlash(p), "/") {
+			if c != "" && c != "." {
+				depth++
+			}
+		}
+		if depth > cfg.RestoreMaxPathDepth {
+			return NewPathLimitError(p)
+		}
+	}
+	return nil
+}
+
+// writefile writes a file to the system, if limit is greater than zero the
+// write speed will be limited to that number of bytes per second.
+func (fs *Filesystem) writefile(p string, r io.Reader, limit int64, sparse bool) error {
 	cleaned, err := fs.SafePath(p)
 	if err != nil {
 		return err
@@ -153,11 +305,29 @@ func (fs *Filesystem) Writefile(p string, r io.Reader) error {
 	}
 	defer file.Close()
 
+	// Token bucket with a capacity of "limit" bytes, adding "limit" bytes/s and then
+	// wrap the file writer with the token bucket limiter.
+	var w io.Writer = file
+	var sw *sparseWriter
+	if sparse {
+		sw = newSparseWriter(file)
+		w = sw
+	}
+	if limit > 0 {
+		w = ratelimit.Writer(w, ratelimit.NewBucketWithRate(float64(limit), limit))
+	}
+
 	buf := make([]byte, 1024*4)
-	sz, err := io.CopyBuffer(file, r, buf)
+	sz, err := io.CopyBuffer(w, r, buf)
+	if err == nil && sw != nil {
+		err = sw.finish()
+	}
 
 	// Adjust the disk usage to account for the old size and the new size of the file.
 	fs.addDisk(sz - currentSize)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
 	return fs.Chown(cleaned)
 }
@@ -276,6 +446,31 @@ func (fs *Filesystem) Chmod(path string, mode os.FileMode) error {
 	return nil
 }
 
+// ChmodRestored sets the mode of a file that is being extracted from a backup or
+// an archive. This behaves the same as Chmod, except that the RestoreUmask
+// configuration option is applied to the mode first.
+func (fs *Filesystem) ChmodRestored(path string, mode os.FileMode) error {
+	mode, err := restoredMode(mode)
+	if err != nil {
+		return err
+	}
+	return fs.Chmod(path, mode)
+}
+
+// restoredMode returns the given mode with the configured restore umask applied
+// to its permission bits.
+func restoredMode(mode os.FileMode) (os.FileMode, error) {
+	umask := config.Get().System.Backups.RestoreUmask
+	if umask == "" {
+		return mode, nil
+	}
+	m, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil {
+		return 0, errors.Errorf("filesystem: invalid restore umask '%s': must be an octal number", umask)
+	}
+	return mode &^ (os.FileMode(m) & os.ModePerm), nil
+}
+
 // Begin looping up to 50 times to try and create a unique copy file name. This will take
 // an input of "file.txt" and generate "file copy.txt". If that name is already taken, it will
 // then try to write "file copy 2.txt" and so on, until reaching 50 loops. At that point we
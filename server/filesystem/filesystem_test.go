@@ -4,11 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 	"unicode/utf8"
 
 	. "github.com/franela/goblin"
@@ -169,6 +172,36 @@ func TestFilesystem_Writefile(t *testing.T) {
 			g.Assert(getFileContent(f)).Equal("new data")
 		})
 
+		g.It("writes the full contents of a rate limited restore", func() {
+			config.Update(func(c *config.Configuration) {
+				c.System.Backups.RestoreRateLimit = 1
+			})
+			defer config.Update(func(c *config.Configuration) {
+				c.System.Backups.RestoreRateLimit = 0
+			})
+
+			b := make([]byte, 64*1024)
+			_, err := rand.Read(b)
+			g.Assert(err).IsNil()
+
+			err = fs.WriteRestoredFile("test.txt", bytes.NewReader(b))
+			g.Assert(err).IsNil()
+
+			f, _, err := fs.File("test.txt")
+			g.Assert(err).IsNil()
+			defer f.Close()
+			g.Assert(getFileContent(f) == string(b)).IsTrue()
+			g.Assert(atomic.LoadInt64(&fs.diskUsed)).Equal(int64(len(b)))
+		})
+
+		g.It("returns an error when the contents cannot be copied", func() {
+			expected := errors.New("read failed")
+			r := io.MultiReader(bytes.NewReader([]byte("partial")), iotest.ErrReader(expected))
+
+			err := fs.Writefile("test.txt", r)
+			g.Assert(errors.Is(err, expected)).IsTrue()
+		})
+
 		g.AfterEach(func() {
 			buf.Truncate(0)
 			rfs.reset()
@@ -516,3 +549,75 @@ func TestFilesystem_Delete(t *testing.T) {
 		})
 	})
 }
+
+func TestFilesystem_ChmodRestored(t *testing.T) {
+	g := Goblin(t)
+	NewFs()
+
+	g.Describe("restoredMode", func() {
+		g.AfterEach(func() {
+			config.Update(func(c *config.Configuration) {
+				c.System.Backups.RestoreUmask = ""
+			})
+		})
+
+		g.It("uses the stored mode when no umask is configured", func() {
+			mode, err := restoredMode(0o777)
+			g.Assert(err).IsNil()
+			g.Assert(mode).Equal(os.FileMode(0o777))
+		})
+
+		g.It("applies the configured umask to the permission bits", func() {
+			config.Update(func(c *config.Configuration) {
+				c.System.Backups.RestoreUmask = "027"
+			})
+			mode, err := restoredMode(os.ModeSetuid | 0o777)
+			g.Assert(err).IsNil()
+			g.Assert(mode).Equal(os.ModeSetuid | 0o750)
+		})
+
+		g.It("returns an error for an invalid umask", func() {
+			config.Update(func(c *config.Configuration) {
+				c.System.Backups.RestoreUmask = "999"
+			})
+			_, err := restoredMode(0o644)
+			g.Assert(err).IsNotNil()
+		})
+	})
+}
+
+func TestFilesystem_KeepExisting(t *testing.T) {
+	g := Goblin(t)
+	fs, rfs := NewFs()
+
+	g.Describe("KeepExisting", func() {
+		g.AfterEach(func() {
+			rfs.reset()
+		})
+
+		g.It("keeps files that are newer than the restored file with NewerWins", func() {
+			g.Assert(rfs.CreateServerFileFromString("existing.txt", "test")).IsNil()
+			now := time.Now()
+			g.Assert(os.Chtimes(filepath.Join(rfs.root, "/server/existing.txt"), now, now)).IsNil()
+
+			for _, tc := range []struct {
+				p      string
+				mtime  time.Time
+				policy ConflictPolicy
+				keep   bool
+			}{
+				{"existing.txt", now.Add(-time.Hour), ConflictNewerWins, true},
+				{"existing.txt", now.Add(time.Hour), ConflictNewerWins, false},
+				{"existing.txt", now, ConflictNewerWins, false},
+				{"existing.txt", now.Add(-time.Hour), ConflictOverwrite, false},
+				{"missing.txt", now.Add(-time.Hour), ConflictNewerWins, false},
+				{"existing.txt", now.Add(time.Hour), ConflictSkip, true},
+				{"missing.txt", now.Add(time.Hour), ConflictSkip, false},
+			} {
+				keep, err := fs.KeepExisting(tc.p, tc.mtime, tc.policy)
+				g.Assert(err).IsNil()
+				g.Assert(keep).Equal(tc.keep)
+			}
+		})
+	})
+}
@@ -0,0 +1,23 @@
+package filesystem
+
+import (
+	"os"
+	"syscall"
+
+	"emperror.dev/errors"
+)
+
+// syncDir flushes the entries of the directory to the disk, making the creation
+// and renaming of the files within it durable. Filesystems that do not support
+// syncing a directory are ignored.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOTSUP) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+package filesystem
+
+// syncDir does nothing on this platform, directories cannot be synced and the
+// entries of a directory are made durable along with the files themselves.
+func syncDir(dir string) error {
+	return nil
+}
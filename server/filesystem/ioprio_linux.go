@@ -0,0 +1,37 @@
+package filesystem
+
+import (
+	"runtime"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+	ioprioClassIdle  = 3
+)
+
+// lowerIOPriority moves the calling goroutine to the idle I/O scheduling class
+// so that any other I/O on the system is always favored over it. I/O priorities
+// are applied per-thread on Linux, so the goroutine is locked to its current OS
+// thread until the returned function is called, at which point the original
+// priority is restored.
+func lowerIOPriority() (func(), error) {
+	runtime.LockOSThread()
+
+	// A "who" of zero targets the calling thread.
+	prev, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_GET, ioprioWhoProcess, 0, 0)
+	if errno != 0 {
+		runtime.UnlockOSThread()
+		return nil, errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, ioprioClassIdle<<ioprioClassShift); errno != 0 {
+		runtime.UnlockOSThread()
+		return nil, errno
+	}
+
+	return func() {
+		_, _, _ = syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, prev)
+		runtime.UnlockOSThread()
+	}, nil
+}
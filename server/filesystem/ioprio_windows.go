@@ -0,0 +1,8 @@
+package filesystem
+
+import "emperror.dev/errors"
+
+// lowerIOPriority is not supported on this platform.
+func lowerIOPriority() (func(), error) {
+	return nil, errors.New("filesystem: i/o priorities are not supported on this platform")
+}
@@ -0,0 +1,24 @@
+package filesystem
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+)
+
+// systemLoad returns the one minute load average of the system.
+func systemLoad() (float64, bool) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	fields := bytes.Fields(b)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(string(fields[0]), 64)
+	if err != nil {
+		return 0, false
+	}
+	return load, true
+}
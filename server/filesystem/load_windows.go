@@ -0,0 +1,6 @@
+package filesystem
+
+// systemLoad is not supported on this platform.
+func systemLoad() (float64, bool) {
+	return 0, false
+}
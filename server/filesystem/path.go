@@ -3,6 +3,7 @@ package filesystem
 import (
 	"context"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -109,6 +110,28 @@ func (fs *Filesystem) unsafeIsInDataDirectory(p string) bool {
 	return strings.HasPrefix(strings.TrimSuffix(p, "/")+"/", strings.TrimSuffix(fs.Path(), "/")+"/")
 }
 
+// safeJoin joins the name of an entry from an archive onto the base directory it
+// is being extracted into, returning an error if the entry attempts to escape the
+// base directory. Absolute entry names are treated as being relative to the base
+// directory. This is a purely lexical check and does not resolve symlinks, the
+// returned path must still be passed through fs.SafePath before it is used.
+func safeJoin(base string, entry string) (string, error) {
+	if strings.IndexByte(entry, 0) != -1 || strings.IndexByte(base, 0) != -1 {
+		return "", NewBadPathResolution(entry, "")
+	}
+	if c := path.Clean(strings.TrimLeft(entry, "/")); c == ".." || strings.HasPrefix(c, "../") {
+		return "", NewBadPathResolution(entry, "")
+	}
+	// Cleaning the entry as an absolute path means it cannot climb out of the base,
+	// an empty base is the current directory, which every joined path is within.
+	base = filepath.Clean(base)
+	joined := filepath.Join(base, path.Clean("/"+entry))
+	if base != "." && joined != base && !strings.HasPrefix(joined, strings.TrimSuffix(base, "/")+"/") {
+		return "", NewBadPathResolution(entry, joined)
+	}
+	return joined, nil
+}
+
 // Executes the fs.SafePath function in parallel against an array of paths. If any of the calls
 // fails an error will be returned.
 func (fs *Filesystem) ParallelSafePath(paths []string) ([]string, error) {
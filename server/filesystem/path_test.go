@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"emperror.dev/errors"
@@ -217,3 +218,74 @@ func TestFilesystem_Blocks_Symlinks(t *testing.T) {
 
 	rfs.reset()
 }
+
+func TestSafeJoin(t *testing.T) {
+	g := Goblin(t)
+
+	g.Describe("safeJoin", func() {
+		g.It("joins entries onto the base directory", func() {
+			for entry, expected := range map[string]string{
+				"test.txt":          "/base/test.txt",
+				"/test.txt":         "/base/test.txt",
+				"./a/b/../test.txt": "/base/a/test.txt",
+				"a//b/":             "/base/a/b",
+				"":                  "/base",
+			} {
+				p, err := safeJoin("/base", entry)
+				g.Assert(err).IsNil()
+				g.Assert(p).Equal(expected)
+			}
+		})
+
+		g.It("joins entries onto an empty or relative base directory", func() {
+			for _, base := range []string{"", "."} {
+				for entry, expected := range map[string]string{
+					"test.txt":          "test.txt",
+					"/test.txt":         "test.txt",
+					"./a/b/../test.txt": "a/test.txt",
+					"foo/bar.txt":       "foo/bar.txt",
+					"":                  ".",
+				} {
+					p, err := safeJoin(base, entry)
+					g.Assert(err).IsNil()
+					g.Assert(p).Equal(expected)
+				}
+				for _, entry := range []string{"..", "../test.txt", "a/../../test.txt"} {
+					_, err := safeJoin(base, entry)
+					g.Assert(IsErrorCode(err, ErrCodePathResolution)).IsTrue()
+				}
+			}
+		})
+
+		g.It("rejects entries that escape the base directory", func() {
+			for _, entry := range []string{"..", "../test.txt", "/../test.txt", "a/../../test.txt", "a\x00b"} {
+				_, err := safeJoin("/base", entry)
+				g.Assert(IsErrorCode(err, ErrCodePathResolution)).IsTrue()
+			}
+		})
+	})
+}
+
+func FuzzSafeJoin(f *testing.F) {
+	for _, base := range []string{"/base/dir", "", "."} {
+		for _, seed := range []string{"test.txt", "../test.txt", "/etc/passwd", "a/../../b", "a\x00b", "//..//..", "..\\..\\b", "symlink/../../b"} {
+			f.Add(base, seed)
+		}
+	}
+	f.Fuzz(func(t *testing.T, base string, entry string) {
+		p, err := safeJoin(base, entry)
+		if err != nil {
+			return
+		}
+		if b := filepath.Clean(base); b == "." {
+			if filepath.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+				t.Fatalf("entry %q resolved to %q which is outside of %q", entry, p, base)
+			}
+		} else if p != b && !strings.HasPrefix(p, strings.TrimSuffix(b, "/")+"/") {
+			t.Fatalf("entry %q resolved to %q which is outside of %q", entry, p, base)
+		}
+		if strings.IndexByte(p, 0) != -1 {
+			t.Fatalf("entry %q resolved to %q which contains a null byte", entry, p)
+		}
+	})
+}
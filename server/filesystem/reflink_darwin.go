@@ -0,0 +1,10 @@
+package filesystem
+
+import (
+	"os"
+)
+
+// reflink is not supported on this platform.
+func reflink(dst *os.File, src *os.File) error {
+	return errReflinkUnsupported
+}
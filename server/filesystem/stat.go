@@ -9,6 +9,12 @@ import (
 	"github.com/goccy/go-json"
 )
 
+// fileID uniquely identifies a file on the system.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
 type Stat struct {
 	os.FileInfo
 	Mimetype string
@@ -1,6 +1,7 @@
 package filesystem
 
 import (
+	"os"
 	"syscall"
 	"time"
 )
@@ -11,3 +12,44 @@ func (s *Stat) CTime() time.Time {
 
 	return time.Unix(st.Ctimespec.Sec, st.Ctimespec.Nsec)
 }
+
+// accessTime returns the time that the file was last accessed.
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(st.Atimespec.Sec, st.Atimespec.Nsec), true
+}
+
+// atimeReliable reports whether the filesystem containing the given path keeps
+// track of the access time of files, which is not the case for noatime mounts.
+func atimeReliable(p string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return false
+	}
+	// MNT_NOATIME, which is not exposed by the syscall package.
+	return st.Flags&0x10000000 == 0
+}
+
+// deviceNumbers returns the major and minor device numbers of a device file.
+func deviceNumbers(fi os.FileInfo) (int64, int64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	dev := uint32(st.Rdev)
+	return int64((dev >> 24) & 0xff), int64(dev & 0xffffff), true
+}
+
+// hardlinkID returns the unique identifier of the file on the system along with
+// the number of hardlinks pointing to it.
+func hardlinkID(fi os.FileInfo) (fileID, uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 0, false
+	}
+	// Do not remove these "redundant" type-casts, they are required for 32-bit builds to work.
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, uint64(st.Nlink), true
+}
@@ -1,6 +1,7 @@
 package filesystem
 
 import (
+	"os"
 	"syscall"
 	"time"
 )
@@ -12,3 +13,48 @@ func (s *Stat) CTime() time.Time {
 	// Do not remove these "redundant" type-casts, they are required for 32-bit builds to work.
 	return time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
 }
+
+// accessTime returns the time that the file was last accessed.
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	// Do not remove these "redundant" type-casts, they are required for 32-bit builds to work.
+	return time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec)), true
+}
+
+// atimeReliable reports whether the filesystem containing the given path keeps
+// track of the access time of files, which is not the case for noatime mounts.
+func atimeReliable(p string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return false
+	}
+	// ST_NOATIME, which is not exposed by the syscall package.
+	return st.Flags&0x400 == 0
+}
+
+// deviceNumbers returns the major and minor device numbers of a device file.
+func deviceNumbers(fi os.FileInfo) (int64, int64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	// Do not remove these "redundant" type-casts, they are required for 32-bit builds to work.
+	dev := uint64(st.Rdev)
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff)
+	minor := (dev & 0xff) | ((dev >> 12) &^ 0xff)
+	return int64(major), int64(minor), true
+}
+
+// hardlinkID returns the unique identifier of the file on the system along with
+// the number of hardlinks pointing to it.
+func hardlinkID(fi os.FileInfo) (fileID, uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 0, false
+	}
+	// Do not remove these "redundant" type-casts, they are required for 32-bit builds to work.
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, uint64(st.Nlink), true
+}
@@ -1,6 +1,7 @@
 package filesystem
 
 import (
+	"os"
 	"time"
 )
 
@@ -10,3 +11,24 @@ import (
 func (s *Stat) CTime() time.Time {
 	return s.ModTime()
 }
+
+// accessTime is not supported on windows, access times are not updated by
+// default on NTFS.
+func accessTime(fi os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// atimeReliable always returns false on windows.
+func atimeReliable(p string) bool {
+	return false
+}
+
+// deviceNumbers is not supported on windows.
+func deviceNumbers(fi os.FileInfo) (int64, int64, bool) {
+	return 0, 0, false
+}
+
+// hardlinkID is not supported on windows.
+func hardlinkID(fi os.FileInfo) (fileID, uint64, bool) {
+	return fileID{}, 0, false
+}